@@ -2,11 +2,15 @@ package api
 
 import (
   "encoding/json"
+  "errors"
   "fmt"
-  "image/jpeg"
+  "io"
+  "log"
   "net/http"
+  "os"
   "strconv"
   "strings"
+  "time"
 
   "github.com/jimmc/mimsrv/auth"
   "github.com/jimmc/mimsrv/content"
@@ -16,6 +20,7 @@ import (
 type Config struct {
   Prefix string         // The path prefix being routed to this handler
   ContentHandler content.Handler
+  MaxUploadBytes int64  // Max size of an upload request, 0 for no limit
 }
 
 type handler struct {
@@ -29,8 +34,20 @@ func NewHandler(c *Config) http.Handler {
   mux.HandleFunc(h.apiPrefix("list"), h.list)
   mux.HandleFunc(h.apiPrefix("image"), h.image)
   mux.HandleFunc(h.apiPrefix("video"), h.video)
+  mux.HandleFunc(h.apiPrefix("hls"), h.hls)
+  mux.HandleFunc(strings.TrimSuffix(h.apiPrefix("jobs"), "/"), h.jobs)
+  mux.HandleFunc(h.apiPrefix("jobs"), h.jobs)
   mux.HandleFunc(h.apiPrefix("index"), h.index)
   mux.HandleFunc(h.apiPrefix("text"), h.text)
+  mux.HandleFunc(h.apiPrefix("search"), h.search)
+  mux.HandleFunc(h.apiPrefix("exif"), h.exif)
+  mux.HandleFunc(h.apiPrefix("geo"), h.geo)
+  mux.HandleFunc(h.apiPrefix("album"), h.album)
+  mux.HandleFunc(h.apiPrefix("tags"), h.tags)
+  mux.HandleFunc(h.apiPrefix("upload"), h.upload)
+  mux.HandleFunc(h.apiPrefix("archive"), h.archive)
+  mux.HandleFunc(strings.TrimSuffix(h.apiPrefix("events"), "/"), h.events)
+  mux.HandleFunc(h.apiPrefix("events"), h.events)
   return mux
 }
 
@@ -42,13 +59,27 @@ func (h *handler) list(w http.ResponseWriter, r *http.Request) {
     return
   }
 
+  minRating, err := formParamInt(r, "minRating")
+  if err != nil {
+    http.Error(w, err.Error(), http.StatusBadRequest)
+    return
+  }
+  options := content.ListOptions{
+    IncludeExif: formParamBool(r, "exif"),
+    MinRating: minRating,
+    Flag: r.FormValue("flag"),
+  }
+
   var result *content.ListResult
-  var err error
   var status int
-  if strings.HasSuffix(path, ".mpr") {
-    result, err, status = h.config.ContentHandler.ListFromIndex(path)
+  if path == content.DateAlbumPrefix || strings.HasPrefix(path, content.DateAlbumPrefix + "/") {
+    result, err, status = h.config.ContentHandler.ListByDate(path, options)
+  } else if path == content.TagAlbumPrefix || strings.HasPrefix(path, content.TagAlbumPrefix + "/") {
+    result, err, status = h.config.ContentHandler.ListByTag(path, options)
+  } else if strings.HasSuffix(path, ".mpr") {
+    result, err, status = h.config.ContentHandler.ListFromIndex(path, options)
   } else {
-    result, err, status = h.config.ContentHandler.List(path)
+    result, err, status = h.config.ContentHandler.List(path, options)
   }
   if err != nil {
     http.Error(w, err.Error(), status)
@@ -60,6 +91,30 @@ func (h *handler) list(w http.ResponseWriter, r *http.Request) {
     http.Error(w, fmt.Sprintf("Failed to create json dir: %v", err), http.StatusInternalServerError)
     return
   }
+  // Building the list is what takes the time, but we can at least save
+  // sending it again if the client already has the same data.
+  if checkNotModified(w, r, etagFor(string(b)), time.Time{}) {
+    return
+  }
+  w.WriteHeader(http.StatusOK)
+  w.Write(b)
+}
+
+func (h *handler) search(w http.ResponseWriter, r *http.Request) {
+  path := strings.TrimPrefix(r.URL.Path, h.apiPrefix("search"))
+  query := r.FormValue("q")
+
+  result, err, status := h.config.ContentHandler.Search(path, query)
+  if err != nil {
+    http.Error(w, err.Error(), status)
+    return
+  }
+
+  b, err := json.MarshalIndent(result, "", "  ")
+  if err != nil {
+    http.Error(w, fmt.Sprintf("Failed to create json search result: %v", err), http.StatusInternalServerError)
+    return
+  }
   w.WriteHeader(http.StatusOK)
   w.Write(b)
 }
@@ -85,18 +140,103 @@ func (h *handler) image(w http.ResponseWriter, r *http.Request) {
     return
   }
 
-  im, err, status := h.config.ContentHandler.Image(path, width, height, rot)
+  quality, err := formParamInt(r, "q")
+  if err != nil {
+    http.Error(w, err.Error(), http.StatusBadRequest)
+    return
+  }
+
+  options := content.ImageOptions{
+    Raw: formParamBool(r, "raw"),         // show the original, without crop or adjustments
+    Format: imageFormat(r),
+    Quality: quality,
+  }
+
+  version, modTime, err, status := h.config.ContentHandler.ImageVersion(path)
+  if err != nil {
+    http.Error(w, err.Error(), status)
+    return
+  }
+  // The format can depend on the Accept header.
+  w.Header().Set("Vary", "Accept")
+  if checkNotModified(w, r, etagFor(version, width, height, rot, options), modTime) {
+    return
+  }
+
+  b, contentType, err, status := h.config.ContentHandler.ImageBytes(path, width, height, rot, options)
+  if err != nil {
+    http.Error(w, err.Error(), status)
+    return
+  }
+
+  w.Header().Set("Content-Type", contentType)
+  w.WriteHeader(http.StatusOK)
+  w.Write(b)
+}
+
+func (h *handler) exif(w http.ResponseWriter, r *http.Request) {
+  path := strings.TrimPrefix(r.URL.Path, h.apiPrefix("exif"))
+  info, err, status := h.config.ContentHandler.Exif(path)
+  if err != nil {
+    http.Error(w, err.Error(), status)
+    return
+  }
+
+  b, err := json.MarshalIndent(info, "", "  ")
+  if err != nil {
+    http.Error(w, fmt.Sprintf("Failed to create json exif: %v", err), http.StatusInternalServerError)
+    return
+  }
+  w.WriteHeader(http.StatusOK)
+  w.Write(b)
+}
+
+func (h *handler) geo(w http.ResponseWriter, r *http.Request) {
+  path := strings.TrimPrefix(r.URL.Path, h.apiPrefix("geo"))
+  var bbox *content.BoundingBox
+  if bboxStr := r.FormValue("bbox"); bboxStr != "" {
+    var err error
+    bbox, err = content.ParseBoundingBox(bboxStr)
+    if err != nil {
+      http.Error(w, err.Error(), http.StatusBadRequest)
+      return
+    }
+  }
+
+  result, err, status := h.config.ContentHandler.Geo(path, bbox)
+  if err != nil {
+    http.Error(w, err.Error(), status)
+    return
+  }
+
+  b, err := json.MarshalIndent(result, "", "  ")
+  if err != nil {
+    http.Error(w, fmt.Sprintf("Failed to create json geo result: %v", err), http.StatusInternalServerError)
+    return
+  }
+  w.WriteHeader(http.StatusOK)
+  w.Write(b)
+}
+
+func (h *handler) archive(w http.ResponseWriter, r *http.Request) {
+  path := strings.TrimPrefix(r.URL.Path, h.apiPrefix("archive"))
+  options := content.ArchiveOptions{
+    Rotate: formParamBool(r, "rotate"),
+  }
+
+  archive, err, status := h.config.ContentHandler.Archive(path, options)
   if err != nil {
     http.Error(w, err.Error(), status)
     return
   }
 
-  w.Header().Set("Content-Type", "image/jpeg")
+  w.Header().Set("Content-Type", "application/zip")
+  w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", archive.Name + ".zip"))
   w.WriteHeader(http.StatusOK)
-  options := &jpeg.Options{
-    Quality: 90,
+  if err := archive.Write(w); err != nil {
+    // Too late to tell the client, other than by the zip file being bad.
+    log.Printf("Error writing archive of %s: %v", path, err)
   }
-  jpeg.Encode(w, im, options)
 }
 
 func (h *handler) video(w http.ResponseWriter, r *http.Request) {
@@ -110,9 +250,99 @@ func (h *handler) video(w http.ResponseWriter, r *http.Request) {
     http.Error(w, "Not a video file", http.StatusBadRequest)
     return
   }
+  // ServeFile handles the conditional and range headers for us, and it
+  // sets Last-Modified, but we need to give it the ETag.
+  if f, err := os.Stat(videoFilePath); err == nil {
+    w.Header().Set("ETag", etagFor(videoFilePath, f.ModTime().UnixNano(), f.Size()))
+    w.Header().Set("Cache-Control", cacheControl)
+  }
   http.ServeFile(w, r, videoFilePath)
 }
 
+// hls serves the HLS playlists and segments for a video, at paths such as
+// "dir/video.mts/playlist.m3u8". Until they are ready, it returns the
+// status of creating them with StatusAccepted, so the client can show
+// the progress and ask again later. A path with just the video returns
+// the status.
+func (h *handler) hls(w http.ResponseWriter, r *http.Request) {
+  path := strings.TrimPrefix(r.URL.Path, h.apiPrefix("hls"))
+  videoPath, name := h.config.ContentHandler.SplitHlsPath(path)
+  if videoPath == "" {
+    http.Error(w, "Not a video file", http.StatusBadRequest)
+    return
+  }
+  hlsStatus, err, status := h.config.ContentHandler.Hls(videoPath)
+  if err != nil {
+    http.Error(w, err.Error(), status)
+    return
+  }
+  if name == "" || hlsStatus.State != content.HlsStateReady {
+    b, err := json.MarshalIndent(hlsStatus, "", "  ")
+    if err != nil {
+      http.Error(w, fmt.Sprintf("Failed to create json HLS status: %v", err), http.StatusInternalServerError)
+      return
+    }
+    switch {
+    case name == "":
+      w.WriteHeader(http.StatusOK)
+    case hlsStatus.State == content.JobStateFailed:
+      w.WriteHeader(http.StatusInternalServerError)
+    default:
+      w.Header().Set("Retry-After", "2")
+      w.WriteHeader(http.StatusAccepted)
+    }
+    w.Write(b)
+    return
+  }
+
+  filePath, err, status := h.config.ContentHandler.HlsFilePath(videoPath, name)
+  if err != nil {
+    http.Error(w, err.Error(), status)
+    return
+  }
+  if strings.HasSuffix(name, ".m3u8") {
+    w.Header().Set("Content-Type", "application/vnd.apple.mpegurl")
+  } else if strings.HasSuffix(name, ".ts") {
+    w.Header().Set("Content-Type", "video/mp2t")
+  }
+  http.ServeFile(w, r, filePath)
+}
+
+// jobs lists the transcoding jobs that are queued, running or have failed.
+// A POST with a directory path queues jobs to transcode the videos in that
+// directory, so that they are ready before anyone asks for them.
+func (h *handler) jobs(w http.ResponseWriter, r *http.Request) {
+  var result []content.Job
+  if r.Method == http.MethodPost {
+    if !auth.CurrentUserHasPermission(r, permissions.CanAdmin) {
+      http.Error(w, "Not authorized to prewarm", http.StatusUnauthorized)
+      return
+    }
+    path := strings.TrimPrefix(r.URL.Path, strings.TrimSuffix(h.apiPrefix("jobs"), "/"))
+    options := content.PrewarmOptions{
+      Recursive: formParamBool(r, "recursive"),
+      Hls: formParamBool(r, "hls"),
+    }
+    var err error
+    var status int
+    result, err, status = h.config.ContentHandler.Prewarm(path, options)
+    if err != nil {
+      http.Error(w, err.Error(), status)
+      return
+    }
+  } else {
+    result = h.config.ContentHandler.Jobs()
+  }
+
+  b, err := json.MarshalIndent(result, "", "  ")
+  if err != nil {
+    http.Error(w, fmt.Sprintf("Failed to create json jobs: %v", err), http.StatusInternalServerError)
+    return
+  }
+  w.WriteHeader(http.StatusOK)
+  w.Write(b)
+}
+
 func (h *handler) index(w http.ResponseWriter, r *http.Request) {
   if !auth.CurrentUserHasPermission(r, permissions.CanEdit) {
     http.Error(w, "Not authorized to edit", http.StatusUnauthorized)
@@ -127,19 +357,59 @@ func (h *handler) index(w http.ResponseWriter, r *http.Request) {
   item := r.FormValue("item")   // name of the index item on which to operate
   action := r.FormValue("action") // action to take on an index item
   value := r.FormValue("value")  // value that goes with the action
-  autocreateStr := r.FormValue("autocreate")
-  autocreate := false
-  if strings.ToLower(autocreateStr) == "true" {
-    autocreate = true;
+  autocreate := formParamBool(r, "autocreate")
+  commandsJson := r.FormValue("commands") // JSON list of commands to apply together
+
+  var err error
+  var status int
+  if commandsJson != "" {
+    var commands []content.UpdateCommand
+    if err := json.Unmarshal([]byte(commandsJson), &commands); err != nil {
+      http.Error(w, fmt.Sprintf("Failed to parse commands: %v", err), http.StatusBadRequest)
+      return
+    }
+    for i := range commands {
+      commands[i].Autocreate = autocreate
+    }
+    err, status = h.config.ContentHandler.UpdateImageIndexBatch(apiPath, commands)
+  } else {
+    command := content.UpdateCommand{
+      Item: item,
+      Action: action,
+      Value: value,
+      Autocreate: autocreate,
+    }
+    err, status = h.config.ContentHandler.UpdateImageIndex(apiPath, command)
   }
+  if err != nil {
+    http.Error(w, err.Error(), status)
+    return
+  }
+  w.WriteHeader(http.StatusOK)
+  w.Write([]byte(`{"status": "ok"}`))
+}
 
-  command := content.UpdateCommand{
-    Item: item,
-    Action: action,
-    Value: value,
-    Autocreate: autocreate,
+func (h *handler) album(w http.ResponseWriter, r *http.Request) {
+  if !auth.CurrentUserHasPermission(r, permissions.CanEdit) {
+    http.Error(w, "Not authorized to edit", http.StatusUnauthorized)
+    return
   }
-  err, status := h.config.ContentHandler.UpdateImageIndex(apiPath, command)
+  if r.Method != http.MethodPost {
+    http.Error(w, "POST method is required", http.StatusMethodNotAllowed)
+    return
+  }
+  apiPath := strings.TrimPrefix(r.URL.Path, h.apiPrefix("album"))
+  if err := r.ParseForm(); err != nil {
+    http.Error(w, err.Error(), http.StatusBadRequest)
+    return
+  }
+
+  command := content.AlbumCommand{
+    Action: r.FormValue("action"),        // create, rename, copy, delete or append
+    Value: r.FormValue("value"),          // new album path for rename and copy
+    Items: r.Form["item"],                // api paths of files for create and append
+  }
+  err, status := h.config.ContentHandler.UpdateAlbum(apiPath, command)
   if err != nil {
     http.Error(w, err.Error(), status)
     return
@@ -148,6 +418,132 @@ func (h *handler) index(w http.ResponseWriter, r *http.Request) {
   w.Write([]byte(`{"status": "ok"}`))
 }
 
+func (h *handler) tags(w http.ResponseWriter, r *http.Request) {
+  apiPath := strings.TrimPrefix(r.URL.Path, h.apiPrefix("tags"))
+  var result interface{}
+  switch r.Method {
+    case http.MethodGet:
+      if apiPath == "" {
+        result = h.config.ContentHandler.AllTags()
+        break
+      }
+      tags, err, status := h.config.ContentHandler.Tags(apiPath)
+      if err != nil {
+        http.Error(w, err.Error(), status)
+        return
+      }
+      result = tags
+    case http.MethodPost:
+      if !auth.CurrentUserHasPermission(r, permissions.CanEdit) {
+        http.Error(w, "Not authorized to edit", http.StatusUnauthorized)
+        return
+      }
+      if err := r.ParseForm(); err != nil {
+        http.Error(w, err.Error(), http.StatusBadRequest)
+        return
+      }
+      command := content.TagsCommand{
+        Action: r.FormValue("action"),    // add, remove or import
+        Tags: r.Form["tag"],
+      }
+      tags, err, status := h.config.ContentHandler.UpdateTags(apiPath, command)
+      if err != nil {
+        http.Error(w, err.Error(), status)
+        return
+      }
+      result = tags
+    default:
+      http.Error(w, "Method must be GET or POST", http.StatusMethodNotAllowed)
+      return
+  }
+  b, err := json.MarshalIndent(result, "", "  ")
+  if err != nil {
+    http.Error(w, fmt.Sprintf("Failed to create json for tags: %v", err), http.StatusInternalServerError)
+    return
+  }
+  w.WriteHeader(http.StatusOK)
+  w.Write(b)
+}
+
+func (h *handler) upload(w http.ResponseWriter, r *http.Request) {
+  if !auth.CurrentUserHasPermission(r, permissions.CanUpload) {
+    http.Error(w, "Not authorized to upload", http.StatusUnauthorized)
+    return
+  }
+  if r.Method != http.MethodPost {
+    http.Error(w, "POST method is required", http.StatusMethodNotAllowed)
+    return
+  }
+  apiPath := strings.TrimPrefix(r.URL.Path, h.apiPrefix("upload"))
+  if h.config.MaxUploadBytes > 0 {
+    r.Body = http.MaxBytesReader(w, r.Body, h.config.MaxUploadBytes)
+  }
+
+  options := content.UploadOptions{
+    Overwrite: queryParamBool(r, "overwrite"),
+    AddToIndex: queryParamBool(r, "index"),
+  }
+  // We read the parts one at a time rather than calling ParseMultipartForm
+  // so that we don't have to hold a whole set of videos in memory or in
+  // temp files. That means options must be in the query string, since
+  // calling FormValue would parse the whole form.
+  reader, err := r.MultipartReader()
+  if err != nil {
+    http.Error(w, fmt.Sprintf("Multipart form is required: %v", err), http.StatusBadRequest)
+    return
+  }
+  uploaded := make([]string, 0)
+  for {
+    part, err := reader.NextPart()
+    if err == io.EOF {
+      break
+    }
+    if err != nil {
+      http.Error(w, fmt.Sprintf("Error reading upload: %v", err), uploadErrorStatus(err, http.StatusBadRequest))
+      return
+    }
+    if part.FileName() == "" {
+      continue          // Not a file
+    }
+    err, status := h.config.ContentHandler.Upload(apiPath, part.FileName(), part, options)
+    part.Close()
+    if err != nil {
+      status = uploadErrorStatus(err, status)
+      if len(uploaded) > 0 {
+        err = fmt.Errorf("%v (after uploading %s)", err, strings.Join(uploaded, ", "))
+      }
+      http.Error(w, err.Error(), status)
+      return
+    }
+    uploaded = append(uploaded, part.FileName())
+  }
+  if len(uploaded) == 0 {
+    http.Error(w, "No files were uploaded", http.StatusBadRequest)
+    return
+  }
+
+  b, err := json.MarshalIndent(map[string]interface{}{
+    "status": "ok",
+    "Files": uploaded,
+  }, "", "  ")
+  if err != nil {
+    http.Error(w, fmt.Sprintf("Failed to create json upload result: %v", err), http.StatusInternalServerError)
+    return
+  }
+  w.WriteHeader(http.StatusOK)
+  w.Write(b)
+}
+
+// uploadErrorStatus returns StatusRequestEntityTooLarge if err came from
+// the upload exceeding MaxUploadBytes, else status.
+func uploadErrorStatus(err error, status int) int {
+  var tooLarge *http.MaxBytesError
+  if errors.As(err, &tooLarge) {
+    return http.StatusRequestEntityTooLarge
+  }
+  return status
+}
+
 func (h *handler) text(w http.ResponseWriter, r *http.Request) {
   path := strings.TrimPrefix(r.URL.Path, h.apiPrefix("text"))
   switch r.Method {
@@ -157,6 +553,10 @@ func (h *handler) text(w http.ResponseWriter, r *http.Request) {
         http.Error(w, err.Error(), status)
         return
       }
+      version, modTime, err, _ := h.config.ContentHandler.FileVersion(path)
+      if err == nil && checkNotModified(w, r, etagFor(version), modTime) {
+        return
+      }
       w.WriteHeader(http.StatusOK)
       w.Write(b)
       return
@@ -167,6 +567,7 @@ func (h *handler) text(w http.ResponseWriter, r *http.Request) {
       }
       cmd := content.UpdateTextCommand{
         Content: r.FormValue("content"),
+        Sidecar: formParamBool(r, "sidecar"),
       }
       err, status := h.config.ContentHandler.PutText(path, cmd)
       if err != nil {
@@ -182,6 +583,45 @@ func (h *handler) text(w http.ResponseWriter, r *http.Request) {
   }
 }
 
+// imageFormat returns the image format from the fmt parameter, or if there
+// is none, the first of JPEG, PNG or GIF that the Accept header lists by name,
+// highest quality value first. Browsers usually accept image/*, in which
+// case we return the empty string to let the content handler choose.
+func imageFormat(r *http.Request) string {
+  if format := r.FormValue("fmt"); format != "" {
+    return format
+  }
+  format := ""
+  bestQ := 0.0
+  for _, part := range strings.Split(r.Header.Get("Accept"), ",") {
+    fields := strings.Split(part, ";")
+    var f string
+    switch strings.ToLower(strings.TrimSpace(fields[0])) {
+    case "image/jpeg":
+      f = content.ImageFormatJpeg
+    case "image/png":
+      f = content.ImageFormatPng
+    case "image/gif":
+      f = content.ImageFormatGif
+    default:
+      continue
+    }
+    q := 1.0
+    for _, param := range fields[1:] {
+      param = strings.TrimSpace(param)
+      if strings.HasPrefix(param, "q=") {
+        if v, err := strconv.ParseFloat(strings.TrimPrefix(param, "q="), 64); err == nil {
+          q = v
+        }
+      }
+    }
+    if q > bestQ {
+      format, bestQ = f, q
+    }
+  }
+  return format
+}
+
 func (h *handler) apiPrefix(s string) string {
   return fmt.Sprintf("%s%s/", h.config.Prefix, s)
 }
@@ -197,3 +637,16 @@ func formParamInt(r *http.Request, name string) (int, error) {
   }
   return intVal, nil
 }
+
+// formParamBool returns true if the named parameter is "true" or "1".
+func formParamBool(r *http.Request, name string) bool {
+  strVal := strings.ToLower(r.FormValue(name))
+  return strVal == "true" || strVal == "1"
+}
+
+// queryParamBool is like formParamBool, but only looks at the URL query,
+// so it does not read the request body.
+func queryParamBool(r *http.Request, name string) bool {
+  strVal := strings.ToLower(r.URL.Query().Get(name))
+  return strVal == "true" || strVal == "1"
+}
@@ -1,10 +1,16 @@
 package api
 
 import (
+  "bufio"
   "encoding/json"
+  "io/ioutil"
   "net/http"
   "net/http/httptest"
+  "os"
+  "runtime"
+  "strings"
   "testing"
+  "time"
 
   "github.com/jimmc/mimsrv/content"
 )
@@ -93,3 +99,197 @@ func TestText(t *testing.T) {
     t.Errorf("text got %s want %s", got, want)
   }
 }
+
+func TestTextNotModified(t *testing.T) {
+  contentHandler := content.NewHandler(&content.Config{
+    ContentRoot: "../content/testdata",
+  })
+  h := handler{
+    config: &Config{
+      Prefix: "/api/",
+      ContentHandler: contentHandler,
+    },
+  }
+  handler := http.HandlerFunc(h.text)
+
+  req, err := http.NewRequest("GET", "/api/text/d1/image1.txt", nil)
+  if err != nil {
+    t.Fatalf("error creating text request: %v", err)
+  }
+  rr := httptest.NewRecorder()
+  handler.ServeHTTP(rr, req)
+  if got, want := rr.Code, http.StatusOK; got != want {
+    t.Fatalf("text call status: got %d, want %d", got, want)
+  }
+  etag := rr.Header().Get("ETag")
+  if etag == "" {
+    t.Fatalf("text response should include an ETag")
+  }
+  lastModified := rr.Header().Get("Last-Modified")
+  if lastModified == "" {
+    t.Fatalf("text response should include Last-Modified")
+  }
+  if got, want := rr.Header().Get("Cache-Control"), cacheControl; got != want {
+    t.Errorf("text Cache-Control: got %s, want %s", got, want)
+  }
+
+  req.Header.Set("If-None-Match", etag)
+  rr = httptest.NewRecorder()
+  handler.ServeHTTP(rr, req)
+  if got, want := rr.Code, http.StatusNotModified; got != want {
+    t.Errorf("text call with matching If-None-Match: got %d, want %d", got, want)
+  }
+  if got, want := rr.Body.String(), ""; got != want {
+    t.Errorf("not-modified body: got %s, want %s", got, want)
+  }
+
+  req.Header.Set("If-None-Match", `"something-else"`)
+  rr = httptest.NewRecorder()
+  handler.ServeHTTP(rr, req)
+  if got, want := rr.Code, http.StatusOK; got != want {
+    t.Errorf("text call with other If-None-Match: got %d, want %d", got, want)
+  }
+
+  req.Header.Del("If-None-Match")
+  req.Header.Set("If-Modified-Since", lastModified)
+  rr = httptest.NewRecorder()
+  handler.ServeHTTP(rr, req)
+  if got, want := rr.Code, http.StatusNotModified; got != want {
+    t.Errorf("text call with If-Modified-Since: got %d, want %d", got, want)
+  }
+}
+
+func TestListNotModified(t *testing.T) {
+  contentHandler := content.NewHandler(&content.Config{
+    ContentRoot: "../content/testdata",
+  })
+  h := handler{
+    config: &Config{
+      Prefix: "/api/",
+      ContentHandler: contentHandler,
+    },
+  }
+  handler := http.HandlerFunc(h.list)
+
+  req, err := http.NewRequest("GET", "/api/list/d1", nil)
+  if err != nil {
+    t.Fatalf("error creating list request: %v", err)
+  }
+  rr := httptest.NewRecorder()
+  handler.ServeHTTP(rr, req)
+  etag := rr.Header().Get("ETag")
+  if etag == "" {
+    t.Fatalf("list response should include an ETag")
+  }
+
+  req.Header.Set("If-None-Match", "W/" + etag)
+  rr = httptest.NewRecorder()
+  handler.ServeHTTP(rr, req)
+  if got, want := rr.Code, http.StatusNotModified; got != want {
+    t.Errorf("list call with matching If-None-Match: got %d, want %d", got, want)
+  }
+}
+
+func TestImageFormat(t *testing.T) {
+  testCases := []struct{
+    url string
+    accept string
+    want string
+  }{
+    { "/api/image/a.jpg", "", "" },
+    { "/api/image/a.jpg", "image/avif,image/webp,image/apng,image/*,*/*;q=0.8", "" },
+    { "/api/image/a.jpg", "image/png", "png" },
+    { "/api/image/a.jpg", "image/jpeg;q=0.5, image/png;q=0.9", "png" },
+    { "/api/image/a.jpg", "image/png;q=0.5, image/jpeg", "jpeg" },
+    { "/api/image/a.jpg", "image/png;q=0", "" },
+    { "/api/image/a.jpg?fmt=original", "image/png", "original" },
+  }
+  for _, tc := range testCases {
+    req, err := http.NewRequest("GET", tc.url, nil)
+    if err != nil {
+      t.Fatalf("error creating image request: %v", err)
+    }
+    if tc.accept != "" {
+      req.Header.Set("Accept", tc.accept)
+    }
+    if got := imageFormat(req); got != tc.want {
+      t.Errorf("imageFormat(%s, Accept: %s): got %q, want %q", tc.url, tc.accept, got, tc.want)
+    }
+  }
+}
+
+func TestEvents(t *testing.T) {
+  if runtime.GOOS != "linux" {
+    t.Skip("watching for changes is only supported on linux")
+  }
+  testDir, err := ioutil.TempDir("", "mimsrv-events")
+  if err != nil {
+    t.Fatalf("Unable to create test directory: %v", err)
+  }
+  defer os.RemoveAll(testDir)
+  if err := os.MkdirAll(testDir + "/a", 0744); err != nil {
+    t.Fatalf("Unable to create test directory: %v", err)
+  }
+  contentHandler := content.NewHandler(&content.Config{
+    ContentRoot: testDir,
+    Watch: true,
+  })
+  defer contentHandler.StopWatching()
+  h := handler{
+    config: &Config{
+      Prefix: "/api/",
+      ContentHandler: contentHandler,
+    },
+  }
+  server := httptest.NewServer(http.HandlerFunc(h.events))
+  defer server.Close()
+
+  resp, err := http.Get(server.URL + "/api/events/a")
+  if err != nil {
+    t.Fatalf("error requesting events: %v", err)
+  }
+  defer resp.Body.Close()
+  if got, want := resp.Header.Get("Content-Type"), "text/event-stream"; got != want {
+    t.Errorf("events Content-Type: got %s, want %s", got, want)
+  }
+
+  // The first file is not under the requested dir, so we should not see it.
+  if err := ioutil.WriteFile(testDir + "/skipped.txt", []byte("x"), 0644); err != nil {
+    t.Fatalf("Unable to write test file: %v", err)
+  }
+  time.Sleep(500 * time.Millisecond)
+  if err := ioutil.WriteFile(testDir + "/a/new.txt", []byte("x"), 0644); err != nil {
+    t.Fatalf("Unable to write test file: %v", err)
+  }
+
+  lines := make(chan string, 100)
+  go func() {
+    scanner := bufio.NewScanner(resp.Body)
+    for scanner.Scan() {
+      lines <- scanner.Text()
+    }
+    close(lines)
+  }()
+  timeout := time.After(5 * time.Second)
+  for {
+    select {
+    case line := <-lines:
+      if !strings.HasPrefix(line, "data: ") {
+        continue
+      }
+      var event content.ChangeEvent
+      if err := json.Unmarshal([]byte(strings.TrimPrefix(line, "data: ")), &event); err != nil {
+        t.Fatalf("error unmarshaling event: %v", err)
+      }
+      if got, want := event.Dir, "a"; got != want {
+        t.Errorf("event Dir: got %s, want %s", got, want)
+      }
+      if got, want := strings.Join(event.Names, ","), "new.txt"; got != want {
+        t.Errorf("event Names: got %s, want %s", got, want)
+      }
+      return
+    case <-timeout:
+      t.Fatalf("timed out waiting for change event")
+    }
+  }
+}
@@ -0,0 +1,76 @@
+package api
+
+import (
+  "crypto/sha256"
+  "fmt"
+  "net/http"
+  "strings"
+  "time"
+)
+
+const (
+  // The content is private to the logged-in user, and it can change
+  // (for example when an image is rotated) without the URL changing,
+  // so we let the client keep a copy but make it check with us before
+  // using it. That check is cheap when the client sends back our ETag.
+  cacheControl = "private, no-cache"
+)
+
+// etagFor returns a strong ETag derived from the given values.
+func etagFor(values ...interface{}) string {
+  sum := sha256.Sum256([]byte(fmt.Sprint(values...)))
+  return fmt.Sprintf(`"%x"`, sum[:16])
+}
+
+// checkNotModified sets the cache validation headers on the response, then
+// checks the conditional headers on the request. If they show that the
+// client already has the current version, it writes a 304 Not Modified
+// response and returns true, in which case the caller should not write
+// anything more. A zero modTime means we don't have a modification time.
+func checkNotModified(w http.ResponseWriter, r *http.Request, etag string, modTime time.Time) bool {
+  w.Header().Set("ETag", etag)
+  w.Header().Set("Cache-Control", cacheControl)
+  if !modTime.IsZero() {
+    w.Header().Set("Last-Modified", modTime.UTC().Format(http.TimeFormat))
+  }
+  if r.Method != http.MethodGet && r.Method != http.MethodHead {
+    return false
+  }
+  if inm := r.Header.Get("If-None-Match"); inm != "" {
+    // If-None-Match takes precedence over If-Modified-Since.
+    if !etagMatches(inm, etag) {
+      return false
+    }
+  } else {
+    ims := r.Header.Get("If-Modified-Since")
+    if ims == "" || modTime.IsZero() {
+      return false
+    }
+    t, err := http.ParseTime(ims)
+    if err != nil {
+      return false
+    }
+    // The header has only one-second resolution.
+    if modTime.Truncate(time.Second).After(t) {
+      return false
+    }
+  }
+  h := w.Header()
+  delete(h, "Content-Type")
+  delete(h, "Content-Length")
+  w.WriteHeader(http.StatusNotModified)
+  return true
+}
+
+// etagMatches returns true if etag is in the list of ETags given in
+// an If-None-Match header. For If-None-Match, weak ETags match their
+// strong equivalents.
+func etagMatches(header, etag string) bool {
+  for _, tag := range strings.Split(header, ",") {
+    tag = strings.TrimSpace(tag)
+    if tag == "*" || strings.TrimPrefix(tag, "W/") == strings.TrimPrefix(etag, "W/") {
+      return true
+    }
+  }
+  return false
+}
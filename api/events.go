@@ -0,0 +1,69 @@
+package api
+
+import (
+  "encoding/json"
+  "fmt"
+  "net/http"
+  "strings"
+  "time"
+
+  "github.com/jimmc/mimsrv/content"
+)
+
+const (
+  // How often we send a comment on an idle event stream, so that
+  // proxies don't decide the connection is dead.
+  eventKeepAliveInterval = 30 * time.Second
+)
+
+// events sends change events to the client as Server-Sent Events until
+// the client disconnects. If a path is given after the prefix, only
+// changes in that directory and below are sent.
+func (h *handler) events(w http.ResponseWriter, r *http.Request) {
+  path := strings.TrimPrefix(r.URL.Path, strings.TrimSuffix(h.apiPrefix("events"), "/"))
+  path = strings.Trim(path, "/")
+  flusher, ok := w.(http.Flusher)
+  if !ok {
+    http.Error(w, "Streaming is not supported", http.StatusInternalServerError)
+    return
+  }
+
+  events, cancel := h.config.ContentHandler.Subscribe()
+  defer cancel()
+
+  w.Header().Set("Content-Type", "text/event-stream")
+  w.Header().Set("Cache-Control", "no-cache")
+  w.WriteHeader(http.StatusOK)
+  flusher.Flush()
+
+  keepAlive := time.NewTicker(eventKeepAliveInterval)
+  defer keepAlive.Stop()
+  for {
+    select {
+    case <-r.Context().Done():
+      return
+    case <-keepAlive.C:
+      fmt.Fprintf(w, ": keepalive\n\n")
+      flusher.Flush()
+    case event, ok := <-events:
+      if !ok {
+        return
+      }
+      if !eventIsUnder(event, path) {
+        continue
+      }
+      b, err := json.Marshal(event)
+      if err != nil {
+        continue
+      }
+      fmt.Fprintf(w, "event: change\ndata: %s\n\n", b)
+      flusher.Flush()
+    }
+  }
+}
+
+// eventIsUnder returns true if the event is for the directory or
+// one of its subdirectories. The root directory is the empty string.
+func eventIsUnder(event content.ChangeEvent, dir string) bool {
+  return dir == "" || event.Dir == dir || strings.HasPrefix(event.Dir, dir + "/")
+}
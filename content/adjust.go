@@ -0,0 +1,121 @@
+package content
+
+import (
+  "fmt"
+  "image"
+  "strconv"
+  "strings"
+
+  "github.com/disintegration/imaging"
+)
+
+const (
+  brightnessAttribute = "brightness"
+  contrastAttribute = "contrast"
+  saturationAttribute = "saturation"
+  gammaAttribute = "gamma"
+  adjustNone = "none"   // Clears all adjustments
+)
+
+// imageAdjustment describes one of the adjustments we can apply to an
+// image, which are stored as attributes in the index entry.
+type imageAdjustment struct {
+  attribute string
+  min, max float64
+  neutral float64       // The value that makes no change
+  apply func(image.Image, float64) image.Image
+}
+
+// imageAdjustments are in the order we apply them.
+var imageAdjustments = []imageAdjustment{
+  { gammaAttribute, 0.1, 10, 1, func(im image.Image, v float64) image.Image {
+    return imaging.AdjustGamma(im, v)
+  }},
+  { brightnessAttribute, -100, 100, 0, func(im image.Image, v float64) image.Image {
+    return imaging.AdjustBrightness(im, v)
+  }},
+  { contrastAttribute, -100, 100, 0, func(im image.Image, v float64) image.Image {
+    return imaging.AdjustContrast(im, v)
+  }},
+  { saturationAttribute, -100, 500, 0, func(im image.Image, v float64) image.Image {
+    return imaging.AdjustSaturation(im, v)
+  }},
+}
+
+func findImageAdjustment(attribute string) *imageAdjustment {
+  for i := range imageAdjustments {
+    if imageAdjustments[i].attribute == attribute {
+      return &imageAdjustments[i]
+    }
+  }
+  return nil
+}
+
+// setAdjustments sets the adjustment attributes in the entry from a value
+// of the form key=value,key=value, such as brightness=10,gamma=1.2.
+// Brightness and contrast are percentages from -100 to 100, saturation is
+// a percentage from -100 to 500, and gamma is from 0.1 to 10. Setting an
+// adjustment to its neutral value (0, or 1 for gamma) removes it, and the
+// value none removes all of them. No changes are made if any part of the
+// value is not valid.
+func (e *imageEntry) setAdjustments(value string) error {
+  if value == adjustNone {
+    for _, adj := range imageAdjustments {
+      e.setAttribute(adj.attribute, "")
+    }
+    return nil
+  }
+  values := make(map[string]string)
+  for _, part := range strings.Split(value, ",") {
+    i := strings.Index(part, "=")
+    if i < 0 {
+      return fmt.Errorf("adjust value must be key=value,...")
+    }
+    key := strings.TrimSpace(part[:i])
+    adj := findImageAdjustment(key)
+    if adj == nil {
+      return fmt.Errorf("%s is not a valid adjustment", key)
+    }
+    f, err := strconv.ParseFloat(strings.TrimSpace(part[i+1:]), 64)
+    if err != nil || !(f >= adj.min && f <= adj.max) {
+      return fmt.Errorf("%s must be a number from %g to %g", key, adj.min, adj.max)
+    }
+    values[key] = ""
+    if f != adj.neutral {
+      values[key] = strconv.FormatFloat(f, 'f', -1, 64)
+    }
+  }
+  for _, adj := range imageAdjustments {
+    if v, ok := values[adj.attribute]; ok {
+      e.setAttribute(adj.attribute, v)
+    }
+  }
+  return nil
+}
+
+// hasAdjustments returns true if the index entry has any adjustments.
+func hasAdjustments(entry *imageEntry) bool {
+  for _, adj := range imageAdjustments {
+    if entry.attribute(adj.attribute) != "" {
+      return true
+    }
+  }
+  return false
+}
+
+// applyAdjustments applies the adjustments in the index entry to the image.
+// Values that are not valid are ignored.
+func applyAdjustments(im image.Image, entry *imageEntry) image.Image {
+  for _, adj := range imageAdjustments {
+    value := entry.attribute(adj.attribute)
+    if value == "" {
+      continue
+    }
+    f, err := strconv.ParseFloat(value, 64)
+    if err != nil || !(f >= adj.min && f <= adj.max) || f == adj.neutral {
+      continue
+    }
+    im = adj.apply(im, f)
+  }
+  return im
+}
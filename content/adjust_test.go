@@ -0,0 +1,104 @@
+package content
+
+import (
+  "image"
+  "image/color"
+  "image/png"
+  "os"
+  "testing"
+)
+
+func TestSetAdjustments(t *testing.T) {
+  testCases := []struct{
+    start string
+    value string
+    want string         // Empty if the value is not valid
+  }{
+    { "img.jpg", "brightness=10", "img.jpg;;brightness=10" },
+    { "img.jpg", "contrast=20, brightness=-5.5", "img.jpg;;brightness=-5.5;contrast=20" },
+    { "img.jpg;+r;rating=3", "gamma=1.2,saturation=50", "img.jpg;+r;rating=3;gamma=1.2;saturation=50" },
+    { "img.jpg;;brightness=10;contrast=20", "brightness=0", "img.jpg;;contrast=20" },
+    { "img.jpg;;gamma=2", "gamma=1", "img.jpg" },
+    { "img.jpg;;brightness=10;rating=2;gamma=2", "none", "img.jpg;;rating=2" },
+    { "img.jpg", "brightness=101", "" },
+    { "img.jpg", "saturation=-101", "" },
+    { "img.jpg", "gamma=0", "" },
+    { "img.jpg", "sharpness=10", "" },
+    { "img.jpg", "brightness", "" },
+    { "img.jpg", "brightness=10,contrast=x", "" },
+  }
+  for _, tc := range testCases {
+    entry := entryFromLine(tc.start)
+    err := entry.setAdjustments(tc.value)
+    if tc.want == "" {
+      if err == nil {
+        t.Errorf("setAdjustments(%q) should fail", tc.value)
+      }
+      if got := entry.toString(); got != tc.start {
+        t.Errorf("setAdjustments(%q) failed but changed the entry to %q", tc.value, got)
+      }
+      continue
+    }
+    if err != nil {
+      t.Errorf("setAdjustments(%q) failed: %v", tc.value, err)
+      continue
+    }
+    if got := entry.toString(); got != tc.want {
+      t.Errorf("setAdjustments(%q) on %q: got %q, want %q", tc.value, tc.start, got, tc.want)
+    }
+  }
+}
+
+func TestImageAdjust(t *testing.T) {
+  testDir := "testdata/tmp"
+  os.RemoveAll(testDir)
+  if err := os.MkdirAll(testDir, 0744); err != nil {
+    t.Fatalf("Unable to create test directory: %v", err)
+  }
+  defer os.RemoveAll(testDir)
+
+  gray := color.NRGBA{100, 100, 100, 255}
+  im := image.NewNRGBA(image.Rect(0, 0, 8, 8))
+  for y := 0; y < 8; y++ {
+    for x := 0; x < 8; x++ {
+      im.Set(x, y, gray)
+    }
+  }
+  f, err := os.Create(testDir + "/img.png")
+  if err != nil {
+    t.Fatalf("Unable to create test image: %v", err)
+  }
+  if err := png.Encode(f, im); err != nil {
+    t.Fatalf("Unable to write test image: %v", err)
+  }
+  f.Close()
+
+  h := NewHandler(&Config{
+    ContentRoot: testDir,
+  });
+  command := UpdateCommand{Item: "img.png", Action: "adjust", Value: "brightness=20", Autocreate: true}
+  if err, _ := h.UpdateImageIndex("index.mpr", command); err != nil {
+    t.Fatalf("failed to set adjustment: %v", err)
+  }
+  if err, _ := h.UpdateImageIndex("index.mpr", UpdateCommand{Item: "img.png", Action: "adjust", Value: "brightness=200"}); err == nil {
+    t.Errorf("adjust with brightness out of range should fail")
+  }
+
+  testCases := []struct{
+    options ImageOptions
+    brighter bool
+  }{
+    { ImageOptions{}, true },
+    { ImageOptions{Raw: true}, false },
+  }
+  for _, tc := range testCases {
+    got, err, _ := h.Image("img.png", 0, 0, 0, tc.options)
+    if err != nil {
+      t.Fatalf("Image failed: %v", err)
+    }
+    c := color.NRGBAModel.Convert(got.At(4, 4)).(color.NRGBA)
+    if brighter := c.R > gray.R; brighter != tc.brighter {
+      t.Errorf("Image(%+v): got color %v from %v, want brighter=%v", tc.options, c, gray, tc.brighter)
+    }
+  }
+}
@@ -0,0 +1,170 @@
+package content
+
+import (
+  "fmt"
+  "log"
+  "net/http"
+  "os"
+  "path"
+  "path/filepath"
+  "strings"
+)
+
+// AlbumCommand is a change to a whole index file, which we call an album
+// when it is used to collect images from several directories.
+type AlbumCommand struct {
+  Action string         // create, rename, copy, delete or append
+  Value string          // The new api path for rename and copy
+  Items []string        // Api paths of files for create and append
+}
+
+// UpdateAlbum creates, renames, copies, deletes or appends to the
+// index file at the specified api path.
+func (h *Handler) UpdateAlbum(apiPath string, command AlbumCommand) (error, int) {
+  apiPath = cleanApiPath(apiPath)
+  albumPath, err, status := h.albumFilePath(apiPath)
+  if err != nil {
+    return err, status
+  }
+  _, statErr := os.Stat(albumPath)
+  if command.Action != "create" && statErr != nil {
+    return fmt.Errorf("album %s does not exist", apiPath), http.StatusNotFound
+  }
+
+  // The index.mpr file holds the order and rotation of the images in its
+  // directory, which we only change with UpdateImageIndex.
+  if (command.Action == "rename" || command.Action == "delete") && path.Base(apiPath) == "index.mpr" {
+    return fmt.Errorf("can not %s index file %s", command.Action, apiPath), http.StatusBadRequest
+  }
+
+  switch command.Action {
+  case "create":
+    if statErr == nil {
+      return fmt.Errorf("album %s already exists", apiPath), http.StatusConflict
+    }
+    lines, err, status := h.albumLinesForItems(apiPath, nil, command.Items)
+    if err != nil {
+      return err, status
+    }
+    if err := writeFileLines(albumPath, lines); err != nil {
+      return fmt.Errorf("error writing album %s: %v", apiPath, err), http.StatusInternalServerError
+    }
+    log.Printf("Created album %s with %d items", albumPath, len(lines))
+    return nil, http.StatusOK
+  case "append":
+    if len(command.Items) == 0 {
+      return fmt.Errorf("no items to append"), http.StatusBadRequest
+    }
+    lines, err := readFileLines(albumPath)
+    if err != nil {
+      return fmt.Errorf("error reading album %s: %v", apiPath, err), http.StatusInternalServerError
+    }
+    lines, err, status := h.albumLinesForItems(apiPath, lines, command.Items)
+    if err != nil {
+      return err, status
+    }
+    if err := backupAndWriteFileLines(albumPath, lines); err != nil {
+      return err, http.StatusInternalServerError
+    }
+    return nil, http.StatusOK
+  case "rename", "copy":
+    newApiPath := cleanApiPath(command.Value)
+    newAlbumPath, err, status := h.albumFilePath(newApiPath)
+    if err != nil {
+      return err, status
+    }
+    if path.Base(newApiPath) == "index.mpr" {
+      return fmt.Errorf("can not %s album to index file %s", command.Action, newApiPath), http.StatusBadRequest
+    }
+    if _, err := os.Stat(newAlbumPath); err == nil {
+      return fmt.Errorf("album %s already exists", newApiPath), http.StatusConflict
+    }
+    lines, err := readFileLines(albumPath)
+    if err != nil {
+      return fmt.Errorf("error reading album %s: %v", apiPath, err), http.StatusInternalServerError
+    }
+    // The entries are relative to the album, so if it is going to a
+    // different directory, they have to change to match.
+    oldDir := path.Dir(apiPath)
+    newDir := path.Dir(newApiPath)
+    if oldDir != newDir {
+      for i, line := range lines {
+        if !isEntryLine(line) {
+          continue
+        }
+        entry := entryFromLine(line)
+        entry.filename = relativeApiPath(newDir, path.Join(oldDir, entry.filename))
+        lines[i] = entry.toString()
+      }
+    }
+    if err := writeFileLines(newAlbumPath, lines); err != nil {
+      return fmt.Errorf("error writing album %s: %v", newApiPath, err), http.StatusInternalServerError
+    }
+    if command.Action == "rename" {
+      if err := os.Remove(albumPath); err != nil {
+        return fmt.Errorf("error removing album %s after copying it: %v", apiPath, err), http.StatusInternalServerError
+      }
+    }
+    log.Printf("Album %s: %s to %s", command.Action, albumPath, newAlbumPath)
+    return nil, http.StatusOK
+  case "delete":
+    // Keep the file as a backup, as we do when updating index files.
+    if err := os.Rename(albumPath, albumPath + "~"); err != nil {
+      return fmt.Errorf("error deleting album %s: %v", apiPath, err), http.StatusInternalServerError
+    }
+    log.Printf("Deleted album %s", albumPath)
+    return nil, http.StatusOK
+  case "":
+    return fmt.Errorf("no action specified"), http.StatusBadRequest
+  }
+  return fmt.Errorf("action %s is not valid", command.Action), http.StatusBadRequest
+}
+
+// albumFilePath checks that the api path is for an index file in an
+// existing directory, and returns the path to the file.
+func (h *Handler) albumFilePath(apiPath string) (string, error, int) {
+  name := path.Base(apiPath)
+  if path.Ext(name) != indexExtension || strings.HasPrefix(name, ".") {
+    return "", fmt.Errorf("album name %s must end with %s", apiPath, indexExtension), http.StatusBadRequest
+  }
+  contentRoot := strings.TrimSuffix(h.config.ContentRoot, "/")
+  albumPath := fmt.Sprintf("%s/%s", contentRoot, apiPath)
+  if f, err := os.Stat(filepath.Dir(albumPath)); err != nil || !f.IsDir() {
+    return "", fmt.Errorf("directory for album %s does not exist", apiPath), http.StatusNotFound
+  }
+  return albumPath, nil, 0
+}
+
+// albumLinesForItems returns lines with entries added for the items, which
+// are api paths, skipping any that are already there. It is an error if
+// any item is not an image or video file.
+func (h *Handler) albumLinesForItems(albumApiPath string, lines []string, itemApiPaths []string) ([]string, error, int) {
+  contentRoot := strings.TrimSuffix(h.config.ContentRoot, "/")
+  albumPath := fmt.Sprintf("%s/%s", contentRoot, albumApiPath)
+  albumDir := path.Dir(albumApiPath)
+  for _, itemApiPath := range itemApiPaths {
+    item := relativeApiPath(albumDir, cleanApiPath(itemApiPath))
+    if err, status := h.checkIndexItemFile(albumPath, item); err != nil {
+      return nil, err, status
+    }
+    if i, _ := findEntry(lines, item); i >= 0 {
+      continue
+    }
+    entry := &imageEntry{
+      filename: item,
+      rotation: "xo",
+    }
+    lines = append(lines, entry.toString())
+  }
+  return lines, nil, 0
+}
+
+// relativeApiPath returns the path to get to the target from the directory,
+// where both are api paths.
+func relativeApiPath(dir, target string) string {
+  rel, err := filepath.Rel("/" + dir, "/" + target)
+  if err != nil {
+    return target       // Can't happen with two absolute paths
+  }
+  return filepath.ToSlash(rel)
+}
@@ -0,0 +1,106 @@
+package content
+
+import (
+  "io/ioutil"
+  "net/http"
+  "os"
+  "testing"
+)
+
+func TestUpdateAlbum(t *testing.T) {
+  testDir := "testdata/tmp"
+  os.RemoveAll(testDir)
+  for _, d := range []string{"/a", "/b", "/albums"} {
+    if err := os.MkdirAll(testDir + d, 0744); err != nil {
+      t.Fatalf("Unable to create test directory: %v", err)
+    }
+  }
+  defer os.RemoveAll(testDir)
+  for _, fn := range []string{"a/img1.jpg", "a/img2.jpg", "b/img3.jpg"} {
+    if err := ioutil.WriteFile(testDir + "/" + fn, []byte{}, 0644); err != nil {
+      t.Fatalf("Unable to create test file: %v", err)
+    }
+  }
+  h := NewHandler(&Config{
+    ContentRoot: testDir,
+  });
+
+  checkAlbum := func(apiPath, want string) {
+    t.Helper()
+    b, err := ioutil.ReadFile(testDir + "/" + apiPath)
+    if err != nil {
+      t.Errorf("Unable to read album %s: %v", apiPath, err)
+      return
+    }
+    if got := string(b); got != want {
+      t.Errorf("album %s: got %q, want %q", apiPath, got, want)
+    }
+  }
+  update := func(apiPath string, command AlbumCommand, wantStatus int) {
+    t.Helper()
+    err, status := h.UpdateAlbum(apiPath, command)
+    if got, want := status, wantStatus; got != want {
+      t.Errorf("%s of %s: got status %d (err %v), want %d", command.Action, apiPath, got, err, want)
+    }
+  }
+
+  update("albums/best.mpr", AlbumCommand{
+    Action: "create",
+    Items: []string{"a/img2.jpg", "/b/img3.jpg"},
+  }, http.StatusOK)
+  checkAlbum("albums/best.mpr", "../a/img2.jpg;xo\n../b/img3.jpg;xo\n")
+  update("albums/best.mpr", AlbumCommand{Action: "create"}, http.StatusConflict)
+  update("albums/best.txt", AlbumCommand{Action: "create"}, http.StatusBadRequest)
+  update("nodir/best.mpr", AlbumCommand{Action: "create"}, http.StatusNotFound)
+  update("albums/bad.mpr", AlbumCommand{
+    Action: "create",
+    Items: []string{"a/nosuchimage.jpg"},
+  }, http.StatusBadRequest)
+
+  update("albums/best.mpr", AlbumCommand{
+    Action: "append",
+    Items: []string{"a/img1.jpg", "a/img2.jpg"},
+  }, http.StatusOK)
+  checkAlbum("albums/best.mpr", "../a/img2.jpg;xo\n../b/img3.jpg;xo\n../a/img1.jpg;xo\n")
+  update("albums/nosuchalbum.mpr", AlbumCommand{
+    Action: "append",
+    Items: []string{"a/img1.jpg"},
+  }, http.StatusNotFound)
+
+  update("albums/best.mpr", AlbumCommand{Action: "copy", Value: "a/copy.mpr"}, http.StatusOK)
+  checkAlbum("albums/best.mpr", "../a/img2.jpg;xo\n../b/img3.jpg;xo\n../a/img1.jpg;xo\n")
+  checkAlbum("a/copy.mpr", "img2.jpg;xo\n../b/img3.jpg;xo\nimg1.jpg;xo\n")
+  update("albums/best.mpr", AlbumCommand{Action: "copy", Value: "a/copy.mpr"}, http.StatusConflict)
+
+  update("a/copy.mpr", AlbumCommand{Action: "rename", Value: "best2.mpr"}, http.StatusOK)
+  checkAlbum("best2.mpr", "a/img2.jpg;xo\nb/img3.jpg;xo\na/img1.jpg;xo\n")
+  if _, err := os.Stat(testDir + "/a/copy.mpr"); !os.IsNotExist(err) {
+    t.Errorf("renamed album should no longer exist")
+  }
+  list, err, _ := h.ListFromIndex("best2.mpr", ListOptions{})
+  if err != nil {
+    t.Fatalf("failed to list renamed album: %v", err)
+  }
+  if got, want := len(list.Items), 3; got != want {
+    t.Errorf("renamed album item count: got %d, want %d", got, want)
+  }
+
+  update("best2.mpr", AlbumCommand{Action: "delete"}, http.StatusOK)
+  if _, err := os.Stat(testDir + "/best2.mpr"); !os.IsNotExist(err) {
+    t.Errorf("deleted album should no longer exist")
+  }
+  checkAlbum("best2.mpr~", "a/img2.jpg;xo\nb/img3.jpg;xo\na/img1.jpg;xo\n")
+  update("best2.mpr", AlbumCommand{Action: "delete"}, http.StatusNotFound)
+  update("albums/best.mpr", AlbumCommand{Action: "frobnicate"}, http.StatusBadRequest)
+
+  // The index.mpr file for a directory can't be replaced or removed.
+  update("a/index.mpr", AlbumCommand{Action: "create", Items: []string{"a/img1.jpg"}}, http.StatusOK)
+  update("a/index.mpr", AlbumCommand{Action: "rename", Value: "a/moved.mpr"}, http.StatusBadRequest)
+  update("a/index.mpr", AlbumCommand{Action: "delete"}, http.StatusBadRequest)
+  update("albums/best.mpr", AlbumCommand{Action: "copy", Value: "b/index.mpr"}, http.StatusBadRequest)
+  update("albums/best.mpr", AlbumCommand{Action: "rename", Value: "b/index.mpr"}, http.StatusBadRequest)
+  checkAlbum("a/index.mpr", "img1.jpg;xo\n")
+  if _, err := os.Stat(testDir + "/b/index.mpr"); !os.IsNotExist(err) {
+    t.Errorf("album should not have been copied to index.mpr")
+  }
+}
@@ -0,0 +1,205 @@
+package content
+
+import (
+  "archive/zip"
+  "fmt"
+  "io"
+  "log"
+  "os"
+  "path"
+  "strings"
+  "time"
+
+  "github.com/disintegration/imaging"
+)
+
+const (
+  // Quality for images we re-encode after rotating them. Higher than
+  // jpegQuality because these are meant to replace the originals.
+  archiveJpegQuality = 95
+)
+
+// ArchiveOptions control what goes into an archive.
+type ArchiveOptions struct {
+  Rotate bool   // Rotate images as we display them, rather than including the originals
+}
+
+// Archive is the set of files to be written into a zip file.
+type Archive struct {
+  Name string    // Suggested name for the zip file, without extension
+  h *Handler
+  options ArchiveOptions
+  entries []archiveEntry
+}
+
+// archiveEntry is one image or video in an archive.
+type archiveEntry struct {
+  apiPath string        // The file to include
+  zipName string        // Its name within the zip file
+  modTime time.Time
+  text string           // Caption to write as a sidecar file, if not empty
+  reencode bool         // Write the image as it is displayed rather than the original
+}
+
+// Archive collects the images and videos in a directory, or listed in an
+// index file, for writing to a zip file. Subdirectories are not included.
+func (h *Handler) Archive(apiPath string, options ArchiveOptions) (*Archive, error, int) {
+  apiPath = cleanApiPath(apiPath)
+  var list *ListResult
+  var err error
+  var status int
+  var dirApiPath string
+  if strings.HasSuffix(apiPath, indexExtension) {
+    list, err, status = h.ListFromIndex(apiPath, ListOptions{})
+    dirApiPath = path.Dir(apiPath)
+  } else {
+    list, err, status = h.List(apiPath, ListOptions{})
+    dirApiPath = apiPath
+  }
+  if err != nil {
+    return nil, err, status
+  }
+
+  name := strings.TrimSuffix(path.Base(apiPath), indexExtension)
+  if apiPath == "" || name == "." {
+    name = "mimsrv"
+  }
+  a := &Archive{
+    Name: name,
+    h: h,
+    options: options,
+  }
+  used := make(map[string]bool)
+  for _, item := range list.Items {
+    if item.Type != MediaKindImage && item.Type != MediaKindVideo {
+      continue
+    }
+    itemApiPath := path.Join(dirApiPath, item.Name)
+    if item.Path != "" {
+      itemApiPath = cleanApiPath(item.Path)
+    }
+    name := item.Name
+    // We can't rotate the frames of an animated GIF without re-encoding
+    // all of them, so those always go in as they are.
+    reencode := options.Rotate && item.Type == MediaKindImage && !item.Animated && h.displayedRotated(itemApiPath)
+    if _, err := imaging.FormatFromExtension(path.Ext(name)); reencode && err != nil {
+      // We can only write this type of image as a JPEG.
+      name = strings.TrimSuffix(name, path.Ext(name)) + ".jpg"
+    }
+    a.entries = append(a.entries, archiveEntry{
+      apiPath: itemApiPath,
+      zipName: uniqueArchiveName(name, used),
+      modTime: time.Unix(item.ModTime, 0),
+      text: item.Text,
+      reencode: reencode,
+    })
+  }
+  return a, nil, 0
+}
+
+// displayedRotated returns true if the image is displayed differently from
+// how a viewer that follows its EXIF orientation would show it, either
+// because it is rotated or because its index entry overrides the EXIF
+// orientation. When we re-encode those, we don't include the EXIF data,
+// so that every image in the archive appears upright without it.
+func (h *Handler) displayedRotated(apiPath string) bool {
+  orientation := -1
+  if r := h.catalogRecordForPath(apiPath); r != nil {
+    orientation = r.Orientation
+  }
+  filePath := fmt.Sprintf("%s/%s", strings.TrimSuffix(h.config.ContentRoot, "/"), apiPath)
+  rot := h.rotationFromIndexAndExif(filePath, exifOrientationToRotation(orientation))
+  return rot != 0 || orientation > 1
+}
+
+// uniqueArchiveName returns name, or if that has already been used,
+// name with a number added to make it unique. An index file can list
+// files with the same name from different directories.
+func uniqueArchiveName(name string, used map[string]bool) string {
+  ext := path.Ext(name)
+  base := strings.TrimSuffix(name, ext)
+  unique := name
+  for n := 2; used[strings.ToLower(unique)] || used[strings.ToLower(base + textExtension)]; n++ {
+    base = fmt.Sprintf("%s-%d", strings.TrimSuffix(name, ext), n)
+    unique = base + ext
+  }
+  used[strings.ToLower(unique)] = true
+  used[strings.ToLower(base + textExtension)] = true
+  return unique
+}
+
+// Write writes the archive as a zip file, one file at a time, so that we
+// never have more than one image in memory. Captions are written as text
+// files next to their images. Since the caller will usually have started
+// sending the zip file by the time we get an error, we skip files that
+// we can't read rather than failing, and only return write errors.
+func (a *Archive) Write(w io.Writer) error {
+  zw := zip.NewWriter(w)
+  for _, entry := range a.entries {
+    if err := a.writeEntry(zw, entry); err != nil {
+      return err
+    }
+  }
+  return zw.Close()
+}
+
+func (a *Archive) writeEntry(zw *zip.Writer, entry archiveEntry) error {
+  filePath := fmt.Sprintf("%s/%s", strings.TrimSuffix(a.h.config.ContentRoot, "/"), entry.apiPath)
+  f, err := os.Open(filePath)
+  if err != nil {
+    log.Printf("Skipping %s in archive: %v", entry.apiPath, err)
+    return nil
+  }
+  defer f.Close()
+
+  header := &zip.FileHeader{
+    Name: entry.zipName,
+    // Images and videos are already compressed.
+    Method: zip.Store,
+    Modified: entry.modTime,
+  }
+  if entry.reencode {
+    // We only rotate; the originals are not cropped or adjusted.
+    im, err, _ := a.h.Image(entry.apiPath, 0, 0, 0, ImageOptions{Raw: true})
+    if err != nil {
+      log.Printf("Skipping %s in archive: %v", entry.apiPath, err)
+      return nil
+    }
+    // Archive gave the entry a .jpg name if we can't write its own format.
+    format, err := imaging.FormatFromExtension(path.Ext(entry.zipName))
+    if err != nil {
+      format = imaging.JPEG
+    }
+    zf, err := zw.CreateHeader(header)
+    if err != nil {
+      return err
+    }
+    if err := imaging.Encode(zf, im, format, imaging.JPEGQuality(archiveJpegQuality)); err != nil {
+      return err
+    }
+  } else {
+    zf, err := zw.CreateHeader(header)
+    if err != nil {
+      return err
+    }
+    if _, err := io.Copy(zf, f); err != nil {
+      return err
+    }
+  }
+
+  if entry.text != "" {
+    textHeader := &zip.FileHeader{
+      Name: strings.TrimSuffix(entry.zipName, path.Ext(entry.zipName)) + textExtension,
+      Method: zip.Deflate,
+      Modified: entry.modTime,
+    }
+    zf, err := zw.CreateHeader(textHeader)
+    if err != nil {
+      return err
+    }
+    if _, err := io.WriteString(zf, entry.text); err != nil {
+      return err
+    }
+  }
+  return nil
+}
@@ -0,0 +1,203 @@
+package content
+
+import (
+  "archive/zip"
+  "bytes"
+  "image"
+  "image/color"
+  "image/gif"
+  "io/ioutil"
+  "net/http"
+  "os"
+  "sort"
+  "strings"
+  "testing"
+)
+
+func TestArchive(t *testing.T) {
+  testDir := "testdata/tmp"
+  os.RemoveAll(testDir)
+  for _, d := range []string{"/a", "/b"} {
+    if err := os.MkdirAll(testDir + d, 0744); err != nil {
+      t.Fatalf("Unable to create test directory: %v", err)
+    }
+  }
+  defer os.RemoveAll(testDir)
+  for _, p := range []string{"/a/one.jpg", "/a/two.jpg", "/b/one.jpg"} {
+    if err := writeTestJpeg(testDir + p, 20, 10); err != nil {
+      t.Fatalf("Unable to create test image: %v", err)
+    }
+  }
+  files := map[string]string{
+    "/a/one.txt": "first caption",
+    "/a/index.mpr": "one.jpg;+r\ntwo.jpg\n",
+    "/a/both.mpr": "one.jpg\n../b/one.jpg\n",
+  }
+  for p, text := range files {
+    if err := ioutil.WriteFile(testDir + p, []byte(text), 0644); err != nil {
+      t.Fatalf("Unable to create test file: %v", err)
+    }
+  }
+
+  h := NewHandler(&Config{
+    ContentRoot: testDir,
+  });
+
+  if _, err, status := h.Archive("no-such-dir", ArchiveOptions{}); err == nil || status != http.StatusNotFound {
+    t.Errorf("archive of non-existent dir: got status %d, want %d", status, http.StatusNotFound)
+  }
+
+  zr := writeTestArchive(t, h, "a", ArchiveOptions{})
+  if got, want := zipNames(zr), "one.jpg,one.txt,two.jpg"; got != want {
+    t.Errorf("archive of dir: got %s, want %s", got, want)
+  }
+  original, err := ioutil.ReadFile(testDir + "/a/one.jpg")
+  if err != nil {
+    t.Fatalf("Unable to read test image: %v", err)
+  }
+  if got := zipFileBytes(t, zr, "one.jpg"); !bytes.Equal(got, original) {
+    t.Errorf("archive of dir should contain original image")
+  }
+  if got, want := string(zipFileBytes(t, zr, "one.txt")), "first caption"; got != want {
+    t.Errorf("archive caption: got %q, want %q", got, want)
+  }
+
+  zr = writeTestArchive(t, h, "a", ArchiveOptions{Rotate: true})
+  cfg, _, err := image.DecodeConfig(bytes.NewReader(zipFileBytes(t, zr, "one.jpg")))
+  if err != nil {
+    t.Fatalf("Unable to decode rotated image: %v", err)
+  }
+  if cfg.Width != 10 || cfg.Height != 20 {
+    t.Errorf("rotated image size: got %dx%d, want 10x20", cfg.Width, cfg.Height)
+  }
+  original, err = ioutil.ReadFile(testDir + "/a/two.jpg")
+  if err != nil {
+    t.Fatalf("Unable to read test image: %v", err)
+  }
+  if got := zipFileBytes(t, zr, "two.jpg"); !bytes.Equal(got, original) {
+    t.Errorf("image with no rotation should be the original")
+  }
+
+  zr = writeTestArchive(t, h, "a/both.mpr", ArchiveOptions{})
+  if got, want := zipNames(zr), "one-2.jpg,one.jpg,one.txt"; got != want {
+    t.Errorf("archive of index: got %s, want %s", got, want)
+  }
+}
+
+func TestArchiveRotateFormats(t *testing.T) {
+  testDir := "testdata/tmp"
+  os.RemoveAll(testDir)
+  if err := os.MkdirAll(testDir, 0744); err != nil {
+    t.Fatalf("Unable to create test directory: %v", err)
+  }
+  defer os.RemoveAll(testDir)
+
+  // A made-up image format that we can decode but not encode.
+  defer func(types []*MediaType) { mediaTypes = types }(mediaTypes)
+  RegisterMediaType(&MediaType{
+    Name: "blank",
+    Kind: MediaKindImage,
+    Extensions: []string{".blank"},
+    Optional: true,
+    Decode: func(filePath string) (image.Image, int, error) {
+      return image.NewNRGBA(image.Rect(0, 0, 30, 20)), -1, nil
+    },
+  })
+  if err := ioutil.WriteFile(testDir + "/odd.blank", []byte("blank"), 0644); err != nil {
+    t.Fatalf("Unable to create test image: %v", err)
+  }
+  // The EXIF orientation says to rotate, but the index entry overrides it.
+  orientation := &testExif{ifd0: []testIfdEntry{{ 0x0112, uint16(6) }}}
+  if err := writeTestJpegWithExif(testDir + "/upright.jpg", 20, 10, orientation); err != nil {
+    t.Fatalf("Unable to create test image: %v", err)
+  }
+  p := color.Palette{color.Black, color.White}
+  anim := &gif.GIF{
+    Image: []*image.Paletted{
+      image.NewPaletted(image.Rect(0, 0, 20, 10), p),
+      image.NewPaletted(image.Rect(0, 0, 20, 10), p),
+    },
+    Delay: []int{10, 10},
+  }
+  var gifBuf bytes.Buffer
+  if err := gif.EncodeAll(&gifBuf, anim); err != nil {
+    t.Fatalf("Unable to encode test image: %v", err)
+  }
+  if err := ioutil.WriteFile(testDir + "/anim.gif", gifBuf.Bytes(), 0644); err != nil {
+    t.Fatalf("Unable to create test image: %v", err)
+  }
+  if err := ioutil.WriteFile(testDir + "/index.mpr", []byte("anim.gif;+r\nodd.blank;+r\nupright.jpg\n"), 0644); err != nil {
+    t.Fatalf("Unable to create test index: %v", err)
+  }
+
+  h := NewHandler(&Config{
+    ContentRoot: testDir,
+    MediaTypes: []string{"blank"},
+  });
+  zr := writeTestArchive(t, h, "", ArchiveOptions{Rotate: true})
+  if got, want := zipNames(zr), "anim.gif,odd.jpg,upright.jpg"; got != want {
+    t.Errorf("archive with rotation: got %s, want %s", got, want)
+  }
+  if got := zipFileBytes(t, zr, "anim.gif"); !bytes.Equal(got, gifBuf.Bytes()) {
+    t.Errorf("animated GIF should be the original")
+  }
+  cfg, format, err := image.DecodeConfig(bytes.NewReader(zipFileBytes(t, zr, "odd.jpg")))
+  if err != nil || format != "jpeg" || cfg.Width != 20 || cfg.Height != 30 {
+    t.Errorf("rotated odd image: got %s %dx%d (%v), want jpeg 20x30", format, cfg.Width, cfg.Height, err)
+  }
+  // Re-encoded without the EXIF orientation, so that viewers don't rotate it.
+  b := zipFileBytes(t, zr, "upright.jpg")
+  if original, err := ioutil.ReadFile(testDir + "/upright.jpg"); err != nil || bytes.Equal(b, original) {
+    t.Errorf("image with overridden EXIF orientation should be re-encoded (%v)", err)
+  }
+  cfg, _, err = image.DecodeConfig(bytes.NewReader(b))
+  if err != nil || cfg.Width != 20 || cfg.Height != 10 {
+    t.Errorf("upright image: got %dx%d (%v), want 20x10", cfg.Width, cfg.Height, err)
+  }
+}
+
+func writeTestArchive(t *testing.T, h Handler, apiPath string, options ArchiveOptions) *zip.Reader {
+  t.Helper()
+  a, err, _ := h.Archive(apiPath, options)
+  if err != nil {
+    t.Fatalf("failed to create archive of %s: %v", apiPath, err)
+  }
+  var buf bytes.Buffer
+  if err := a.Write(&buf); err != nil {
+    t.Fatalf("failed to write archive of %s: %v", apiPath, err)
+  }
+  zr, err := zip.NewReader(bytes.NewReader(buf.Bytes()), int64(buf.Len()))
+  if err != nil {
+    t.Fatalf("failed to read archive of %s: %v", apiPath, err)
+  }
+  return zr
+}
+
+func zipNames(zr *zip.Reader) string {
+  names := make([]string, len(zr.File))
+  for i, f := range zr.File {
+    names[i] = f.Name
+  }
+  sort.Strings(names)
+  return strings.Join(names, ",")
+}
+
+func zipFileBytes(t *testing.T, zr *zip.Reader, name string) []byte {
+  t.Helper()
+  for _, f := range zr.File {
+    if f.Name == name {
+      r, err := f.Open()
+      if err != nil {
+        t.Fatalf("failed to open %s in zip: %v", name, err)
+      }
+      defer r.Close()
+      b, err := ioutil.ReadAll(r)
+      if err != nil {
+        t.Fatalf("failed to read %s in zip: %v", name, err)
+      }
+      return b
+    }
+  }
+  t.Fatalf("%s not found in zip", name)
+  return nil
+}
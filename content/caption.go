@@ -0,0 +1,139 @@
+package content
+
+import (
+  "bytes"
+  "encoding/xml"
+  "fmt"
+  "io/ioutil"
+  "os"
+  "path/filepath"
+  "strings"
+)
+
+// Values for ListItem.TextSource, saying where the caption text came from.
+const (
+  TextSourceTxt = "txt"                 // Our own .txt file
+  TextSourceSidecar = "sidecar"         // dc:description in an XMP sidecar file
+  TextSourceXmp = "xmp"                 // dc:description in XMP in the image file
+  TextSourceIptc = "iptc"               // IPTC caption in the image file
+)
+
+const (
+  xmpExtension = ".xmp"
+
+  // What we write when we create a new XMP sidecar file.
+  newXmpSidecar = `<?xpacket begin="` + "\ufeff" + `" id="W5M0MpCehiHzreSzNTczkc9d"?>
+<x:xmpmeta xmlns:x="adobe:ns:meta/">
+ <rdf:RDF xmlns:rdf="http://www.w3.org/1999/02/22-rdf-syntax-ns#">
+  <rdf:Description rdf:about="">
+  </rdf:Description>
+ </rdf:RDF>
+</x:xmpmeta>
+<?xpacket end="w"?>
+`
+)
+
+// xmpSidecarPathFor returns the path to the XMP sidecar file for a media
+// file. Lightroom names it like our text files, img.xmp, while some other
+// programs add .xmp to the full name, img.jpg.xmp. We use whichever one
+// exists, or the Lightroom name if neither does.
+func xmpSidecarPathFor(filePath string) string {
+  sidecarPath := strings.TrimSuffix(filePath, filepath.Ext(filePath)) + xmpExtension
+  if _, err := os.Stat(sidecarPath); err != nil {
+    if _, err := os.Stat(filePath + xmpExtension); err == nil {
+      return filePath + xmpExtension
+    }
+  }
+  return sidecarPath
+}
+
+// writeXmpSidecarCaption sets the dc:description in the XMP sidecar file,
+// creating the file if it does not exist, and leaving everything else in
+// an existing file as it is. An empty text removes the description.
+func writeXmpSidecarCaption(sidecarPath, text string) error {
+  b, err := ioutil.ReadFile(sidecarPath)
+  if os.IsNotExist(err) {
+    if text == "" {
+      return nil
+    }
+    b = []byte(newXmpSidecar)
+  } else if err != nil {
+    return err
+  }
+  b, err = setXmpDescription(b, text)
+  if err != nil {
+    return fmt.Errorf("can't update XMP sidecar %s: %v", sidecarPath, err)
+  }
+  newPath := sidecarPath + ".new"
+  if err := ioutil.WriteFile(newPath, b, 0644); err != nil {
+    return err
+  }
+  return os.Rename(newPath, sidecarPath)
+}
+
+// setXmpDescription returns the XMP data with its dc:description replaced
+// by the text. We edit the bytes rather than re-encoding the XML so that
+// the rest of the file, with the namespace prefixes the other programs
+// chose, stays exactly as it was. The element we write declares its own
+// namespaces so that it is valid wherever we put it.
+func setXmpDescription(b []byte, text string) ([]byte, error) {
+  var element []byte
+  if text != "" {
+    var escaped bytes.Buffer
+    xml.EscapeText(&escaped, []byte(text))
+    element = []byte(`<dc:description xmlns:dc="` + xmpDcNamespace + `"><rdf:Alt xmlns:rdf="` +
+        xmpRdfNamespace + `"><rdf:li xml:lang="x-default">` + escaped.String() +
+        `</rdf:li></rdf:Alt></dc:description>`)
+  }
+
+  d := xml.NewDecoder(bytes.NewReader(b))
+  depth := 0
+  descStart, descDepth := -1, 0
+  insertAt := -1        // After the first rdf:Description start tag
+  selfClosingStart := -1        // Start of that tag if it is <rdf:Description .../>
+  for {
+    offset := int(d.InputOffset())
+    tok, err := d.Token()
+    if err != nil {
+      break
+    }
+    switch t := tok.(type) {
+    case xml.StartElement:
+      depth++
+      if descStart < 0 && t.Name.Space == xmpDcNamespace && t.Name.Local == "description" {
+        descStart, descDepth = offset, depth
+      }
+      if insertAt < 0 && t.Name.Space == xmpRdfNamespace && t.Name.Local == "Description" {
+        insertAt = int(d.InputOffset())
+        if bytes.HasSuffix(b[offset:insertAt], []byte("/>")) {
+          selfClosingStart = offset
+        }
+      }
+    case xml.EndElement:
+      if descStart >= 0 && depth == descDepth {
+        end := int(d.InputOffset())
+        return concatBytes(b[:descStart], element, b[end:]), nil
+      }
+      depth--
+    }
+  }
+  if text == "" {
+    return b, nil       // Nothing to remove
+  }
+  if insertAt < 0 {
+    return nil, fmt.Errorf("no rdf:Description element")
+  }
+  if selfClosingStart >= 0 {
+    // Turn <rdf:Description .../> into <rdf:Description ...>element</rdf:Description>
+    tag := b[selfClosingStart:insertAt - 2]
+    name := bytes.Fields(tag[1:])[0]
+    tag = bytes.TrimRight(tag, " \t\r\n")
+    return concatBytes(b[:selfClosingStart], tag, []byte(">"), element,
+        []byte("</"), name, []byte(">"), b[insertAt:]), nil
+  }
+  return concatBytes(b[:insertAt], element, b[insertAt:]), nil
+}
+
+func concatBytes(parts ...[]byte) []byte {
+  return bytes.Join(parts, nil)
+}
@@ -0,0 +1,166 @@
+package content
+
+import (
+  "io/ioutil"
+  "net/http"
+  "os"
+  "strings"
+  "testing"
+)
+
+func TestCaptionFallback(t *testing.T) {
+  testDir := "testdata/tmp"
+  os.RemoveAll(testDir)
+  if err := os.MkdirAll(testDir, 0744); err != nil {
+    t.Fatalf("Unable to create test directory: %v", err)
+  }
+  defer os.RemoveAll(testDir)
+
+  iptc := testIptcDataset(2, 120, []byte("IPTC caption"))
+  iptcSegment := testJpegSegment(0xED, append([]byte(photoshopApp13Header), testPhotoshopResource(iptcResourceId, iptc)...))
+  xmpSegment := testJpegSegment(0xE1, append([]byte(xmpApp1Header), testXmpDescription("XMP caption")...))
+  files := []struct{
+    name string
+    segments [][]byte
+  }{
+    { "plain.jpg", nil },
+    { "iptc.jpg", [][]byte{iptcSegment} },
+    { "both.jpg", [][]byte{iptcSegment, xmpSegment} },
+    { "sidecar.jpg", [][]byte{xmpSegment} },
+    { "digikam.jpg", nil },
+    { "txt.jpg", [][]byte{xmpSegment} },
+  }
+  for _, f := range files {
+    if err := writeTestJpeg(testDir + "/" + f.name, 8, 8); err != nil {
+      t.Fatalf("Unable to create test file: %v", err)
+    }
+    if err := insertTestJpegSegments(testDir + "/" + f.name, f.segments...); err != nil {
+      t.Fatalf("Unable to add metadata to test file: %v", err)
+    }
+  }
+  writeFiles := map[string]string{
+    "sidecar.xmp": string(testXmpDescription("Sidecar caption")),
+    "digikam.jpg.xmp": string(testXmpDescription("Other sidecar caption")),
+    "txt.txt": "Text file caption",
+  }
+  for name, text := range writeFiles {
+    if err := ioutil.WriteFile(testDir + "/" + name, []byte(text), 0644); err != nil {
+      t.Fatalf("Unable to create test file: %v", err)
+    }
+  }
+
+  h := NewHandler(&Config{
+    ContentRoot: testDir,
+  });
+  list, err, _ := h.List("", ListOptions{})
+  if err != nil {
+    t.Fatalf("List failed: %v", err)
+  }
+  var got []string
+  for _, item := range list.Items {
+    if item.Type == "image" {
+      got = append(got, item.Name + ":" + item.TextSource + ":" + item.Text)
+    }
+  }
+  want := []string{
+    "both.jpg:xmp:XMP caption",
+    "digikam.jpg:sidecar:Other sidecar caption",
+    "iptc.jpg:iptc:IPTC caption",
+    "plain.jpg::",
+    "sidecar.jpg:sidecar:Sidecar caption",
+    "txt.jpg:txt:Text file caption",
+  }
+  if got, want := strings.Join(got, "\n"), strings.Join(want, "\n"); got != want {
+    t.Errorf("captions: got\n%s\nwant\n%s", got, want)
+  }
+
+  b, err, _ := h.Text("iptc.txt")
+  if err != nil {
+    t.Fatalf("Text(iptc.txt) failed: %v", err)
+  }
+  if got, want := string(b), "IPTC caption"; got != want {
+    t.Errorf("Text(iptc.txt): got %q, want %q", got, want)
+  }
+  if _, err, status := h.Text("plain.txt"); err == nil || status != http.StatusNotFound {
+    t.Errorf("Text(plain.txt): got status %d, want %d", status, http.StatusNotFound)
+  }
+
+  // Writing to a sidecar creates one if needed, and keeps the rest of an existing one.
+  if err, _ := h.PutText("plain.txt", UpdateTextCommand{Content: "New <caption>", Sidecar: true}); err != nil {
+    t.Fatalf("PutText to new sidecar failed: %v", err)
+  }
+  md, err := readEmbeddedMetadata(testDir + "/plain.xmp")
+  if err != nil {
+    t.Fatalf("Failed to read new sidecar: %v", err)
+  }
+  if got, want := md.Caption, "New <caption>"; got != want {
+    t.Errorf("new sidecar caption: got %q, want %q", got, want)
+  }
+  if err, _ := h.PutText("digikam.txt", UpdateTextCommand{Content: "Changed", Sidecar: true}); err != nil {
+    t.Fatalf("PutText to existing sidecar failed: %v", err)
+  }
+  md, err = readEmbeddedMetadata(testDir + "/digikam.jpg.xmp")
+  if err != nil {
+    t.Fatalf("Failed to read existing sidecar: %v", err)
+  }
+  if got, want := md.Caption, "Changed"; got != want {
+    t.Errorf("existing sidecar caption: got %q, want %q", got, want)
+  }
+  if got, want := strings.Join(md.Keywords, ","), "kept"; got != want {
+    t.Errorf("existing sidecar keywords: got %q, want %q", got, want)
+  }
+  if _, err := os.Stat(testDir + "/digikam.xmp"); !os.IsNotExist(err) {
+    t.Errorf("digikam.xmp should not have been created")
+  }
+
+  if err, status := h.PutText("txt.txt", UpdateTextCommand{Content: "x", Sidecar: true}); err == nil || status != http.StatusConflict {
+    t.Errorf("PutText to sidecar with text file: got status %d, want %d", status, http.StatusConflict)
+  }
+  if err, status := h.PutText("nosuch.txt", UpdateTextCommand{Content: "x", Sidecar: true}); err == nil || status != http.StatusNotFound {
+    t.Errorf("PutText to sidecar with no image: got status %d, want %d", status, http.StatusNotFound)
+  }
+}
+
+func TestSetXmpDescription(t *testing.T) {
+  selfClosing := `<x:xmpmeta xmlns:x="adobe:ns:meta/"><rdf:RDF xmlns:rdf="http://www.w3.org/1999/02/22-rdf-syntax-ns#">` +
+      `<rdf:Description rdf:about="" xmlns:xmp="http://ns.adobe.com/xap/1.0/" xmp:Rating="3"/>` +
+      `</rdf:RDF></x:xmpmeta>`
+  testCases := []struct{
+    xmp string
+    text string
+  }{
+    { string(testXmpDescription("Old")), "New & improved" },
+    { string(testXmpDescription("Old")), "" },
+    { newXmpSidecar, "Added" },
+    { selfClosing, "Added" },
+  }
+  for _, tc := range testCases {
+    b, err := setXmpDescription([]byte(tc.xmp), tc.text)
+    if err != nil {
+      t.Fatalf("setXmpDescription(%q) failed: %v", tc.text, err)
+    }
+    md := &embeddedMetadata{}
+    md.parseXmp(b)
+    if got := md.Caption; got != tc.text {
+      t.Errorf("setXmpDescription(%q): got caption %q in\n%s", tc.text, got, b)
+    }
+  }
+  if _, err := setXmpDescription([]byte(`<x:xmpmeta xmlns:x="adobe:ns:meta/"/>`), "text"); err == nil {
+    t.Errorf("setXmpDescription with no rdf:Description should fail")
+  }
+}
+
+// testXmpDescription returns an XMP packet with the caption and a keyword,
+// using a different prefix for the dc namespace than we write.
+func testXmpDescription(caption string) []byte {
+  return []byte(`<?xpacket begin="" id="W5M0MpCehiHzreSzNTczkc9d"?>
+<x:xmpmeta xmlns:x="adobe:ns:meta/">
+ <rdf:RDF xmlns:rdf="http://www.w3.org/1999/02/22-rdf-syntax-ns#">
+  <rdf:Description rdf:about="" xmlns:d="http://purl.org/dc/elements/1.1/">
+   <d:description><rdf:Alt><rdf:li xml:lang="fr">Pas celui-ci</rdf:li><rdf:li xml:lang="x-default">` + caption + `</rdf:li></rdf:Alt></d:description>
+   <d:subject><rdf:Bag><rdf:li>kept</rdf:li></rdf:Bag></d:subject>
+  </rdf:Description>
+ </rdf:RDF>
+</x:xmpmeta>
+<?xpacket end="w"?>`)
+}
@@ -0,0 +1,494 @@
+package content
+
+import (
+  "encoding/json"
+  "fmt"
+  "image"
+  "io/ioutil"
+  "log"
+  "os"
+  "path/filepath"
+  "strings"
+  "sync"
+  "time"
+)
+
+const (
+  // How long we use the results of a scan before we check for changes,
+  // when we are not scanning in the background.
+  catalogRefreshInterval = time.Minute
+  // Increment this when changing catalogRecord so that we rescan
+  // everything rather than using records with missing fields.
+  catalogVersion = 5
+)
+
+// How long we wait after the catalog changes before saving it, so that
+// we save a burst of changes once. A variable so that tests can change it.
+var catalogSaveDelay = 10 * time.Second
+
+// catalog holds the metadata about every media file under the content
+// root, so that we don't have to open and parse each file every time
+// we list a directory, and so that we can do listings that cut across
+// directories. We build it by scanning the whole tree, either in the
+// background or on demand; on later scans we only read files whose
+// size or modification time have changed. If we have a path, we save
+// the catalog there shortly after it changes, and load it again when we
+// start up.
+type catalog struct {
+  path string            // Where we save the catalog; not saved if empty
+
+  scanMu sync.Mutex      // Held while scanning, so we only do one at a time.
+  saveMu sync.Mutex      // Held while writing our file.
+
+  mu sync.Mutex          // Protects the fields below.
+  scanned time.Time      // When we finished our last scan
+  dirty bool             // True if we have changes that have not been saved
+  saveTimer *time.Timer  // Set when we have arranged to save the changes
+  records map[string]*catalogRecord    // Keyed by api path.
+}
+
+// catalogRecord is the information we keep about one media file.
+// Records are not modified once they are in the catalog; to make a
+// change, we make a copy and replace the record.
+type catalogRecord struct {
+  ApiPath string
+  Size int64
+  ModTime time.Time
+  ExifDateTime time.Time        // Creation time for a video; zero if not available
+  Orientation int               // EXIF orientation, or -1 if none
+  Width int                     // Actual image or video frame dimensions in pixels
+  Height int
+  Video *VideoInfo              // Nil if not a video or we couldn't probe it
+  Animated bool                 // A GIF with more than one frame
+  HasGPS bool
+  Latitude float64
+  Longitude float64
+  Altitude float64
+  Exif *ExifSummary             // Nil if no EXIF data
+  Text string                   // From the text file for this image, or a fallback
+  TextError string
+  TextSource string             // Where Text came from, such as TextSourceTxt
+  TextModTime time.Time         // Zero if there is no text file
+  XmpModTime time.Time          // Zero if there is no XMP sidecar file
+  EmbeddedText string           // Caption from XMP or IPTC data in the image file
+  EmbeddedTextSource string
+  Tags []string                 // From the tags file for this image
+  TagsModTime time.Time         // Zero if there is no tags file
+}
+
+// catalogFile is what we store in the catalog file.
+type catalogFile struct {
+  Version int
+  Scanned time.Time
+  Records []*catalogRecord
+}
+
+func newCatalog(path string) *catalog {
+  c := &catalog{
+    path: path,
+    records: make(map[string]*catalogRecord),
+  }
+  if path != "" {
+    c.load()
+  }
+  return c
+}
+
+// captureTime returns our best guess as to when the photo or video was
+// taken: the EXIF DateTime if there is one, else the file modification time.
+func (r *catalogRecord) captureTime() time.Time {
+  if !r.ExifDateTime.IsZero() {
+    return r.ExifDateTime
+  }
+  return r.ModTime
+}
+
+func (c *catalog) get(apiPath string) *catalogRecord {
+  c.mu.Lock()
+  defer c.mu.Unlock()
+  return c.records[apiPath]
+}
+
+func (c *catalog) put(r *catalogRecord) {
+  c.mu.Lock()
+  defer c.mu.Unlock()
+  c.records[r.ApiPath] = r
+  c.markDirty()
+}
+
+func (c *catalog) remove(apiPath string) {
+  c.mu.Lock()
+  defer c.mu.Unlock()
+  if _, ok := c.records[apiPath]; ok {
+    delete(c.records, apiPath)
+    c.markDirty()
+  }
+}
+
+// markDirty notes that we have unsaved changes, and arranges to save them
+// after catalogSaveDelay. The caller must hold c.mu.
+func (c *catalog) markDirty() {
+  c.dirty = true
+  if c.path != "" && c.saveTimer == nil {
+    c.saveTimer = time.AfterFunc(catalogSaveDelay, func() {
+      c.mu.Lock()
+      c.saveTimer = nil
+      c.mu.Unlock()
+      if err := c.save(); err != nil {
+        log.Printf("Error saving catalog: %v", err)
+      }
+    })
+  }
+}
+
+// removeTree removes the records for all files under the directory.
+func (c *catalog) removeTree(dirApiPath string) {
+  c.mu.Lock()
+  defer c.mu.Unlock()
+  prefix := dirApiPath + "/"
+  for apiPath := range c.records {
+    if strings.HasPrefix(apiPath, prefix) {
+      delete(c.records, apiPath)
+      c.markDirty()
+    }
+  }
+}
+
+// snapshot returns all of the records in the catalog.
+func (c *catalog) snapshot() []*catalogRecord {
+  c.mu.Lock()
+  defer c.mu.Unlock()
+  records := make([]*catalogRecord, 0, len(c.records))
+  for _, r := range c.records {
+    records = append(records, r)
+  }
+  return records
+}
+
+// needsScan returns true if we have never scanned, or it has been
+// longer than maxAge since our last scan.
+func (c *catalog) needsScan(maxAge time.Duration) bool {
+  c.mu.Lock()
+  defer c.mu.Unlock()
+  return time.Since(c.scanned) > maxAge
+}
+
+// finishScan removes all of the records that were not seen in the scan.
+func (c *catalog) finishScan(seen map[string]bool) {
+  c.mu.Lock()
+  defer c.mu.Unlock()
+  for apiPath := range c.records {
+    if !seen[apiPath] {
+      delete(c.records, apiPath)
+      c.markDirty()
+    }
+  }
+  c.scanned = time.Now()
+}
+
+// load reads the catalog from our file. If there is any problem with the
+// file, we start with an empty catalog, which will get filled in by a scan.
+func (c *catalog) load() {
+  b, err := ioutil.ReadFile(c.path)
+  if err != nil {
+    if !os.IsNotExist(err) {
+      log.Printf("Error reading catalog file %s: %v", c.path, err)
+    }
+    return
+  }
+  var cf catalogFile
+  if err := json.Unmarshal(b, &cf); err != nil {
+    log.Printf("Error parsing catalog file %s: %v", c.path, err)
+    return
+  }
+  if cf.Version != catalogVersion {
+    log.Printf("Catalog file %s is version %d, not %d; ignoring it", c.path, cf.Version, catalogVersion)
+    return
+  }
+  c.mu.Lock()
+  defer c.mu.Unlock()
+  for _, r := range cf.Records {
+    c.records[r.ApiPath] = r
+  }
+  log.Printf("Loaded %d records from catalog file %s", len(c.records), c.path)
+}
+
+// save writes the catalog to our file if there are any unsaved changes.
+func (c *catalog) save() error {
+  if c.path == "" {
+    return nil
+  }
+  c.saveMu.Lock()
+  defer c.saveMu.Unlock()
+  c.mu.Lock()
+  if !c.dirty {
+    c.mu.Unlock()
+    return nil
+  }
+  cf := catalogFile{
+    Version: catalogVersion,
+    Scanned: c.scanned,
+    Records: make([]*catalogRecord, 0, len(c.records)),
+  }
+  for _, r := range c.records {
+    cf.Records = append(cf.Records, r)
+  }
+  c.dirty = false
+  c.mu.Unlock()
+
+  b, err := json.Marshal(cf)
+  if err != nil {
+    return fmt.Errorf("error encoding catalog: %v", err)
+  }
+  if err := os.MkdirAll(filepath.Dir(c.path), 0700); err != nil {
+    return fmt.Errorf("error creating catalog directory: %v", err)
+  }
+  newPath := c.path + ".new"
+  if err := ioutil.WriteFile(newPath, b, 0600); err != nil {
+    return fmt.Errorf("error writing catalog file %s: %v", newPath, err)
+  }
+  if err := os.Rename(newPath, c.path); err != nil {
+    return fmt.Errorf("error renaming catalog file %s: %v", newPath, err)
+  }
+  return nil
+}
+
+// scanCatalogInBackground rescans the content tree periodically
+// until the program exits.
+func (h *Handler) scanCatalogInBackground(interval time.Duration) {
+  for {
+    h.scanCatalog()
+    time.Sleep(interval)
+  }
+}
+
+// catalogRecords returns a snapshot of the records in the catalog. If we
+// are not scanning in the background, we first rescan the content tree if
+// our last scan is too old.
+func (h *Handler) catalogRecords() []*catalogRecord {
+  if h.config.CatalogScanInterval <= 0 && h.catalog.needsScan(catalogRefreshInterval) {
+    h.scanCatalog()
+  }
+  return h.catalog.snapshot()
+}
+
+// scanCatalog walks the content tree and updates the records for all
+// new or changed media files, then saves the catalog.
+func (h *Handler) scanCatalog() {
+  c := h.catalog
+  c.scanMu.Lock()
+  defer c.scanMu.Unlock()
+  root := filepath.Clean(h.config.ContentRoot)
+  seen := make(map[string]bool)
+  updated := 0
+  filepath.Walk(root, func(p string, f os.FileInfo, err error) error {
+    if err != nil {
+      log.Printf("Error scanning %s for catalog: %v", p, err)
+      return nil
+    }
+    if f.IsDir() {
+      // Skip hidden dirs, in particular our cache dir.
+      if p != root && strings.HasPrefix(f.Name(), ".") {
+        return filepath.SkipDir
+      }
+      return nil
+    }
+    if !h.isMediaFile(f.Name()) {
+      return nil
+    }
+    rel, err := filepath.Rel(root, p)
+    if err != nil {
+      return nil
+    }
+    apiPath := filepath.ToSlash(rel)
+    seen[apiPath] = true
+    if _, changed := h.catalogRecordForFile(apiPath, p, f); changed {
+      updated++
+    }
+    return nil
+  })
+  c.finishScan(seen)
+  if updated > 0 {
+    log.Printf("Catalog scan updated %d of %d files", updated, len(seen))
+  }
+  if err := c.save(); err != nil {
+    log.Printf("Error saving catalog: %v", err)
+  }
+}
+
+// catalogRecordForFile returns the catalog record for a media file,
+// reading the file and updating the catalog if the file or its text,
+// XMP sidecar or tags file has changed since we last looked at it. The bool return value
+// is true if we updated the record, in which case we also update the
+// caption in the search index.
+func (h *Handler) catalogRecordForFile(apiPath, filePath string, f os.FileInfo) (*catalogRecord, bool) {
+  r, changed := h.loadCatalogRecord(apiPath, filePath, f)
+  if changed {
+    h.searchIndex.updateText(apiPath, searchCaption(r))
+  }
+  return r, changed
+}
+
+// loadCatalogRecord does the work of catalogRecordForFile, without
+// updating the search index.
+func (h *Handler) loadCatalogRecord(apiPath, filePath string, f os.FileInfo) (*catalogRecord, bool) {
+  r := h.catalog.get(apiPath)
+  if r == nil || r.Size != f.Size() || !r.ModTime.Equal(f.ModTime()) {
+    r = h.newCatalogRecord(apiPath, filePath, f)
+    h.catalog.put(r)
+    return r, true
+  }
+  tagsPath := tagsFilePathFor(filePath, false)
+  if !r.TextModTime.Equal(fileModTime(textFilePathFor(filePath))) ||
+      !r.XmpModTime.Equal(fileModTime(xmpSidecarPathFor(filePath))) ||
+      !r.TagsModTime.Equal(fileModTime(tagsPath)) {
+    nr := *r
+    nr.loadText(filePath)
+    nr.loadTags(tagsPath)
+    h.catalog.put(&nr)
+    return &nr, true
+  }
+  return r, false
+}
+
+// catalogRecordForListItem returns the catalog record for a file that
+// is being listed, or nil if the file is not a media file within our
+// content root.
+func (h *Handler) catalogRecordForListItem(parentPath string, f os.FileInfo) *catalogRecord {
+  if !h.isMediaFile(f.Name()) {
+    return nil
+  }
+  filePath := filepath.Join(parentPath, f.Name())
+  rel, err := filepath.Rel(filepath.Clean(h.config.ContentRoot), filePath)
+  if err != nil || strings.HasPrefix(rel, "..") {
+    return nil
+  }
+  r, _ := h.catalogRecordForFile(filepath.ToSlash(rel), filePath, f)
+  return r
+}
+
+// newCatalogRecord reads the information about one file for the catalog.
+func (h *Handler) newCatalogRecord(apiPath, filePath string, f os.FileInfo) *catalogRecord {
+  r := &catalogRecord{
+    ApiPath: apiPath,
+    Size: f.Size(),
+    ModTime: f.ModTime(),
+    Orientation: -1,
+  }
+  if h.isImageFile(filePath) {
+    // Many images don't have EXIF data, so we don't log errors here.
+    if info, err := exifInfoFromFile(filePath); err == nil {
+      r.ExifDateTime = info.DateTime
+      if info.Orientation != 0 {
+        r.Orientation = info.Orientation
+      }
+      r.HasGPS = info.HasGPS
+      r.Latitude = info.Latitude
+      r.Longitude = info.Longitude
+      r.Altitude = info.Altitude
+      r.Exif = &info.ExifSummary
+    }
+    r.Width, r.Height = imageDimensions(filePath)
+    if t := h.mediaType(filePath); r.Width == 0 && t.Decode != nil {
+      // Not a format the image package knows, so we have to decode it.
+      if im, _, err := t.Decode(filePath); err == nil {
+        r.Width, r.Height = im.Bounds().Dx(), im.Bounds().Dy()
+      }
+    }
+    if strings.ToLower(filepath.Ext(filePath)) == ".gif" {
+      r.Animated = isAnimatedGif(filePath)
+    }
+    if md, err := readEmbeddedMetadata(filePath); err == nil {
+      r.EmbeddedText = md.Caption
+      r.EmbeddedTextSource = md.CaptionSource
+    }
+  }
+  if h.isVideoFile(filePath) {
+    if info, err := probeVideo(filePath); err != nil {
+      log.Printf("%v", err)
+    } else {
+      r.Video = info
+      r.Width, r.Height = info.Width, info.Height
+      // So that videos sort and group by date along with photos.
+      r.ExifDateTime = localCreationTime(info.CreationTime, readTzFile(filepath.Dir(filePath)))
+    }
+  }
+  r.loadText(filePath)
+  r.loadTags(tagsFilePathFor(filePath, false))
+  return r
+}
+
+// loadText sets the text for the record from the text file for the media
+// file. If there is no text file, we use the caption from the XMP sidecar
+// file, or if there is none there either, the caption from the media file.
+func (r *catalogRecord) loadText(filePath string) {
+  r.Text = ""
+  r.TextError = ""
+  r.TextSource = ""
+  textPath := textFilePathFor(filePath)
+  sidecarPath := xmpSidecarPathFor(filePath)
+  r.TextModTime = fileModTime(textPath)
+  r.XmpModTime = fileModTime(sidecarPath)
+  if !r.TextModTime.IsZero() {
+    r.TextSource = TextSourceTxt
+    b, err := ioutil.ReadFile(textPath)
+    if err != nil {
+      r.TextError = fmt.Sprintf("%v", err)
+      return
+    }
+    r.Text = string(b)
+    return
+  }
+  if !r.XmpModTime.IsZero() {
+    md, err := readEmbeddedMetadata(sidecarPath)
+    if err != nil {
+      r.TextError = fmt.Sprintf("%v", err)
+    } else if md.Caption != "" {
+      r.Text = md.Caption
+      r.TextSource = TextSourceSidecar
+      return
+    }
+  }
+  if r.EmbeddedText != "" {
+    r.Text = r.EmbeddedText
+    r.TextSource = r.EmbeddedTextSource
+  }
+}
+
+// loadTags reads the tags file for the record.
+func (r *catalogRecord) loadTags(tagsPath string) {
+  r.TagsModTime = fileModTime(tagsPath)
+  r.Tags = readTagsFile(tagsPath)
+}
+
+// fileModTime returns the modification time of the file,
+// or zero if it does not exist.
+func fileModTime(filePath string) time.Time {
+  f, err := os.Stat(filePath)
+  if err != nil {
+    return time.Time{}
+  }
+  return f.ModTime()
+}
+
+// imageDimensions returns the width and height of the image in the file,
+// or zeros if we can't read it.
+func imageDimensions(filePath string) (int, int) {
+  f, err := os.Open(filePath)
+  if err != nil {
+    return 0, 0
+  }
+  defer f.Close()
+  cfg, _, err := image.DecodeConfig(f)
+  if err != nil {
+    return 0, 0
+  }
+  return cfg.Width, cfg.Height
+}
+
+// textFilePathFor returns the path to the text file for a media file,
+// which has the same name with a .txt extension.
+func textFilePathFor(filePath string) string {
+  return strings.TrimSuffix(filePath, filepath.Ext(filePath)) + textExtension
+}
+
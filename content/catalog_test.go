@@ -0,0 +1,112 @@
+package content
+
+import (
+  "io/ioutil"
+  "os"
+  "testing"
+  "time"
+)
+
+func TestCatalog(t *testing.T) {
+  testDir := "testdata/tmp"
+  catalogPath := testDir + "/.mimcache/catalog.json"
+  os.RemoveAll(testDir)
+  if err := os.MkdirAll(testDir + "/a", 0744); err != nil {
+    t.Fatalf("Unable to create test directory: %v", err)
+  }
+  defer os.RemoveAll(testDir)
+  defer func(d time.Duration) { catalogSaveDelay = d }(catalogSaveDelay)
+  catalogSaveDelay = 10 * time.Millisecond
+  if err := writeTestJpegWithExif(testDir + "/a/exif.jpg", 40, 20, sampleTestExif()); err != nil {
+    t.Fatalf("Unable to create test image: %v", err)
+  }
+  if err := writeTestJpeg(testDir + "/a/noexif.jpg", 30, 10); err != nil {
+    t.Fatalf("Unable to create test image: %v", err)
+  }
+  if err := ioutil.WriteFile(testDir + "/a/noexif.txt", []byte("first"), 0644); err != nil {
+    t.Fatalf("Unable to create test text file: %v", err)
+  }
+
+  h := NewHandler(&Config{
+    ContentRoot: testDir,
+    CatalogPath: catalogPath,
+  });
+  records := h.catalogRecords()
+  if got, want := len(records), 2; got != want {
+    t.Fatalf("catalog record count: got %d, want %d", got, want)
+  }
+  exifRecord := h.catalog.get("a/exif.jpg")
+  if exifRecord == nil {
+    t.Fatalf("catalog should have a record for a/exif.jpg")
+  }
+  if got, want := exifRecord.Orientation, -1; got != want {
+    t.Errorf("orientation for a/exif.jpg: got %d, want %d", got, want)
+  }
+  if got, want := exifRecord.Width, 40; got != want {
+    t.Errorf("width for a/exif.jpg: got %d, want %d", got, want)
+  }
+  if exifRecord.Exif == nil || exifRecord.Exif.Model != "TestModel 1" {
+    t.Errorf("catalog record for a/exif.jpg should have exif data")
+  }
+  if got, want := h.catalog.get("a/noexif.jpg").Text, "first"; got != want {
+    t.Errorf("text for a/noexif.jpg: got %s, want %s", got, want)
+  }
+  if _, err := os.Stat(catalogPath); err != nil {
+    t.Fatalf("catalog file should have been saved: %v", err)
+  }
+
+  // A new handler should load the catalog from the file, and not
+  // create new records for unchanged files when it scans.
+  h2 := NewHandler(&Config{
+    ContentRoot: testDir,
+    CatalogPath: catalogPath,
+  });
+  if got, want := len(h2.catalog.snapshot()), 2; got != want {
+    t.Fatalf("loaded catalog record count: got %d, want %d", got, want)
+  }
+  loadedRecord := h2.catalog.get("a/exif.jpg")
+  h2.scanCatalog()
+  if h2.catalog.get("a/exif.jpg") != loadedRecord {
+    t.Errorf("scan should not replace record for unchanged file")
+  }
+
+  // Changing the text file should show up in a listing.
+  later := time.Now().Add(time.Minute)
+  if err := ioutil.WriteFile(testDir + "/a/noexif.txt", []byte("second"), 0644); err != nil {
+    t.Fatalf("Unable to update test text file: %v", err)
+  }
+  if err := os.Chtimes(testDir + "/a/noexif.txt", later, later); err != nil {
+    t.Fatalf("Unable to set file time: %v", err)
+  }
+  list, err, _ := h2.List("a", ListOptions{})
+  if err != nil {
+    t.Fatalf("failed to list: %v", err)
+  }
+  if got, want := list.Items[1].Text, "second"; got != want {
+    t.Errorf("text for a/noexif.jpg after update: got %s, want %s", got, want)
+  }
+  if h2.catalog.get("a/exif.jpg") != loadedRecord {
+    t.Errorf("list should not replace record for unchanged file")
+  }
+
+  // The change should be saved without waiting for a scan.
+  saved := ""
+  for deadline := time.Now().Add(5 * time.Second); saved != "second" && time.Now().Before(deadline); {
+    time.Sleep(10 * time.Millisecond)
+    if r := newCatalog(catalogPath).get("a/noexif.jpg"); r != nil {
+      saved = r.Text
+    }
+  }
+  if saved != "second" {
+    t.Errorf("saved text for a/noexif.jpg after update: got %s, want second", saved)
+  }
+
+  // Removed files should be removed from the catalog on the next scan.
+  if err := os.Remove(testDir + "/a/noexif.jpg"); err != nil {
+    t.Fatalf("Unable to remove test file: %v", err)
+  }
+  h2.scanCatalog()
+  if got, want := len(h2.catalog.snapshot()), 1; got != want {
+    t.Errorf("catalog record count after remove: got %d, want %d", got, want)
+  }
+}
@@ -0,0 +1,101 @@
+package content
+
+import (
+  "fmt"
+  "image"
+  "math"
+  "strconv"
+  "strings"
+
+  "github.com/disintegration/imaging"
+)
+
+const (
+  cropAttribute = "crop"
+  cropNone = "none"     // Only used when setting; not stored
+)
+
+// cropRect is a crop rectangle in normalized coordinates, where the
+// full image runs from 0 to 1 in each direction. In the index file it
+// is relative to the image as displayed, after rotation.
+type cropRect struct {
+  X, Y, W, H float64
+}
+
+// parseCrop parses a crop value of the form x,y,w,h.
+func parseCrop(value string) (cropRect, error) {
+  fields := strings.Split(value, ",")
+  if len(fields) != 4 {
+    return cropRect{}, fmt.Errorf("crop must be x,y,w,h")
+  }
+  var v [4]float64
+  for i, field := range fields {
+    f, err := strconv.ParseFloat(strings.TrimSpace(field), 64)
+    if err != nil || math.IsNaN(f) || f < 0 || f > 1 {
+      return cropRect{}, fmt.Errorf("crop values must be numbers from 0 to 1")
+    }
+    v[i] = f
+  }
+  c := cropRect{v[0], v[1], v[2], v[3]}
+  const epsilon = 1e-9
+  if c.W <= 0 || c.H <= 0 || c.X + c.W > 1 + epsilon || c.Y + c.H > 1 + epsilon {
+    return cropRect{}, fmt.Errorf("crop rectangle %s is not within the image", value)
+  }
+  return c, nil
+}
+
+// String returns the crop in the form we store it, with enough precision
+// for a pixel of a very large image.
+func (c cropRect) String() string {
+  format := func(f float64) string {
+    return strconv.FormatFloat(math.Round(f * 10000) / 10000, 'f', -1, 64)
+  }
+  return strings.Join([]string{format(c.X), format(c.Y), format(c.W), format(c.H)}, ",")
+}
+
+// unrotate returns the crop rectangle for the original image, given the
+// rectangle for the image as displayed after rotating it counterclockwise
+// by rot degrees.
+func (c cropRect) unrotate(rot int) cropRect {
+  switch ((rot % 360) + 360) % 360 {
+  case 90:
+    return cropRect{1 - c.Y - c.H, c.X, c.H, c.W}
+  case 180:
+    return cropRect{1 - c.X - c.W, 1 - c.Y - c.H, c.W, c.H}
+  case 270:
+    return cropRect{c.Y, 1 - c.X - c.W, c.H, c.W}
+  }
+  return c
+}
+
+// apply crops the image, always leaving at least one pixel.
+func (c cropRect) apply(im image.Image) image.Image {
+  b := im.Bounds()
+  w := float64(b.Dx())
+  h := float64(b.Dy())
+  x0 := b.Min.X + int(math.Round(c.X * w))
+  y0 := b.Min.Y + int(math.Round(c.Y * h))
+  x1 := b.Min.X + int(math.Round((c.X + c.W) * w))
+  y1 := b.Min.Y + int(math.Round((c.Y + c.H) * h))
+  if x1 <= x0 {
+    x1 = x0 + 1
+  }
+  if y1 <= y0 {
+    y1 = y0 + 1
+  }
+  return imaging.Crop(im, image.Rect(x0, y0, x1, y1))
+}
+
+// cropFromEntry returns the crop rectangle from the index entry, or nil
+// if there is none or it is not valid.
+func cropFromEntry(entry *imageEntry) *cropRect {
+  value := entry.attribute(cropAttribute)
+  if value == "" {
+    return nil
+  }
+  c, err := parseCrop(value)
+  if err != nil {
+    return nil
+  }
+  return &c
+}
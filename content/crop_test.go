@@ -0,0 +1,173 @@
+package content
+
+import (
+  "image"
+  "image/color"
+  "image/png"
+  "net/http"
+  "os"
+  "testing"
+)
+
+func TestParseCrop(t *testing.T) {
+  testCases := []struct{
+    value string
+    want string         // Empty if the value is not valid
+  }{
+    { "0,0,1,1", "0,0,1,1" },
+    { "0.1, 0.2, 0.5, 0.25", "0.1,0.2,0.5,0.25" },
+    { "0.123456,0,0.5,0.5", "0.1235,0,0.5,0.5" },
+    { "0.5,0.5,0.5,0.5", "0.5,0.5,0.5,0.5" },
+    { "0.5,0.5,0.6,0.5", "" },
+    { "0,0,0,1", "" },
+    { "-0.1,0,0.5,0.5", "" },
+    { "0,0,1", "" },
+    { "a,b,c,d", "" },
+    { "NaN,0,1,1", "" },
+  }
+  for _, tc := range testCases {
+    c, err := parseCrop(tc.value)
+    if tc.want == "" {
+      if err == nil {
+        t.Errorf("parseCrop(%q) should fail", tc.value)
+      }
+      continue
+    }
+    if err != nil {
+      t.Errorf("parseCrop(%q) failed: %v", tc.value, err)
+      continue
+    }
+    if got := c.String(); got != tc.want {
+      t.Errorf("parseCrop(%q): got %q, want %q", tc.value, got, tc.want)
+    }
+  }
+}
+
+func TestCropUnrotate(t *testing.T) {
+  c := cropRect{0.1, 0.2, 0.3, 0.4}
+  testCases := []struct{
+    rot int
+    want string
+  }{
+    { 0, "0.1,0.2,0.3,0.4" },
+    { 90, "0.4,0.1,0.4,0.3" },
+    { 180, "0.6,0.4,0.3,0.4" },
+    { -90, "0.2,0.6,0.4,0.3" },
+    { 270, "0.2,0.6,0.4,0.3" },
+    { 450, "0.4,0.1,0.4,0.3" },
+  }
+  for _, tc := range testCases {
+    if got := c.unrotate(tc.rot).String(); got != tc.want {
+      t.Errorf("unrotate(%d): got %q, want %q", tc.rot, got, tc.want)
+    }
+  }
+}
+
+func TestImageCrop(t *testing.T) {
+  testDir := "testdata/tmp"
+  os.RemoveAll(testDir)
+  if err := os.MkdirAll(testDir, 0744); err != nil {
+    t.Fatalf("Unable to create test directory: %v", err)
+  }
+  defer os.RemoveAll(testDir)
+
+  // Left half red, right half blue.
+  red := color.NRGBA{255, 0, 0, 255}
+  blue := color.NRGBA{0, 0, 255, 255}
+  im := image.NewNRGBA(image.Rect(0, 0, 40, 20))
+  for y := 0; y < 20; y++ {
+    for x := 0; x < 40; x++ {
+      if x < 20 {
+        im.Set(x, y, red)
+      } else {
+        im.Set(x, y, blue)
+      }
+    }
+  }
+  f, err := os.Create(testDir + "/img.png")
+  if err != nil {
+    t.Fatalf("Unable to create test image: %v", err)
+  }
+  if err := png.Encode(f, im); err != nil {
+    t.Fatalf("Unable to write test image: %v", err)
+  }
+  f.Close()
+
+  h := NewHandler(&Config{
+    ContentRoot: testDir,
+  });
+  // Rotated counterclockwise, the blue half is at the top, so cropping
+  // to the top half of the displayed image leaves only blue.
+  commands := []UpdateCommand{
+    {Item: "img.png", Action: "deltarotation", Value: "+r", Autocreate: true},
+    {Item: "img.png", Action: "crop", Value: "0,0,1,0.5"},
+  }
+  if err, _ := h.UpdateImageIndexBatch("index.mpr", commands); err != nil {
+    t.Fatalf("failed to set crop: %v", err)
+  }
+
+  testCases := []struct{
+    width, height int
+    options ImageOptions
+    wantWidth, wantHeight int
+    wantTop, wantBottom color.NRGBA
+  }{
+    { 0, 0, ImageOptions{}, 20, 20, blue, blue },
+    { 10, 10, ImageOptions{}, 10, 10, blue, blue },
+    { 0, 0, ImageOptions{Raw: true}, 20, 40, blue, red },
+  }
+  for _, tc := range testCases {
+    got, err, _ := h.Image("img.png", tc.width, tc.height, 0, tc.options)
+    if err != nil {
+      t.Fatalf("Image failed: %v", err)
+    }
+    b := got.Bounds()
+    if b.Dx() != tc.wantWidth || b.Dy() != tc.wantHeight {
+      t.Errorf("Image(%d, %d, %+v) size: got %dx%d, want %dx%d", tc.width, tc.height, tc.options,
+          b.Dx(), b.Dy(), tc.wantWidth, tc.wantHeight)
+      continue
+    }
+    top := color.NRGBAModel.Convert(got.At(b.Min.X + b.Dx() / 2, b.Min.Y + 1)).(color.NRGBA)
+    bottom := color.NRGBAModel.Convert(got.At(b.Min.X + b.Dx() / 2, b.Max.Y - 2)).(color.NRGBA)
+    if top != tc.wantTop || bottom != tc.wantBottom {
+      t.Errorf("Image(%d, %d, %+v) colors: got %v and %v, want %v and %v", tc.width, tc.height, tc.options,
+          top, bottom, tc.wantTop, tc.wantBottom)
+    }
+  }
+
+  if err, _ := h.UpdateImageIndex("index.mpr", UpdateCommand{Item: "img.png", Action: "crop", Value: "0,0,2,1"}); err == nil {
+    t.Errorf("crop outside the image should fail")
+  }
+  if err, _ := h.UpdateImageIndex("index.mpr", UpdateCommand{Item: "img.png", Action: "crop", Value: "none"}); err != nil {
+    t.Fatalf("failed to remove crop: %v", err)
+  }
+  got, _, _ := h.Image("img.png", 0, 0, 0, ImageOptions{})
+  if b := got.Bounds(); b.Dx() != 20 || b.Dy() != 40 {
+    t.Errorf("Image size after removing crop: got %dx%d, want 20x40", b.Dx(), b.Dy())
+  }
+
+  // We don't use the crop, adjustments or poster from an album, so they
+  // can't be set there.
+  if err := os.MkdirAll(testDir + "/albums", 0744); err != nil {
+    t.Fatalf("Unable to create test directory: %v", err)
+  }
+  if err, _ := h.UpdateAlbum("albums/best.mpr", AlbumCommand{Action: "create", Items: []string{"img.png"}}); err != nil {
+    t.Fatalf("failed to create album: %v", err)
+  }
+  if err, _ := h.UpdateAlbum("best.mpr", AlbumCommand{Action: "create", Items: []string{"img.png"}}); err != nil {
+    t.Fatalf("failed to create album: %v", err)
+  }
+  albumCommands := []struct{
+    album string
+    command UpdateCommand
+  }{
+    { "albums/best.mpr", UpdateCommand{Item: "../img.png", Action: "crop", Value: "0,0,1,0.5"} },
+    { "albums/best.mpr", UpdateCommand{Item: "../img.png", Action: "adjust", Value: "brightness=10"} },
+    { "best.mpr", UpdateCommand{Item: "img.png", Action: "crop", Value: "0,0,1,0.5"} },
+  }
+  for _, ac := range albumCommands {
+    if err, status := h.UpdateImageIndex(ac.album, ac.command); status != http.StatusBadRequest {
+      t.Errorf("%s in %s: got status %d (err %v), want %d", ac.command.Action, ac.album, status, err, http.StatusBadRequest)
+    }
+  }
+}
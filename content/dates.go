@@ -0,0 +1,144 @@
+package content
+
+import (
+  "fmt"
+  "net/http"
+  "path"
+  "sort"
+  "strconv"
+  "strings"
+  "time"
+)
+
+const (
+  // DateAlbumPrefix is the top of the virtual directory hierarchy that
+  // organizes all of our media files by year, month and day.
+  DateAlbumPrefix = "@dates"
+)
+
+// datedRecord is a catalog record along with the time we display for it.
+type datedRecord struct {
+  record *catalogRecord
+  t time.Time
+}
+
+// ListByDate lists one level of the virtual date hierarchy, such as
+// "@dates/2019/07/14". The top three levels are directories for years,
+// months and days; a day lists all of the images and videos under the
+// content root that were taken on that day, in time order, each with its
+// full path. We use the EXIF DateTime when available, else the file time.
+// The options filter and add to the items for a day, as for List.
+func (h *Handler) ListByDate(apiPath string, options ListOptions) (*ListResult, error, int) {
+  if err := checkListFilter(options); err != nil {
+    return nil, err, http.StatusBadRequest
+  }
+  apiPath = cleanApiPath(apiPath)
+  if apiPath != DateAlbumPrefix && !strings.HasPrefix(apiPath, DateAlbumPrefix + "/") {
+    return nil, fmt.Errorf("%s is not a date album path", apiPath), http.StatusBadRequest
+  }
+  parts := strings.Split(strings.TrimPrefix(apiPath, DateAlbumPrefix), "/")[1:]
+  if len(parts) > 3 {
+    return nil, fmt.Errorf("date album path %s is too long", apiPath), http.StatusNotFound
+  }
+  for i, part := range parts {
+    if !validDatePart(i, part) {
+      return nil, fmt.Errorf("invalid date in album path %s", apiPath), http.StatusNotFound
+    }
+  }
+
+  records := h.datedRecords(parts)
+  if len(parts) < 3 {
+    return datedRecordsToDirList(records, len(parts)), nil, 0
+  }
+
+  sort.Slice(records, func(i, j int) bool {
+    if records[i].t.Equal(records[j].t) {
+      return records[i].record.ApiPath < records[j].record.ApiPath
+    }
+    return records[i].t.Before(records[j].t)
+  })
+  apiPaths := make([]string, len(records))
+  for i, r := range records {
+    apiPaths[i] = r.record.ApiPath
+  }
+  return &ListResult{
+    Items: filterListItems(h.apiPathsToListItems(apiPaths, options), options),
+  }, nil, 0
+}
+
+// datedRecords returns the catalog records whose times fall within
+// the year, month and day given in the leading parts.
+func (h *Handler) datedRecords(parts []string) []datedRecord {
+  locs := make(map[string]*time.Location)
+  records := make([]datedRecord, 0)
+  for _, r := range h.catalogRecords() {
+    t := r.captureTime()
+    if r.ExifDateTime.IsZero() {
+      // Display file times in the time zone of their directory, as List does.
+      dir := path.Dir(r.ApiPath)
+      loc, ok := locs[dir]
+      if !ok {
+        loc = readTzFile(path.Join(h.config.ContentRoot, dir))
+        locs[dir] = loc
+      }
+      if loc != nil {
+        t = t.In(loc)
+      }
+    }
+    dp := datePath(t)
+    match := true
+    for i, part := range parts {
+      if dp[i] != part {
+        match = false
+      }
+    }
+    if match {
+      records = append(records, datedRecord{r, t})
+    }
+  }
+  return records
+}
+
+// datedRecordsToDirList returns a list of the virtual directories at the
+// given level of the date hierarchy that contain the records.
+func datedRecordsToDirList(records []datedRecord, level int) *ListResult {
+  names := make(map[string]bool)
+  for _, r := range records {
+    names[datePath(r.t)[level]] = true
+  }
+  list := make([]ListItem, 0, len(names))
+  for name := range names {
+    list = append(list, ListItem{
+      Name: name,
+      IsDir: true,
+    })
+  }
+  sort.Slice(list, func(i, j int) bool { return list[i].Name < list[j].Name })
+  return &ListResult{
+    Items: list,
+  }
+}
+
+// datePath returns the year, month and day of t as directory names.
+func datePath(t time.Time) []string {
+  return []string{
+    fmt.Sprintf("%04d", t.Year()),
+    fmt.Sprintf("%02d", int(t.Month())),
+    fmt.Sprintf("%02d", t.Day()),
+  }
+}
+
+// validDatePart returns true if part is valid as a year (level 0),
+// month (level 1) or day (level 2) in a date album path.
+func validDatePart(level int, part string) bool {
+  n, err := strconv.Atoi(part)
+  if err != nil {
+    return false
+  }
+  switch level {
+  case 0: return len(part) == 4
+  case 1: return len(part) == 2 && n >= 1 && n <= 12
+  case 2: return len(part) == 2 && n >= 1 && n <= 31
+  }
+  return false
+}
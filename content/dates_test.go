@@ -0,0 +1,101 @@
+package content
+
+import (
+  "net/http"
+  "os"
+  "testing"
+  "time"
+)
+
+func TestListByDate(t *testing.T) {
+  testDir := "testdata/tmp"
+  os.RemoveAll(testDir)
+  for _, d := range []string{"a", "b"} {
+    if err := os.MkdirAll(testDir + "/" + d, 0744); err != nil {
+      t.Fatalf("Unable to create test directory: %v", err)
+    }
+  }
+  defer os.RemoveAll(testDir)
+  // EXIF says 2019-07-14 10:11:12.
+  if err := writeTestJpegWithExif(testDir + "/a/exif.jpg", 8, 8, sampleTestExif()); err != nil {
+    t.Fatalf("Unable to create test image: %v", err)
+  }
+  // No EXIF, so we use the file times.
+  if err := writeTestJpeg(testDir + "/b/early.jpg", 8, 8); err != nil {
+    t.Fatalf("Unable to create test image: %v", err)
+  }
+  if err := writeTestJpeg(testDir + "/b/other.jpg", 8, 8); err != nil {
+    t.Fatalf("Unable to create test image: %v", err)
+  }
+  early := time.Date(2019, 7, 14, 8, 0, 0, 0, time.Local)
+  if err := os.Chtimes(testDir + "/b/early.jpg", early, early); err != nil {
+    t.Fatalf("Unable to set file time: %v", err)
+  }
+  other := time.Date(2020, 1, 2, 12, 0, 0, 0, time.Local)
+  if err := os.Chtimes(testDir + "/b/other.jpg", other, other); err != nil {
+    t.Fatalf("Unable to set file time: %v", err)
+  }
+
+  h := NewHandler(&Config{
+    ContentRoot: testDir,
+  });
+
+  testCases := []struct{
+    path string
+    wantNames []string
+  }{
+    { "@dates", []string{"2019", "2020"} },
+    { "@dates/2019", []string{"07"} },
+    { "@dates/2020/", []string{"01"} },
+    { "@dates/2019/07", []string{"14"} },
+    { "@dates/2019/07/14", []string{"early.jpg", "exif.jpg"} },
+    { "@dates/2019/07/15", []string{} },
+  }
+  for _, test := range testCases {
+    t.Run(test.path, func(t *testing.T) {
+      list, err, _ := h.ListByDate(test.path, ListOptions{})
+      if err != nil {
+        t.Fatalf("ListByDate failed: %v", err)
+      }
+      if got, want := len(list.Items), len(test.wantNames); got != want {
+        t.Fatalf("item count: got %d, want %d", got, want)
+      }
+      for i, item := range list.Items {
+        if got, want := item.Name, test.wantNames[i]; got != want {
+          t.Errorf("item %d name: got %s, want %s", i, got, want)
+        }
+      }
+    })
+  }
+
+  list, _, _ := h.ListByDate("@dates/2019/07/14", ListOptions{})
+  if got, want := list.Items[0].Path, "/b/early.jpg"; got != want {
+    t.Errorf("path of first item: got %s, want %s", got, want)
+  }
+  if got, want := list.Items[1].Path, "/a/exif.jpg"; got != want {
+    t.Errorf("path of second item: got %s, want %s", got, want)
+  }
+
+  // Filters and EXIF summaries work as they do for List.
+  flag := UpdateCommand{Item: "exif.jpg", Action: "flag", Value: FlagPick, Autocreate: true}
+  if err, _ := h.UpdateImageIndex("a/index.mpr", flag); err != nil {
+    t.Fatalf("failed to set flag: %v", err)
+  }
+  list, _, _ = h.ListByDate("@dates/2019/07/14", ListOptions{Flag: FlagPick, IncludeExif: true})
+  if len(list.Items) != 1 || list.Items[0].Path != "/a/exif.jpg" {
+    t.Fatalf("ListByDate with flag filter: got %+v, want only /a/exif.jpg", list.Items)
+  }
+  if list.Items[0].Exif == nil {
+    t.Errorf("ListByDate with exif option should include the EXIF summary")
+  }
+
+  for _, p := range []string{"@dates/19", "@dates/2019/13", "@dates/2019/07/14/01", "@dates/x"} {
+    _, err, status := h.ListByDate(p, ListOptions{})
+    if err == nil {
+      t.Errorf("ListByDate(%s) should fail", p)
+    }
+    if got, want := status, http.StatusNotFound; got != want {
+      t.Errorf("ListByDate(%s) status: got %d, want %d", p, got, want)
+    }
+  }
+}
@@ -7,7 +7,6 @@ import (
   "net/http"
   "os"
   "path"
-  "path/filepath"
   "sort"
   "strings"
 )
@@ -60,11 +59,7 @@ func (h *Handler) keepFileInList(dirPath string, f os.FileInfo) bool {
     }
     return true;
   }
-  ext := strings.ToLower(filepath.Ext(f.Name()))
-  if h.imageExts[ext] || h.videoExts[ext] || ext == ".mpr" {
-    return true;
-  }
-  return false;
+  return h.mediaType(f.Name()) != nil
 }
 
 // SymlinkPointsToDirectory returns true if f refers to a symlink
@@ -0,0 +1,158 @@
+package content
+
+import (
+  "fmt"
+  "io/ioutil"
+  "os"
+  "path"
+  "sort"
+  "strings"
+  "sync"
+)
+
+const (
+  // How many events we buffer for a subscriber before we start dropping them.
+  changeEventBufferSize = 16
+)
+
+// ChangeEvent tells subscribers that some files in a directory have been
+// created, modified or removed.
+type ChangeEvent struct {
+  Dir string            // Api path of the directory, empty for the root
+  Names []string        // Names of the changed files within Dir
+}
+
+// changeBroker passes change events to everyone who has subscribed.
+type changeBroker struct {
+  mu sync.Mutex
+  subscribers map[chan ChangeEvent]struct{}
+}
+
+func newChangeBroker() *changeBroker {
+  return &changeBroker{
+    subscribers: make(map[chan ChangeEvent]struct{}),
+  }
+}
+
+// subscribe returns a channel on which the caller will receive change
+// events, and a function to call when it no longer wants them.
+func (b *changeBroker) subscribe() (<-chan ChangeEvent, func()) {
+  ch := make(chan ChangeEvent, changeEventBufferSize)
+  b.mu.Lock()
+  b.subscribers[ch] = struct{}{}
+  b.mu.Unlock()
+  cancel := func() {
+    b.mu.Lock()
+    defer b.mu.Unlock()
+    if _, ok := b.subscribers[ch]; ok {
+      delete(b.subscribers, ch)
+      close(ch)
+    }
+  }
+  return ch, cancel
+}
+
+// publish sends an event to all subscribers. If a subscriber is not
+// keeping up, it misses the event rather than holding up everyone else.
+func (b *changeBroker) publish(event ChangeEvent) {
+  b.mu.Lock()
+  defer b.mu.Unlock()
+  for ch := range b.subscribers {
+    select {
+    case ch <- event:
+    default:
+    }
+  }
+}
+
+// Subscribe returns a channel on which the caller will receive an event
+// each time files under the content root change, and a function to call
+// to unsubscribe, which closes the channel. Events for changes made by
+// other programs are only generated when the Watch option is set in the
+// Config; uploads always generate them.
+func (h *Handler) Subscribe() (<-chan ChangeEvent, func()) {
+  return h.changes.subscribe()
+}
+
+// StopWatching stops watching the content root for changes.
+func (h *Handler) StopWatching() {
+  if h.watcher != nil {
+    h.watcher.close()
+  }
+}
+
+// filesChanged updates our caches for a set of files that have changed
+// in one directory, then tells our subscribers about the change.
+func (h *Handler) filesChanged(dirApiPath string, names map[string]bool) {
+  event := ChangeEvent{
+    Dir: cleanApiPath(dirApiPath),
+    Names: make([]string, 0, len(names)),
+  }
+  for name := range names {
+    h.fileChanged(path.Join(event.Dir, name))
+    event.Names = append(event.Names, name)
+  }
+  sort.Strings(event.Names)
+  h.changes.publish(event)
+}
+
+// fileChanged updates our caches for one file that has been created,
+// modified or removed.
+func (h *Handler) fileChanged(apiPath string) {
+  filePath := fmt.Sprintf("%s/%s", strings.TrimSuffix(h.config.ContentRoot, "/"), apiPath)
+  f, err := os.Stat(filePath)
+  exists := err == nil
+  if exists && f.IsDir() {
+    return
+  }
+  ext := strings.ToLower(path.Ext(apiPath))
+  if h.isMediaFile(apiPath) {
+    h.imageCache.invalidate(filePath)
+    if exists {
+      h.catalogRecordForFile(apiPath, filePath, f)
+    } else {
+      h.catalog.remove(apiPath)
+      h.searchIndex.updateText(apiPath, "")
+    }
+    if h.needsTranscode(apiPath) {
+      // Force the video to be transcoded again the next time it is requested.
+      os.Remove(h.mp4PathInCache(apiPath))
+      h.jobs.forget(h.mp4PathInCache(apiPath))
+    }
+    if h.isVideoFile(apiPath) {
+      h.removeHlsCache(apiPath)
+      h.removePosterFrames(apiPath, "")
+    }
+    return
+  }
+  if ext == textExtension || ext == tagsExtension || ext == xmpExtension {
+    if ext == textExtension {
+      text := ""
+      if exists {
+        if b, err := ioutil.ReadFile(filePath); err == nil {
+          text = string(b)
+        }
+      }
+      h.searchIndex.updateText(apiPath, text)
+    } else if ext == tagsExtension {
+      var tags []string
+      if exists {
+        tags = readTagsFile(filePath)
+      }
+      h.tagIndex.update(apiPath, tags)
+    }
+    // Pick up the new text, caption or tags in the catalog record for the
+    // image, and its caption in the search index.
+    if itemApiPath := h.itemForSidecarFile(apiPath); itemApiPath != "" && h.isMediaFile(itemApiPath) {
+      itemFilePath := fmt.Sprintf("%s/%s", strings.TrimSuffix(h.config.ContentRoot, "/"), itemApiPath)
+      if f, err := os.Stat(itemFilePath); err == nil {
+        h.catalogRecordForFile(itemApiPath, itemFilePath, f)
+      }
+    }
+    return
+  }
+  if !exists {
+    // Might have been a directory, in which case everything in it is gone.
+    h.catalog.removeTree(apiPath)
+  }
+}
@@ -0,0 +1,157 @@
+package content
+
+import (
+  "fmt"
+  "net/http"
+  "os"
+  "time"
+
+  "github.com/rwcarlsen/goexif/exif"
+)
+
+// ExifSummary is the subset of the EXIF data for an image that we
+// include in a ListItem when requested.
+type ExifSummary struct {
+  Make string
+  Model string
+  LensModel string
+  FocalLength float64   // in mm
+  FNumber float64
+  ExposureTime string   // in seconds, such as "1/250" or "2"
+  ISO int
+  Width int             // original dimensions in pixels
+  Height int
+}
+
+// ExifInfo is the EXIF data we make available for an image.
+// Fields not present in the image are left as zero values.
+type ExifInfo struct {
+  ExifSummary
+  LensMake string
+  FocalLengthIn35mm int
+  Flash int             // the raw EXIF Flash value
+  FlashFired bool
+  DateTime time.Time
+  Orientation int
+  HasGPS bool
+  Latitude float64      // degrees, negative is south
+  Longitude float64     // degrees, negative is west
+  Altitude float64      // meters, negative is below sea level
+}
+
+// Exif returns the EXIF data from the specified image file.
+func (h *Handler) Exif(path string) (*ExifInfo, error, int) {
+  imageFilePath := fmt.Sprintf("%s/%s", h.config.ContentRoot, path)
+  info, err := exifInfoFromFile(imageFilePath)
+  if err != nil {
+    return nil, err, http.StatusNotFound
+  }
+  return info, nil, 0
+}
+
+func exifInfoFromFile(imageFilePath string) (*ExifInfo, error) {
+  f, err := os.Open(imageFilePath)
+  if err != nil {
+    return nil, fmt.Errorf("failed to open file: %v", err)
+  }
+  defer f.Close()
+  x, err := exif.Decode(f)
+  if err != nil {
+    return nil, fmt.Errorf("failed to read EXIF data: %v", err)
+  }
+  return exifInfoFromExif(x), nil
+}
+
+// exifInfoFromExif collects the fields we care about from decoded EXIF data.
+func exifInfoFromExif(x *exif.Exif) *ExifInfo {
+  info := &ExifInfo{}
+  info.Make = exifString(x, exif.Make)
+  info.Model = exifString(x, exif.Model)
+  info.LensMake = exifString(x, exif.LensMake)
+  info.LensModel = exifString(x, exif.LensModel)
+  info.FocalLength = exifFloat(x, exif.FocalLength)
+  info.FocalLengthIn35mm = exifInt(x, exif.FocalLengthIn35mmFilm)
+  info.FNumber = exifFloat(x, exif.FNumber)
+  info.ExposureTime = exifExposureTime(x)
+  info.ISO = exifInt(x, exif.ISOSpeedRatings)
+  info.Flash = exifInt(x, exif.Flash)
+  info.FlashFired = info.Flash & 1 == 1
+  info.Width = exifInt(x, exif.PixelXDimension)
+  info.Height = exifInt(x, exif.PixelYDimension)
+  if dt, err := x.DateTime(); err == nil {
+    info.DateTime = dt
+  }
+  info.Orientation = exifInt(x, exif.Orientation)
+  if lat, lon, err := x.LatLong(); err == nil {
+    info.HasGPS = true
+    info.Latitude = lat
+    info.Longitude = lon
+    info.Altitude = exifFloat(x, exif.GPSAltitude)
+    if exifInt(x, exif.GPSAltitudeRef) == 1 {
+      info.Altitude = -info.Altitude
+    }
+  }
+  return info
+}
+
+func exifString(x *exif.Exif, name exif.FieldName) string {
+  tag, err := x.Get(name)
+  if err != nil {
+    return ""
+  }
+  s, err := tag.StringVal()
+  if err != nil {
+    return ""
+  }
+  return s
+}
+
+func exifInt(x *exif.Exif, name exif.FieldName) int {
+  tag, err := x.Get(name)
+  if err != nil {
+    return 0
+  }
+  n, err := tag.Int(0)
+  if err != nil {
+    return 0
+  }
+  return n
+}
+
+// exifFloat returns the value of a rational field as a float.
+func exifFloat(x *exif.Exif, name exif.FieldName) float64 {
+  num, den, err := exifRat(x, name)
+  if err != nil || den == 0 {
+    return 0
+  }
+  return float64(num) / float64(den)
+}
+
+func exifRat(x *exif.Exif, name exif.FieldName) (int64, int64, error) {
+  tag, err := x.Get(name)
+  if err != nil {
+    return 0, 0, err
+  }
+  return tag.Rat2(0)
+}
+
+// exifExposureTime formats the exposure time the way photographers
+// usually write it: as a fraction of a second for short exposures.
+func exifExposureTime(x *exif.Exif) string {
+  num, den, err := exifRat(x, exif.ExposureTime)
+  if err != nil || num <= 0 || den <= 0 {
+    return ""
+  }
+  return formatExposureTime(num, den)
+}
+
+func formatExposureTime(num, den int64) string {
+  if num >= den {
+    return fmt.Sprintf("%g", float64(num) / float64(den))
+  }
+  if den % num == 0 {
+    return fmt.Sprintf("1/%d", den / num)
+  }
+  // Round to the nearest 1/n, which is how cameras display it.
+  return fmt.Sprintf("1/%.0f", float64(den) / float64(num))
+}
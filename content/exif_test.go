@@ -0,0 +1,268 @@
+package content
+
+import (
+  "bytes"
+  "encoding/binary"
+  "image"
+  "image/jpeg"
+  "io/ioutil"
+  "math"
+  "net/http"
+  "os"
+  "testing"
+)
+
+const (
+  exifIfdPointerTag = 0x8769
+  gpsIfdPointerTag = 0x8825
+)
+
+// testIfdEntry is one field in an EXIF IFD for writing test files.
+// The value is a string (ASCII), uint16 (SHORT), uint32 (LONG), or
+// [][2]uint32 (RATIONAL).
+type testIfdEntry struct {
+  tag uint16
+  value interface{}
+}
+
+// testExif holds the fields to put into the three IFDs we know about.
+type testExif struct {
+  ifd0 []testIfdEntry
+  exif []testIfdEntry
+  gps []testIfdEntry
+}
+
+func TestExif(t *testing.T) {
+  testDir := "testdata/tmp"
+  os.RemoveAll(testDir)
+  if err := os.MkdirAll(testDir, 0744); err != nil {
+    t.Fatalf("Unable to create test directory: %v", err)
+  }
+  defer os.RemoveAll(testDir)
+  if err := writeTestJpegWithExif(testDir + "/exif.jpg", 40, 20, sampleTestExif()); err != nil {
+    t.Fatalf("Unable to create test image: %v", err)
+  }
+  if err := writeTestJpeg(testDir + "/noexif.jpg", 40, 20); err != nil {
+    t.Fatalf("Unable to create test image: %v", err)
+  }
+
+  h := NewHandler(&Config{
+    ContentRoot: testDir,
+  });
+
+  _, err, status := h.Exif("no-such-file.jpg")
+  if err == nil {
+    t.Errorf("exif for non-existent file should fail")
+  }
+  if got, want := status, http.StatusNotFound; got != want {
+    t.Errorf("exif status for non-existent file: got %d, want %d", got, want)
+  }
+  _, err, _ = h.Exif("noexif.jpg")
+  if err == nil {
+    t.Errorf("exif for file with no exif data should fail")
+  }
+
+  info, err, _ := h.Exif("exif.jpg")
+  if err != nil {
+    t.Fatalf("failed to get exif: %v", err)
+  }
+  if got, want := info.Make, "TestMake"; got != want {
+    t.Errorf("exif Make: got %s, want %s", got, want)
+  }
+  if got, want := info.Model, "TestModel 1"; got != want {
+    t.Errorf("exif Model: got %s, want %s", got, want)
+  }
+  if got, want := info.LensModel, "TestLens 50mm"; got != want {
+    t.Errorf("exif LensModel: got %s, want %s", got, want)
+  }
+  if got, want := info.FocalLength, 50.0; got != want {
+    t.Errorf("exif FocalLength: got %v, want %v", got, want)
+  }
+  if got, want := info.FNumber, 2.8; got != want {
+    t.Errorf("exif FNumber: got %v, want %v", got, want)
+  }
+  if got, want := info.ExposureTime, "1/250"; got != want {
+    t.Errorf("exif ExposureTime: got %v, want %v", got, want)
+  }
+  if got, want := info.ISO, 400; got != want {
+    t.Errorf("exif ISO: got %v, want %v", got, want)
+  }
+  if !info.FlashFired {
+    t.Errorf("exif FlashFired should be true")
+  }
+  if got, want := info.Width, 4000; got != want {
+    t.Errorf("exif Width: got %v, want %v", got, want)
+  }
+  if got, want := info.DateTime.Format("2006-01-02 15:04:05"), "2019-07-14 10:11:12"; got != want {
+    t.Errorf("exif DateTime: got %v, want %v", got, want)
+  }
+  if !info.HasGPS {
+    t.Fatalf("exif HasGPS should be true")
+  }
+  if got, want := info.Latitude, 37.5; math.Abs(got - want) > 0.0001 {
+    t.Errorf("exif Latitude: got %v, want %v", got, want)
+  }
+  if got, want := info.Longitude, -122.25; math.Abs(got - want) > 0.0001 {
+    t.Errorf("exif Longitude: got %v, want %v", got, want)
+  }
+  if got, want := info.Altitude, -10.0; got != want {
+    t.Errorf("exif Altitude: got %v, want %v", got, want)
+  }
+
+  list, err, _ := h.List("", ListOptions{IncludeExif: true})
+  if err != nil {
+    t.Fatalf("failed to list: %v", err)
+  }
+  if list.Items[0].Exif == nil {
+    t.Fatalf("list with exif should include exif summary")
+  }
+  if got, want := list.Items[0].Exif.Model, "TestModel 1"; got != want {
+    t.Errorf("list exif Model: got %s, want %s", got, want)
+  }
+  list, err, _ = h.List("", ListOptions{})
+  if err != nil {
+    t.Fatalf("failed to list: %v", err)
+  }
+  if list.Items[0].Exif != nil {
+    t.Errorf("list without exif should not include exif summary")
+  }
+}
+
+func TestFormatExposureTime(t *testing.T) {
+  testCases := []struct{
+    num, den int64
+    want string
+  }{
+    { 1, 250, "1/250" },
+    { 10, 2500, "1/250" },
+    { 3, 1000, "1/333" },
+    { 2, 1, "2" },
+    { 5, 2, "2.5" },
+  }
+  for _, test := range testCases {
+    if got := formatExposureTime(test.num, test.den); got != test.want {
+      t.Errorf("formatExposureTime(%d, %d): got %s, want %s", test.num, test.den, got, test.want)
+    }
+  }
+}
+
+func sampleTestExif() *testExif {
+  return &testExif{
+    ifd0: []testIfdEntry{
+      { 0x010F, "TestMake" },
+      { 0x0110, "TestModel 1" },
+    },
+    exif: []testIfdEntry{
+      { 0x829A, [][2]uint32{{1, 250}} },       // ExposureTime
+      { 0x829D, [][2]uint32{{28, 10}} },       // FNumber
+      { 0x8827, uint16(400) },                 // ISOSpeedRatings
+      { 0x9003, "2019:07:14 10:11:12" },       // DateTimeOriginal
+      { 0x9209, uint16(1) },                   // Flash
+      { 0x920A, [][2]uint32{{50, 1}} },        // FocalLength
+      { 0xA002, uint32(4000) },                // PixelXDimension
+      { 0xA003, uint32(3000) },                // PixelYDimension
+      { 0xA434, "TestLens 50mm" },             // LensModel
+    },
+    gps: []testIfdEntry{
+      { 0x0001, "N" },
+      { 0x0002, [][2]uint32{{37, 1}, {30, 1}, {0, 1}} },
+      { 0x0003, "W" },
+      { 0x0004, [][2]uint32{{122, 1}, {15, 1}, {0, 1}} },
+      { 0x0005, []byte{1} },                   // AltitudeRef: below sea level
+      { 0x0006, [][2]uint32{{10, 1}} },
+    },
+  }
+}
+
+// writeTestJpegWithExif writes a JPEG file with an APP1 segment
+// containing the given EXIF data.
+func writeTestJpegWithExif(filename string, width, height int, x *testExif) error {
+  var buf bytes.Buffer
+  im := image.NewGray(image.Rect(0, 0, width, height))
+  if err := jpeg.Encode(&buf, im, nil); err != nil {
+    return err
+  }
+  jpg := buf.Bytes()
+  tiffData := encodeTestTiff(x)
+  app1 := []byte{0xFF, 0xE1, 0, 0}
+  binary.BigEndian.PutUint16(app1[2:], uint16(2 + 6 + len(tiffData)))
+  app1 = append(app1, []byte("Exif\x00\x00")...)
+  app1 = append(app1, tiffData...)
+  out := append([]byte{}, jpg[:2]...)   // SOI
+  out = append(out, app1...)
+  out = append(out, jpg[2:]...)
+  return ioutil.WriteFile(filename, out, 0644)
+}
+
+// encodeTestTiff lays out IFD0, followed by the Exif IFD, followed by
+// the GPS IFD, each with its data immediately after it.
+func encodeTestTiff(x *testExif) []byte {
+  ifd0 := append([]testIfdEntry{}, x.ifd0...)
+  ifd0 = append(ifd0, testIfdEntry{exifIfdPointerTag, uint32(0)})
+  if len(x.gps) > 0 {
+    ifd0 = append(ifd0, testIfdEntry{gpsIfdPointerTag, uint32(0)})
+  }
+  ifd0Offset := 8
+  exifOffset := ifd0Offset + len(encodeTestIfd(ifd0, 0))
+  gpsOffset := exifOffset + len(encodeTestIfd(x.exif, 0))
+  ifd0[len(x.ifd0)].value = uint32(exifOffset)
+  if len(x.gps) > 0 {
+    ifd0[len(x.ifd0) + 1].value = uint32(gpsOffset)
+  }
+
+  out := []byte{'M', 'M', 0, 42, 0, 0, 0, 8}
+  out = append(out, encodeTestIfd(ifd0, ifd0Offset)...)
+  out = append(out, encodeTestIfd(x.exif, exifOffset)...)
+  if len(x.gps) > 0 {
+    out = append(out, encodeTestIfd(x.gps, gpsOffset)...)
+  }
+  return out
+}
+
+// encodeTestIfd encodes an IFD that is to be placed at offset in the
+// TIFF data, with values that don't fit in an entry placed after it.
+func encodeTestIfd(entries []testIfdEntry, offset int) []byte {
+  be := binary.BigEndian
+  dataOffset := offset + 2 + 12 * len(entries) + 4
+  ifd := make([]byte, 2, dataOffset - offset)
+  be.PutUint16(ifd, uint16(len(entries)))
+  data := make([]byte, 0)
+  for _, e := range entries {
+    var typ uint16
+    var count int
+    var val []byte
+    switch v := e.value.(type) {
+    case string:
+      typ, count, val = 2, len(v) + 1, append([]byte(v), 0)
+    case []byte:
+      typ, count, val = 1, len(v), v
+    case uint16:
+      typ, count, val = 3, 1, []byte{0, 0}
+      be.PutUint16(val, v)
+    case uint32:
+      typ, count, val = 4, 1, []byte{0, 0, 0, 0}
+      be.PutUint32(val, v)
+    case [][2]uint32:
+      typ, count = 5, len(v)
+      for _, r := range v {
+        b := make([]byte, 8)
+        be.PutUint32(b, r[0])
+        be.PutUint32(b[4:], r[1])
+        val = append(val, b...)
+      }
+    }
+    entry := make([]byte, 12)
+    be.PutUint16(entry, e.tag)
+    be.PutUint16(entry[2:], typ)
+    be.PutUint32(entry[4:], uint32(count))
+    if len(val) <= 4 {
+      copy(entry[8:], val)
+    } else {
+      be.PutUint32(entry[8:], uint32(dataOffset + len(data)))
+      data = append(data, val...)
+    }
+    ifd = append(ifd, entry...)
+  }
+  ifd = append(ifd, 0, 0, 0, 0)        // No next IFD
+  return append(ifd, data...)
+}
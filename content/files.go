@@ -5,13 +5,14 @@ import (
   "fmt"
   "image"
   "image/color"
-  _ "image/jpeg"
+  "image/gif"
+  "image/jpeg"
+  "image/png"
   "io"
   "io/ioutil"
   "log"
   "net/http"
   "os"
-  "os/exec"
   "path"
   "path/filepath"
   "strings"
@@ -25,16 +26,33 @@ const (
   textExtension = ".txt"
   timeFormat = "3:04:05pm Mon Jan 2, 2006 MST"
   cacheDir = ".mimcache/"
+  jpegQuality = 90
 )
 
+// The command we run to extract frames from videos and to transcode them.
+var ffmpegCommand = "ffmpeg"
+
 type Config struct {
   ContentRoot string    // The root directory of our content hierarchy
+  ImageCacheDir string  // Where to cache resized images; no caching if empty
+  ImageCacheMaxBytes int64      // Max total size of files in ImageCacheDir
+  CatalogPath string    // Where to save the catalog of file metadata; not saved if empty
+  CatalogScanInterval time.Duration     // Time between background scans; none if zero
+  Watch bool            // Watch ContentRoot for changes
+  MediaTypes []string   // Names of optional media types to enable
+  JobWorkers int        // How many transcoding jobs to run at once; default if zero
 }
 
 type Handler struct {
   config *Config
-  imageExts map[string]bool
-  videoExts map[string]bool
+  media *mediaRegistry  // The types of files we list and serve
+  imageCache *imageCache        // nil if no image caching
+  searchIndex *searchIndex
+  tagIndex *tagIndex
+  catalog *catalog
+  changes *changeBroker
+  watcher *watcher      // nil if not watching for changes
+  jobs *jobQueue        // Transcoding jobs
 }
 
 type ListItem struct {
@@ -50,6 +68,14 @@ type ListItem struct {
   ModTimeStr string      // ModTime converted to a string by the server
   Text string
   TextError string       // The error if we get one trying to read the text file
+  TextSource string      // Where Text came from, such as TextSourceTxt; empty if no text
+  Exif *ExifSummary     // Only included if requested in ListOptions
+  Attributes map[string]string  // From the index entry for the item
+  Rating int            // 0 to 5 stars, 0 if not rated
+  Flag string           // FlagPick, FlagReject, or empty if not flagged
+  Tags []string         // From the .tags file for the item
+  Animated bool         // True for a GIF file with more than one frame
+  Video *VideoInfo      // Duration, size and codecs of a video file
 }
 
 type ListResult struct {
@@ -58,8 +84,23 @@ type ListResult struct {
   Items []ListItem
 }
 
+// ListOptions are the optional parts of a request to list a directory or index.
+type ListOptions struct {
+  IncludeExif bool      // Include a summary of the EXIF data for each item
+  MinRating int         // Only include files with at least this rating
+  Flag string           // Only include files with this flag, FlagNone for unflagged
+}
+
+// ImageOptions control how Image renders an image.
+type ImageOptions struct {
+  Raw bool              // Ignore the crop and adjustments in the index entry, to show the original
+  Format string         // ImageFormatJpeg, ImageFormatPng, ImageFormatGif or ImageFormatOriginal; empty for the default
+  Quality int           // JPEG quality from 1 to 100; 0 for the default
+}
+
 type UpdateTextCommand struct {
   Content string
+  Sidecar bool          // Write to the XMP sidecar for the image rather than the text file
 }
 
 // dirInfo stores info loaded from one directory.
@@ -75,20 +116,37 @@ func NewHandler(c *Config) Handler {
 }
 
 func (h *Handler) init() {
-  h.imageExts = map[string]bool {
-    ".gif": true,
-    ".jpeg": true,
-    ".jpg": true,
-    ".png": true,
+  h.media = newMediaRegistry(h.config.MediaTypes)
+  h.searchIndex = newSearchIndex(h.config.ContentRoot, h.searchCaptionForFile)
+  h.tagIndex = newTagIndex(h.config.ContentRoot)
+  h.catalog = newCatalog(h.config.CatalogPath)
+  if h.config.CatalogScanInterval > 0 {
+    go h.scanCatalogInBackground(h.config.CatalogScanInterval)
+  }
+  h.changes = newChangeBroker()
+  h.jobs = newJobQueue(h.config.JobWorkers)
+  if h.config.ImageCacheDir != "" && h.config.ImageCacheMaxBytes > 0 {
+    c, err := newImageCache(h.config.ImageCacheDir, h.config.ImageCacheMaxBytes)
+    if err != nil {
+      log.Printf("Image caching disabled: %v", err)
+    } else {
+      h.imageCache = c
+    }
   }
-  h.videoExts = map[string]bool {
-    ".mp4": true,
-    ".mpg": true,
-    ".mts": true,
+  if h.config.Watch {
+    w, err := h.startWatcher()
+    if err != nil {
+      log.Printf("Not watching for changes: %v", err)
+    } else {
+      h.watcher = w
+    }
   }
 }
 
-func (h *Handler) List(dirApiPath string) (*ListResult, error, int) {
+func (h *Handler) List(dirApiPath string, options ListOptions) (*ListResult, error, int) {
+  if err := checkListFilter(options); err != nil {
+    return nil, err, http.StatusBadRequest
+  }
   contentRoot := strings.TrimSuffix(h.config.ContentRoot, "/")
   dirApiPath = strings.TrimSuffix(dirApiPath, "/")
   dirPath := fmt.Sprintf("%s/%s", contentRoot, dirApiPath)
@@ -108,16 +166,23 @@ func (h *Handler) List(dirApiPath string) (*ListResult, error, int) {
 
   loc := readTzFile(dirPath)
 
-  result := h.mapFileInfosToListResult(files, dirPath, loc, flags.ignoreFileTimes)
+  result := h.mapFileInfosToListResult(files, dirPath, loc, flags.ignoreFileTimes, options)
   result.UnfilteredFileCount = unfilteredFileCount
   if imageIndex != nil {
     result.IndexName = imageIndex.indexName
+    for i := range result.Items {
+      result.Items[i].setIndexEntry(imageIndex.entries[result.Items[i].Name])
+    }
   }
+  result.Items = filterListItems(result.Items, options)
   return result, nil, 0
 }
 
 // ListFromIndex creates a list of files as given in the specified index file.
-func (h *Handler) ListFromIndex(indexApiPath string) (*ListResult, error, int) {
+func (h *Handler) ListFromIndex(indexApiPath string, options ListOptions) (*ListResult, error, int) {
+  if err := checkListFilter(options); err != nil {
+    return nil, err, http.StatusBadRequest
+  }
   contentRoot := strings.TrimSuffix(h.config.ContentRoot, "/")
   indexApiPath = strings.TrimSuffix(indexApiPath, "/")
   indexApiDir := path.Dir(indexApiPath)
@@ -153,17 +218,51 @@ func (h *Handler) ListFromIndex(indexApiPath string) (*ListResult, error, int) {
       if err != nil {
         return nil, fmt.Errorf("Error reading file info for %s", fn), http.StatusInternalServerError
       }
-      h.mapFileInfoToListItem(f, &list[i], dir, dirInfo.loc, dirInfo.flags.ignoreFileTimes)
+      h.mapFileInfoToListItem(f, &list[i], dir, dirInfo.loc, dirInfo.flags.ignoreFileTimes, options)
       list[i].Path = path.Join("/", indexApiDir, fn)
       list[i].IndexPath = indexApiPath
       list[i].IndexEntry = fn
+      list[i].setIndexEntry(imageIndex.entries[fn])
     }
   }
   return &ListResult{
-    Items: list,
+    Items: filterListItems(list, options),
   }, nil, 0
 }
 
+// apiPathsToListItems creates list items for files scattered across
+// directories, each with its full path. Files that no longer exist
+// are skipped. The options are used as for List, but not to filter.
+func (h *Handler) apiPathsToListItems(apiPaths []string, options ListOptions) []ListItem {
+  contentRoot := strings.TrimSuffix(h.config.ContentRoot, "/")
+  dirInfos := make(map[string]dirInfo)
+  indexes := make(map[string]*ImageIndex)
+  list := make([]ListItem, 0, len(apiPaths))
+  for _, apiPath := range apiPaths {
+    filePath := path.Join(contentRoot, apiPath)
+    dir := path.Dir(filePath)
+    di, ok := dirInfos[dir]
+    if !ok {
+      di.loc = readTzFile(dir)
+      di.flags = loadDirFlags(dir)
+      dirInfos[dir] = di
+      indexes[dir] = h.imageIndex(dir)
+    }
+    f, err := os.Stat(filePath)
+    if err != nil {
+      continue
+    }
+    var item ListItem
+    h.mapFileInfoToListItem(f, &item, dir, di.loc, di.flags.ignoreFileTimes, options)
+    if index := indexes[dir]; index != nil {
+      item.setIndexEntry(index.entries[f.Name()])
+    }
+    item.Path = "/" + apiPath
+    list = append(list, item)
+  }
+  return list
+}
+
 // validDirsFromSet takes a set of relative directories and returns
 // the equivalent set of directories resolved against dirPath, removing
 // any that are not withing contentRoot.
@@ -198,29 +297,25 @@ func readTzFile(dirPath string) *time.Location {
 }
 
 func (h *Handler) mapFileInfosToListResult(files []os.FileInfo, parentPath string,
-    loc *time.Location, ignoreFileTimes bool) *ListResult {
+    loc *time.Location, ignoreFileTimes bool, options ListOptions) *ListResult {
   n := len(files)
   list := make([]ListItem, n, n)
   for i, f := range files {
-    h.mapFileInfoToListItem(f, &list[i], parentPath, loc, ignoreFileTimes)
+    h.mapFileInfoToListItem(f, &list[i], parentPath, loc, ignoreFileTimes, options)
   }
   return &ListResult{
     Items: list,
   }
 }
 
-func (h *Handler) mapFileInfoToListItem(f os.FileInfo, item *ListItem, parentPath string, loc *time.Location, ignoreFileTimes bool) {
+func (h *Handler) mapFileInfoToListItem(f os.FileInfo, item *ListItem, parentPath string,
+    loc *time.Location, ignoreFileTimes bool, options ListOptions) {
   item.Name = f.Name()
   item.IsDir = f.IsDir() || isSymlinkToDir(parentPath, f)
   item.Size = f.Size()
   item.ModTime = f.ModTime().Unix()
-  ext := strings.ToLower(filepath.Ext(item.Name))
-  if h.imageExts[ext] {
-    item.Type = "image"
-  } else if h.videoExts[ext] {
-    item.Type = "video"
-  } else if ext == ".mpr" {
-    item.Type = "index"
+  if t := h.mediaType(item.Name); t != nil {
+    item.Type = t.Kind
   }
   if !ignoreFileTimes {
     t := f.ModTime()
@@ -229,8 +324,28 @@ func (h *Handler) mapFileInfoToListItem(f os.FileInfo, item *ListItem, parentPat
     }
     item.ModTimeStr = t.Format(timeFormat)
   }
-  h.loadTextFile(item, parentPath)
-  h.loadExifDateTime(item, parentPath)
+  if item.IsDir {
+    h.loadTextFile(item, parentPath)
+    item.Tags = readTagsFile(filepath.Join(parentPath, item.Name, summaryTagsName))
+    return
+  }
+  // For media files, we get the info from our catalog, which only
+  // reads the files if they have changed since the last time we looked.
+  r := h.catalogRecordForListItem(parentPath, f)
+  if r == nil {
+    h.loadTextFile(item, parentPath)
+    return
+  }
+  item.Text = r.Text
+  item.TextError = r.TextError
+  item.TextSource = r.TextSource
+  item.Tags = r.Tags
+  item.Animated = r.Animated
+  item.Video = r.Video
+  item.ExifDateTime = r.ExifDateTime
+  if options.IncludeExif {
+    item.Exif = r.Exif
+  }
 }
 
 func (h *Handler) loadTextFile(item *ListItem, parentPath string) {
@@ -249,30 +364,134 @@ func (h *Handler) loadTextFile(item *ListItem, parentPath string) {
     }
   } else {
     item.Text = string(b)
+    item.TextSource = TextSourceTxt
   }
 }
 
-// loadExifDateTime opens the image file, reads the DateTime field
-// from the exif data, and stores it in the item.
-func (h *Handler) loadExifDateTime(item *ListItem, parentPath string) {
-    imagepath := fmt.Sprintf("%s/%s", parentPath, item.Name)
-    datetime, err := datetimeFromFile(imagepath)
+// ImageJpeg returns the specified image as JPEG data, resized and rotated
+// as with Image.
+func (h *Handler) ImageJpeg(path string, width, height, rot int, options ImageOptions) ([]byte, error, int) {
+  options.Format = ImageFormatJpeg
+  b, _, err, status := h.ImageBytes(path, width, height, rot, options)
+  return b, err, status
+}
+
+// ImageBytes returns the specified image encoded in the format from the
+// options, resized and rotated as with Image, along with its content type.
+// If we have an image cache, we look there first, and we save newly
+// generated images there. With ImageFormatOriginal, we return the bytes
+// from the image file if we don't need to change the image.
+func (h *Handler) ImageBytes(path string, width, height, rot int, options ImageOptions) ([]byte, string, error, int) {
+  if options.Format == ImageFormatOriginal {
+    if b, contentType, ok := h.passthroughImage(path, width, height, rot, options); ok {
+      return b, contentType, nil, 0
+    }
+    options.Format = ""
+  }
+  format := options.Format
+  if format == "" {
+    format = h.defaultImageFormat(path)
+  }
+  contentType, ok := imageFormatContentTypes[format]
+  if !ok {
+    return nil, "", fmt.Errorf("image format %s is not supported", format), http.StatusBadRequest
+  }
+  quality := options.Quality
+  if quality == 0 {
+    quality = jpegQuality
+  }
+  if quality < 1 || quality > 100 {
+    return nil, "", fmt.Errorf("quality must be from 1 to 100"), http.StatusBadRequest
+  }
+
+  imageFilePath := fmt.Sprintf("%s/%s", h.config.ContentRoot, path)
+  // The index entry holds the rotation and crop for this image, so we include
+  // it in the cache key to make sure we see changes made to the index file.
+  variant := fmt.Sprintf("w=%d;h=%d;r=%d;fmt=%s;q=%d;raw=%t;index=%s",
+      width, height, rot, format, quality, options.Raw, h.indexEntryStringForImage(imageFilePath))
+  if b, ok := h.imageCache.get(imageFilePath, variant); ok {
+    return b, contentType, nil, 0
+  }
+
+  var buf bytes.Buffer
+  if format == ImageFormatGif && strings.ToLower(filepath.Ext(path)) == ".gif" {
+    g, err, status := h.animatedGif(path, width, height, rot, options)
     if err != nil {
-        log.Printf("Error getting EXIF DateTime for parent %s: %v", parentPath, err)
-    } else {
-        item.ExifDateTime = datetime
+      return nil, "", err, status
+    }
+    if err := gif.EncodeAll(&buf, g); err != nil {
+      return nil, "", fmt.Errorf("failed to encode image: %v", err), http.StatusInternalServerError
     }
+    b := buf.Bytes()
+    h.imageCache.put(imageFilePath, variant, b)
+    return b, contentType, nil, 0
+  }
+  im, err, status := h.Image(path, width, height, rot, options)
+  if err != nil {
+    return nil, "", err, status
+  }
+  if format == ImageFormatPng {
+    err = png.Encode(&buf, im)
+  } else if format == ImageFormatGif {
+    err = gif.Encode(&buf, im, nil)
+  } else {
+    err = jpeg.Encode(&buf, im, &jpeg.Options{
+      Quality: quality,
+    })
+  }
+  if err != nil {
+    return nil, "", fmt.Errorf("failed to encode image: %v", err), http.StatusInternalServerError
+  }
+  b := buf.Bytes()
+  h.imageCache.put(imageFilePath, variant, b)
+  return b, contentType, nil, 0
 }
 
-func (h *Handler) Image(path string, width, height, rot int) (image.Image, error, int) {
+func (h *Handler) Image(path string, width, height, rot int, options ImageOptions) (image.Image, error, int) {
   im, exifOrientation, _, err := h.imageFromPath(path, width, height)
   if err != nil {
     return nil, fmt.Errorf("failed to decode image file: %v", err), http.StatusBadRequest
   }
 
   imageFilePath := fmt.Sprintf("%s/%s", h.config.ContentRoot, path)
-  exifRotation := exifOrientationToRotation(exifOrientation)
-  rot = rot + h.rotationFromIndexAndExif(imageFilePath, exifRotation)
+  t := h.imageTransformFor(imageFilePath, exifOrientationToRotation(exifOrientation), rot, options)
+  return t.apply(im, width, height), nil, 0
+}
+
+// imageTransform is what we do to an image from a file to display it.
+type imageTransform struct {
+  crop *cropRect        // Relative to the unrotated image; nil for none
+  entry *imageEntry     // For the adjustments; nil for none
+  rot int               // Total counterclockwise rotation in degrees
+}
+
+// imageTransformFor returns the transform for the image file, from its index
+// entry and EXIF rotation, plus the additional rotation requested.
+func (h *Handler) imageTransformFor(imageFilePath string, exifRotation, rot int, options ImageOptions) imageTransform {
+  displayRot := h.rotationFromIndexAndExif(imageFilePath, exifRotation)
+  t := imageTransform{
+    rot: rot + displayRot,
+  }
+  if !options.Raw {
+    t.entry = h.indexEntryForImage(imageFilePath)
+    if crop := cropFromEntry(t.entry); crop != nil {
+      // The crop is relative to the image as displayed, so we map it back
+      // to the unrotated image, which we crop before resizing.
+      c := crop.unrotate(displayRot)
+      t.crop = &c
+    }
+  }
+  return t
+}
+
+// apply crops, resizes, adjusts and rotates the image. The width and height
+// are the size of the box to fit the rotated image into; zero for either
+// means no limit in that direction.
+func (t imageTransform) apply(im image.Image, width, height int) image.Image {
+  if t.crop != nil {
+    im = t.crop.apply(im)
+  }
+  rot := t.rot
   if ((rot + 360) / 90) % 2 == 1 {
     width, height = height, width
   }
@@ -294,16 +513,24 @@ func (h *Handler) Image(path string, width, height, rot int) (image.Image, error
     im = imaging.Resize(im, width, height, imaging.Box)
   }
 
+  if t.entry != nil {
+    // After resizing, so that we have fewer pixels to adjust.
+    im = applyAdjustments(im, t.entry)
+  }
+
   if rot != 0 {
     im = imaging.Rotate(im, float64(rot), color.Black)
   }
 
-  return im, nil, 0
+  return im
 }
 
 func (h *Handler) imageFromPath(path string, width, height int) (image.Image, int, string, error) {
-  ext := strings.ToLower(filepath.Ext(path))
-  if (h.videoExts[ext]) {
+  t := h.mediaType(path)
+  if t != nil && t.Decode != nil {
+    im, orientation, err := t.Decode(fmt.Sprintf("%s/%s", h.config.ContentRoot, path))
+    return im, orientation, t.Name, err
+  } else if t != nil && t.Kind == MediaKindVideo {
     return h.imageFromVideo(path, width, height)
   } else {
     return h.imageFromFile(path)
@@ -389,25 +616,21 @@ func orientationFromOpenFile(path string, f *os.File) int {
   return orientation
 }
 
+// imageFromVideo returns the poster frame for the video.
 func (h *Handler) imageFromVideo(path string, width, height int) (image.Image, int, string, error) {
-  inputFilePath := fmt.Sprintf("%s/%s", h.config.ContentRoot, path)
-  cmd := exec.Command("ffmpeg",
-      "-i", inputFilePath,
-      "-vframes", "1",
-      "-f", "singlejpeg",
-      "-")
-  var buf bytes.Buffer
-  cmd.Stdout = &buf
-  if err := cmd.Run(); err != nil {
+  im, err := h.posterFrame(path)
+  if err != nil {
     log.Printf("Error extracting image from video file %v: %v", path, err)
-    return nil, -1, "", fmt.Errorf("Error extracting image from video file %v: %v", path, err)
+    return nil, -1, "", err
   }
-  r := bytes.NewReader(buf.Bytes())
-  img, imgFmt, err := image.Decode(r)
-  return img, -1, imgFmt, err
+  return im, -1, "jpeg", nil
 }
 
-func (h *Handler) transcodeVideoToCache(path string) error {
+// transcodeVideoToCache transcodes the video to mp4/H.264 in our cache
+// directory. We write it under a temporary name and rename it when we are
+// done, so that a transcode that fails or is interrupted never leaves a
+// partial file that looks like it is cached.
+func (h *Handler) transcodeVideoToCache(path string, progress func(float64)) error {
   inputFilePath := fmt.Sprintf("%s/%s", h.config.ContentRoot, path)
   transcodedFilePath := h.mp4PathInCache(path)
   transcodedFileDir := filepath.Dir(transcodedFilePath)
@@ -417,7 +640,9 @@ func (h *Handler) transcodeVideoToCache(path string) error {
       return err
     }
   }
-  cmd := exec.Command("ffmpeg",
+  tmpFilePath := transcodedFilePath + ".tmp"
+  args := []string{
+      "-y",
       "-i", inputFilePath,
       "-c:v", "libx264",
       "-preset", "slow",
@@ -425,28 +650,62 @@ func (h *Handler) transcodeVideoToCache(path string) error {
       "-c:a", "aac",
       "-strict", "experimental",
       "-b:a", "128k",
-      transcodedFilePath)
+      "-f", "mp4",
+      tmpFilePath,
+  }
   log.Printf("Transcoding video file %s to %s", inputFilePath, transcodedFilePath)
-  if err := cmd.Run(); err != nil {
-    log.Printf("Error transcoding video file %v: %v", path, err)
+  if err := runFfmpegWithProgress(args, progress); err != nil {
+    os.Remove(tmpFilePath)
     return fmt.Errorf("Error transcoding video file %v: %v", path, err)
   }
+  if err := os.Rename(tmpFilePath, transcodedFilePath); err != nil {
+    os.Remove(tmpFilePath)
+    return err
+  }
   log.Printf("Done transcoding video file %s", transcodedFilePath)
   return nil
 }
 
+// submitTranscode queues a job to transcode the video, or returns the
+// job that is already doing so.
+func (h *Handler) submitTranscode(path string) *Job {
+  return h.jobs.submit(JobKindTranscode, path, h.mp4PathInCache(path), func(progress func(float64)) error {
+    return h.transcodeVideoToCache(path, progress)
+  })
+}
+
+// startTranscode queues a job to transcode the video if it is not already
+// in the cache, and returns a copy of the job, or nil if there is no job.
+func (h *Handler) startTranscode(path string) *Job {
+  transcodedFilePath := h.mp4PathInCache(path)
+  if job := h.jobs.status(transcodedFilePath); job != nil {
+    return job
+  }
+  if _, err := os.Stat(transcodedFilePath); err == nil {
+    return nil
+  }
+  return h.jobs.snapshot(h.submitTranscode(path))
+}
+
+func fileExists(filePath string) bool {
+  _, err := os.Stat(filePath)
+  return err == nil
+}
+
 // VideoFilePath returns the path on disk to the specified video file.
 // If the extension is not one of our video extensions, returns the empty string.
+// If the video needs to be transcoded, waits for the transcoding job.
 func (h *Handler) VideoFilePath(path string) (string, error) {
-  ext := strings.ToLower(filepath.Ext(path))
-  if !h.videoExts[ext] {
+  if !h.isVideoFile(path) {
     return "", nil;          // Not a video file
   }
   videoFilePath := fmt.Sprintf("%s/%s", h.config.ContentRoot, path)
-  if ext == ".mpg" || ext == ".mts" {
+  if h.needsTranscode(path) {
     transcodedFilePath := h.mp4PathInCache(path)
-    if _, err := os.Stat(transcodedFilePath); os.IsNotExist(err) {
-      if err := h.transcodeVideoToCache(path); err != nil {
+    // Check for a job first, since the job creates the file before it finishes.
+    if h.jobs.status(transcodedFilePath) != nil || !fileExists(transcodedFilePath) {
+      // Wait for the job that is already running, or start one.
+      if err := h.jobs.wait(h.submitTranscode(path)); err != nil {
         return "", err
       }
     }
@@ -463,12 +722,48 @@ func (h *Handler) mp4PathInCache(path string) string {
   return dir + cacheDir + base + ".mp4"
 }
 
+// FileVersion returns a string that changes whenever the specified file
+// changes, and the modification time of the file, for use in validating
+// a client's cached copy of the file.
+func (h *Handler) FileVersion(path string) (string, time.Time, error, int) {
+  filePath := fmt.Sprintf("%s/%s", h.config.ContentRoot, path)
+  f, err := os.Stat(filePath)
+  if err != nil {
+    return "", time.Time{}, fmt.Errorf("failed to stat file: %v", err), http.StatusNotFound
+  }
+  version := fmt.Sprintf("%d-%d", f.ModTime().UnixNano(), f.Size())
+  return version, f.ModTime(), nil, 0
+}
+
+// ImageVersion is like FileVersion, but also includes the entry for the
+// image in the index file, since that can change how we display the image.
+// The returned time is the later of the image and index modification times.
+func (h *Handler) ImageVersion(path string) (string, time.Time, error, int) {
+  version, modTime, err, status := h.FileVersion(path)
+  if err != nil {
+    return "", time.Time{}, err, status
+  }
+  imageFilePath := fmt.Sprintf("%s/%s", h.config.ContentRoot, path)
+  indexPath := filepath.Join(filepath.Dir(imageFilePath), "index.mpr")
+  if f, err := os.Stat(indexPath); err == nil && f.ModTime().After(modTime) {
+    modTime = f.ModTime()
+  }
+  version = version + ";" + h.indexEntryStringForImage(imageFilePath)
+  return version, modTime, nil, 0
+}
+
 func (h *Handler) Text(path string) ([]byte, error, int) {
   textFilePath := fmt.Sprintf("%s/%s", h.config.ContentRoot, path)
   if filepath.Ext(textFilePath) != textExtension {
     return nil, fmt.Errorf("Text operations can only apply to %s files, not to %s", textExtension, textFilePath), http.StatusBadRequest
   }
   b, err := ioutil.ReadFile(textFilePath)
+  if os.IsNotExist(err) {
+    // Use the caption from the XMP or IPTC data, if there is one.
+    if r := h.catalogRecordForTextFile(path); r != nil && r.Text != "" {
+      return []byte(r.Text), nil, 0
+    }
+  }
   if err != nil {
     return nil, fmt.Errorf("failed to read file: %v", err), http.StatusNotFound
   }
@@ -481,6 +776,9 @@ func (h *Handler) PutText(path string, command UpdateTextCommand) (error, int) {
     return fmt.Errorf("Text operations can only apply to %s files, not to %s", textExtension, textFilePath), http.StatusBadRequest
   }
   content := command.Content
+  if command.Sidecar {
+    return h.putSidecarText(path, content)
+  }
   if content == "" {
     // Delete the file rather than writing out an empty file.
     err := os.Remove(textFilePath)
@@ -494,9 +792,49 @@ func (h *Handler) PutText(path string, command UpdateTextCommand) (error, int) {
       return err, http.StatusInternalServerError
     }
   }
+  h.searchIndex.updateText(path, content)
+  // The caption from the XMP sidecar or the image may show again.
+  h.catalogRecordForTextFile(path)
   return nil, http.StatusOK
 }
 
+// putSidecarText writes the caption for the image that goes with the text
+// file path into the XMP sidecar file for the image. If there is a text
+// file, its text is what we show, so we don't allow that.
+func (h *Handler) putSidecarText(path, content string) (error, int) {
+  itemApiPath := h.itemForSidecarFile(cleanApiPath(path))
+  if itemApiPath == "" || !h.isMediaFile(itemApiPath) {
+    return fmt.Errorf("no image file for %s", path), http.StatusNotFound
+  }
+  contentRoot := strings.TrimSuffix(h.config.ContentRoot, "/")
+  itemFilePath := fmt.Sprintf("%s/%s", contentRoot, itemApiPath)
+  if _, err := os.Stat(textFilePathFor(itemFilePath)); err == nil {
+    return fmt.Errorf("%s exists, remove it before writing to the XMP sidecar", path), http.StatusConflict
+  }
+  if err := writeXmpSidecarCaption(xmpSidecarPathFor(itemFilePath), content); err != nil {
+    return err, http.StatusInternalServerError
+  }
+  // Pick up the new caption in the catalog and the search index.
+  h.catalogRecordForTextFile(path)
+  return nil, http.StatusOK
+}
+
+// catalogRecordForTextFile returns the catalog record for the media file
+// that goes with the text file, or nil if there is none.
+func (h *Handler) catalogRecordForTextFile(path string) *catalogRecord {
+  itemApiPath := h.itemForSidecarFile(cleanApiPath(path))
+  if itemApiPath == "" || !h.isMediaFile(itemApiPath) {
+    return nil
+  }
+  itemFilePath := fmt.Sprintf("%s/%s", strings.TrimSuffix(h.config.ContentRoot, "/"), itemApiPath)
+  f, err := os.Stat(itemFilePath)
+  if err != nil {
+    return nil
+  }
+  r, _ := h.catalogRecordForFile(itemApiPath, itemFilePath, f)
+  return r
+}
+
 // Given an EXIF Orientation, returns the number of degress of counterclockwise
 // rotation required to  display the image with the appropriate edge at the top.
 // If the value is not one of the 8 defined orientations, returns 0.
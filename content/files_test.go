@@ -12,7 +12,7 @@ func TestListNoIndex(t *testing.T) {
     ContentRoot: "testdata",
   });
 
-  list, err, status := h.List("no-such-directory")
+  list, err, status := h.List("no-such-directory", ListOptions{})
   if err == nil {
     t.Errorf("listing non-existant directory should fail")
   }
@@ -20,7 +20,7 @@ func TestListNoIndex(t *testing.T) {
     t.Errorf("listing non-existant directory should return NotFound status")
   }
 
-  list, err, status = h.List("d1")
+  list, err, status = h.List("d1", ListOptions{})
   if err != nil {
     t.Fatalf("failed to list test directory d1")
   }
@@ -49,7 +49,7 @@ func TestListWithIndex(t *testing.T) {
     ContentRoot: "testdata",
   });
 
-  list, err, _ := h.List("with-index")
+  list, err, _ := h.List("with-index", ListOptions{})
   if err != nil {
     t.Fatalf("failed to list test directory with-index")
   }
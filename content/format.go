@@ -0,0 +1,96 @@
+package content
+
+import (
+  "fmt"
+  "io/ioutil"
+  "os"
+  "path/filepath"
+  "strings"
+)
+
+// Formats for ImageOptions.Format. We can't offer WebP, since neither
+// the standard library nor our image packages can encode it.
+const (
+  ImageFormatJpeg = "jpeg"
+  ImageFormatPng = "png"
+  ImageFormatGif = "gif"        // Animated if the file is an animated GIF
+  // The image file as it is if we don't need to change it,
+  // otherwise the default format.
+  ImageFormatOriginal = "original"
+)
+
+var imageFormatContentTypes = map[string]string{
+  ImageFormatJpeg: "image/jpeg",
+  ImageFormatPng: "image/png",
+  ImageFormatGif: "image/gif",
+}
+
+// defaultImageFormat returns the format we use for the file when none is
+// requested. Animated GIFs stay GIFs so that they keep all of their frames.
+// Other images from PNG and GIF files may be transparent, so we use PNG
+// for them; everything else, including frames from videos, is JPEG.
+func (h *Handler) defaultImageFormat(path string) string {
+  switch strings.ToLower(filepath.Ext(path)) {
+  case ".gif":
+    if r := h.catalogRecordForPath(path); r != nil && r.Animated {
+      return ImageFormatGif
+    }
+    return ImageFormatPng
+  case ".png":
+    return ImageFormatPng
+  }
+  return ImageFormatJpeg
+}
+
+// catalogRecordForPath returns the catalog record for the media file,
+// or nil if there is no such file.
+func (h *Handler) catalogRecordForPath(path string) *catalogRecord {
+  if !h.isMediaFile(path) {
+    return nil
+  }
+  filePath := fmt.Sprintf("%s/%s", h.config.ContentRoot, path)
+  f, err := os.Stat(filePath)
+  if err != nil {
+    return nil
+  }
+  r, _ := h.catalogRecordForFile(cleanApiPath(path), filePath, f)
+  return r
+}
+
+// passthroughImage returns the contents of the image file and its content
+// type if the image would be displayed exactly as it is in the file: not
+// rotated, cropped or adjusted, and not larger than the requested size.
+// The bool return value is false if we can't pass the file through.
+func (h *Handler) passthroughImage(path string, width, height, rot int, options ImageOptions) ([]byte, string, bool) {
+  t := h.mediaType(path)
+  if t == nil || t.Kind != MediaKindImage || t.ContentType == "" {
+    return nil, "", false       // Not an image browsers can display
+  }
+  contentType := t.ContentType
+  imageFilePath := fmt.Sprintf("%s/%s", h.config.ContentRoot, path)
+  r := h.catalogRecordForPath(path)
+  if r == nil || r.Width == 0 || r.Height == 0 {
+    return nil, "", false       // Not an image we can read
+  }
+  if (width != 0 && r.Width > width) || (height != 0 && r.Height > height) {
+    return nil, "", false
+  }
+  if r.Orientation > 1 {
+    // Browsers follow the EXIF orientation, which the index can override.
+    return nil, "", false
+  }
+  if (rot + h.rotationFromIndexAndExif(imageFilePath, 0)) % 360 != 0 {
+    return nil, "", false
+  }
+  if !options.Raw {
+    entry := h.indexEntryForImage(imageFilePath)
+    if cropFromEntry(entry) != nil || hasAdjustments(entry) {
+      return nil, "", false
+    }
+  }
+  b, err := ioutil.ReadFile(imageFilePath)
+  if err != nil {
+    return nil, "", false
+  }
+  return b, contentType, true
+}
@@ -0,0 +1,135 @@
+package content
+
+import (
+  "bytes"
+  "image"
+  "image/color"
+  "image/png"
+  "io/ioutil"
+  "net/http"
+  "os"
+  "testing"
+)
+
+func TestImageBytes(t *testing.T) {
+  testDir := "testdata/tmp"
+  os.RemoveAll(testDir)
+  if err := os.MkdirAll(testDir, 0744); err != nil {
+    t.Fatalf("Unable to create test directory: %v", err)
+  }
+  defer os.RemoveAll(testDir)
+
+  // A partly transparent PNG.
+  im := image.NewNRGBA(image.Rect(0, 0, 20, 10))
+  for x := 0; x < 10; x++ {
+    im.Set(x, 5, color.NRGBA{255, 0, 0, 255})
+  }
+  // Not the default compression, so that the original is different
+  // from what we get when we encode the image again.
+  var buf bytes.Buffer
+  encoder := png.Encoder{CompressionLevel: png.NoCompression}
+  if err := encoder.Encode(&buf, im); err != nil {
+    t.Fatalf("Unable to encode test image: %v", err)
+  }
+  original := buf.Bytes()
+  if err := ioutil.WriteFile(testDir + "/img.png", original, 0644); err != nil {
+    t.Fatalf("Unable to write test image: %v", err)
+  }
+  if err := writeTestJpeg(testDir + "/img.jpg", 20, 10); err != nil {
+    t.Fatalf("Unable to write test image: %v", err)
+  }
+
+  h := NewHandler(&Config{
+    ContentRoot: testDir,
+  });
+  testCases := []struct{
+    path string
+    width, height int
+    options ImageOptions
+    wantType string
+    wantOriginal bool
+  }{
+    { "img.png", 0, 0, ImageOptions{}, "image/png", false },
+    { "img.png", 10, 10, ImageOptions{Format: ImageFormatJpeg}, "image/jpeg", false },
+    { "img.png", 0, 0, ImageOptions{Format: ImageFormatOriginal}, "image/png", true },
+    { "img.png", 20, 20, ImageOptions{Format: ImageFormatOriginal}, "image/png", true },
+    { "img.png", 10, 10, ImageOptions{Format: ImageFormatOriginal}, "image/png", false },
+    { "img.jpg", 0, 0, ImageOptions{}, "image/jpeg", false },
+    { "img.jpg", 0, 0, ImageOptions{Format: ImageFormatPng}, "image/png", false },
+    { "img.jpg", 0, 0, ImageOptions{Quality: 50}, "image/jpeg", false },
+  }
+  for _, tc := range testCases {
+    b, contentType, err, _ := h.ImageBytes(tc.path, tc.width, tc.height, 0, tc.options)
+    if err != nil {
+      t.Fatalf("ImageBytes(%s, %+v) failed: %v", tc.path, tc.options, err)
+    }
+    if contentType != tc.wantType {
+      t.Errorf("ImageBytes(%s, %+v) content type: got %s, want %s", tc.path, tc.options, contentType, tc.wantType)
+    }
+    if got := bytes.Equal(b, original); got != tc.wantOriginal {
+      t.Errorf("ImageBytes(%s, %d, %d, %+v) returned original: got %v, want %v",
+          tc.path, tc.width, tc.height, tc.options, got, tc.wantOriginal)
+    }
+    decoded, _, err := image.Decode(bytes.NewReader(b))
+    if err != nil {
+      t.Errorf("ImageBytes(%s, %+v) result does not decode: %v", tc.path, tc.options, err)
+      continue
+    }
+    if tc.wantType == "image/png" && tc.path == "img.png" {
+      if _, _, _, a := decoded.At(0, 0).RGBA(); a != 0 {
+        t.Errorf("ImageBytes(%s, %+v) lost transparency", tc.path, tc.options)
+      }
+    }
+  }
+
+  // Passthrough is not possible when the image is rotated.
+  command := UpdateCommand{Item: "img.png", Action: "deltarotation", Value: "+r", Autocreate: true}
+  if err, _ := h.UpdateImageIndex("index.mpr", command); err != nil {
+    t.Fatalf("failed to rotate image: %v", err)
+  }
+  b, _, err, _ := h.ImageBytes("img.png", 0, 0, 0, ImageOptions{Format: ImageFormatOriginal})
+  if err != nil {
+    t.Fatalf("ImageBytes of rotated image failed: %v", err)
+  }
+  if bytes.Equal(b, original) {
+    t.Errorf("ImageBytes of rotated image returned the original")
+  }
+
+  // Nor when the index overrides the EXIF orientation, which browsers
+  // would follow.
+  if err := os.MkdirAll(testDir + "/sub", 0744); err != nil {
+    t.Fatalf("Unable to create test directory: %v", err)
+  }
+  orientation := &testExif{ifd0: []testIfdEntry{{ 0x0112, uint16(6) }}}
+  if err := writeTestJpegWithExif(testDir + "/sub/exif.jpg", 20, 10, orientation); err != nil {
+    t.Fatalf("Unable to write test image: %v", err)
+  }
+  if err := ioutil.WriteFile(testDir + "/sub/index.mpr", []byte("exif.jpg\n"), 0644); err != nil {
+    t.Fatalf("Unable to write test index: %v", err)
+  }
+  exifOriginal, err := ioutil.ReadFile(testDir + "/sub/exif.jpg")
+  if err != nil {
+    t.Fatalf("Unable to read test image: %v", err)
+  }
+  b, _, err, _ = h.ImageBytes("sub/exif.jpg", 0, 0, 0, ImageOptions{Format: ImageFormatOriginal})
+  if err != nil {
+    t.Fatalf("ImageBytes of image with EXIF orientation failed: %v", err)
+  }
+  if bytes.Equal(b, exifOriginal) {
+    t.Errorf("ImageBytes of image with overridden EXIF orientation returned the original")
+  }
+  if cfg, _, err := image.DecodeConfig(bytes.NewReader(b)); err != nil || cfg.Width != 20 || cfg.Height != 10 {
+    t.Errorf("ImageBytes of image with overridden EXIF orientation: got %dx%d (%v), want 20x10", cfg.Width, cfg.Height, err)
+  }
+
+  badOptions := []ImageOptions{
+    {Format: "webp"},
+    {Quality: 101},
+    {Quality: -1},
+  }
+  for _, options := range badOptions {
+    if _, _, err, status := h.ImageBytes("img.jpg", 0, 0, 0, options); err == nil || status != http.StatusBadRequest {
+      t.Errorf("ImageBytes(%+v): got status %d, want %d", options, status, http.StatusBadRequest)
+    }
+  }
+}
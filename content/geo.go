@@ -0,0 +1,111 @@
+package content
+
+import (
+  "fmt"
+  "net/http"
+  "os"
+  "path"
+  "sort"
+  "strconv"
+  "strings"
+  "time"
+)
+
+// BoundingBox is an area on the map. If MinLon is greater than MaxLon,
+// the box crosses the 180 degree meridian.
+type BoundingBox struct {
+  MinLat float64
+  MinLon float64
+  MaxLat float64
+  MaxLon float64
+}
+
+// GeoItem is an image that has GPS coordinates.
+type GeoItem struct {
+  Name string
+  Path string           // Full API path to the image
+  Latitude float64
+  Longitude float64
+  Altitude float64
+  ExifDateTime time.Time
+}
+
+type GeoResult struct {
+  Items []GeoItem
+}
+
+// ParseBoundingBox parses a string of the form "minlat,minlon,maxlat,maxlon".
+func ParseBoundingBox(s string) (*BoundingBox, error) {
+  fields := strings.Split(s, ",")
+  if len(fields) != 4 {
+    return nil, fmt.Errorf("bounding box must be minlat,minlon,maxlat,maxlon")
+  }
+  v := make([]float64, 4)
+  for i, field := range fields {
+    f, err := strconv.ParseFloat(strings.TrimSpace(field), 64)
+    if err != nil {
+      return nil, fmt.Errorf("bad number %q in bounding box", field)
+    }
+    v[i] = f
+  }
+  b := &BoundingBox{
+    MinLat: v[0],
+    MinLon: v[1],
+    MaxLat: v[2],
+    MaxLon: v[3],
+  }
+  if b.MinLat > b.MaxLat {
+    return nil, fmt.Errorf("minimum latitude is greater than maximum latitude in bounding box")
+  }
+  if b.MinLat < -90 || b.MaxLat > 90 || b.MinLon < -180 || b.MaxLon > 180 {
+    return nil, fmt.Errorf("bounding box is out of range")
+  }
+  return b, nil
+}
+
+func (b *BoundingBox) contains(lat, lon float64) bool {
+  if lat < b.MinLat || lat > b.MaxLat {
+    return false
+  }
+  if b.MinLon <= b.MaxLon {
+    return lon >= b.MinLon && lon <= b.MaxLon
+  }
+  return lon >= b.MinLon || lon <= b.MaxLon
+}
+
+// Geo returns all of the images under the specified directory (or the
+// whole content tree if the directory is empty) that have GPS coordinates
+// within the bounding box. If the bounding box is nil, all images with
+// GPS coordinates are returned.
+func (h *Handler) Geo(dirApiPath string, bbox *BoundingBox) (*GeoResult, error, int) {
+  dirApiPath = cleanApiPath(dirApiPath)
+  dirPath := path.Join(h.config.ContentRoot, dirApiPath)
+  if f, err := os.Stat(dirPath); err != nil || !f.IsDir() {
+    return nil, fmt.Errorf("directory %s not found", dirApiPath), http.StatusNotFound
+  }
+
+  items := make([]GeoItem, 0)
+  for _, r := range h.catalogRecords() {
+    if !r.HasGPS {
+      continue
+    }
+    if dirApiPath != "" && !strings.HasPrefix(r.ApiPath, dirApiPath + "/") {
+      continue
+    }
+    if bbox != nil && !bbox.contains(r.Latitude, r.Longitude) {
+      continue
+    }
+    items = append(items, GeoItem{
+      Name: path.Base(r.ApiPath),
+      Path: "/" + r.ApiPath,
+      Latitude: r.Latitude,
+      Longitude: r.Longitude,
+      Altitude: r.Altitude,
+      ExifDateTime: r.ExifDateTime,
+    })
+  }
+  sort.Slice(items, func(i, j int) bool { return items[i].Path < items[j].Path })
+  return &GeoResult{
+    Items: items,
+  }, nil, 0
+}
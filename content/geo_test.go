@@ -0,0 +1,89 @@
+package content
+
+import (
+  "os"
+  "testing"
+)
+
+func TestGeo(t *testing.T) {
+  testDir := "testdata/tmp"
+  os.RemoveAll(testDir)
+  for _, d := range []string{"a", "b"} {
+    if err := os.MkdirAll(testDir + "/" + d, 0744); err != nil {
+      t.Fatalf("Unable to create test directory: %v", err)
+    }
+  }
+  defer os.RemoveAll(testDir)
+  // GPS is 37.5N 122.25W.
+  if err := writeTestJpegWithExif(testDir + "/a/exif.jpg", 8, 8, sampleTestExif()); err != nil {
+    t.Fatalf("Unable to create test image: %v", err)
+  }
+  if err := writeTestJpeg(testDir + "/b/noexif.jpg", 8, 8); err != nil {
+    t.Fatalf("Unable to create test image: %v", err)
+  }
+
+  h := NewHandler(&Config{
+    ContentRoot: testDir,
+  });
+
+  testCases := []struct{
+    name string
+    dir string
+    bbox string
+    wantCount int
+  }{
+    { "all", "", "", 1 },
+    { "in dir", "a", "", 1 },
+    { "other dir", "b", "", 0 },
+    { "inside box", "", "37,-123,38,-122", 1 },
+    { "outside box", "", "30,-123,31,-122", 0 },
+    { "across 180", "", "37,170,38,-120", 1 },
+  }
+  for _, test := range testCases {
+    t.Run(test.name, func(t *testing.T) {
+      var bbox *BoundingBox
+      if test.bbox != "" {
+        var err error
+        bbox, err = ParseBoundingBox(test.bbox)
+        if err != nil {
+          t.Fatalf("failed to parse bounding box: %v", err)
+        }
+      }
+      result, err, _ := h.Geo(test.dir, bbox)
+      if err != nil {
+        t.Fatalf("Geo failed: %v", err)
+      }
+      if got, want := len(result.Items), test.wantCount; got != want {
+        t.Fatalf("item count: got %d, want %d", got, want)
+      }
+      if test.wantCount > 0 {
+        if got, want := result.Items[0].Path, "/a/exif.jpg"; got != want {
+          t.Errorf("item path: got %s, want %s", got, want)
+        }
+        if got, want := result.Items[0].Latitude, 37.5; got != want {
+          t.Errorf("item latitude: got %v, want %v", got, want)
+        }
+      }
+    })
+  }
+
+  _, err, _ := h.Geo("no-such-dir", nil)
+  if err == nil {
+    t.Errorf("Geo on non-existent directory should fail")
+  }
+}
+
+func TestParseBoundingBox(t *testing.T) {
+  for _, s := range []string{"", "1,2,3", "a,b,c,d", "10,0,5,1", "-91,0,0,1", "0,0,1,181"} {
+    if _, err := ParseBoundingBox(s); err == nil {
+      t.Errorf("ParseBoundingBox(%q) should fail", s)
+    }
+  }
+  b, err := ParseBoundingBox("1.5, -2, 3, 4.25")
+  if err != nil {
+    t.Fatalf("ParseBoundingBox failed: %v", err)
+  }
+  if got, want := *b, (BoundingBox{1.5, -2, 3, 4.25}); got != want {
+    t.Errorf("ParseBoundingBox: got %v, want %v", got, want)
+  }
+}
@@ -0,0 +1,188 @@
+package content
+
+import (
+  "bufio"
+  "fmt"
+  "image"
+  "image/color"
+  "image/color/palette"
+  "image/draw"
+  "image/gif"
+  "io"
+  "net/http"
+  "os"
+)
+
+// animatedGif returns the animated GIF in the file with each of its frames
+// cropped, resized, adjusted and rotated as Image does for a single image.
+func (h *Handler) animatedGif(path string, width, height, rot int, options ImageOptions) (*gif.GIF, error, int) {
+  imageFilePath := fmt.Sprintf("%s/%s", h.config.ContentRoot, path)
+  f, err := os.Open(imageFilePath)
+  if err != nil {
+    return nil, fmt.Errorf("failed to open file: %v", err), http.StatusNotFound
+  }
+  defer f.Close()
+  g, err := gif.DecodeAll(f)
+  if err != nil {
+    return nil, fmt.Errorf("failed to decode GIF file: %v", err), http.StatusBadRequest
+  }
+
+  // GIF files don't have EXIF data, so there is no EXIF rotation.
+  t := h.imageTransformFor(imageFilePath, 0, rot, options)
+  // Each output frame is a whole composited frame, which can include
+  // pixels from earlier frames, so we can't use the frame's own palette.
+  p := gifPalette(g)
+  if p == nil || (t.entry != nil && hasAdjustments(t.entry)) {
+    p = append(color.Palette{color.Transparent}, palette.WebSafe...)
+  }
+  out := &gif.GIF{
+    LoopCount: g.LoopCount,
+  }
+  gifFrames(g, func(i int, frame image.Image) {
+    out.Image = append(out.Image, palettedImage(t.apply(frame, width, height), p))
+    out.Delay = append(out.Delay, g.Delay[i])
+    // Each frame is complete, so clear it before drawing the next one
+    // rather than letting it show through transparent pixels.
+    out.Disposal = append(out.Disposal, gif.DisposalBackground)
+  })
+  return out, nil, 0
+}
+
+// gifPalette returns the global palette of the GIF with a transparent
+// color, for the areas that no frame has drawn, or nil if there is no
+// global palette or no room in it for a transparent color.
+func gifPalette(g *gif.GIF) color.Palette {
+  p, ok := g.Config.ColorModel.(color.Palette)
+  if !ok || len(p) == 0 {
+    return nil
+  }
+  for _, c := range p {
+    if _, _, _, a := c.RGBA(); a == 0 {
+      return p
+    }
+  }
+  if len(p) >= 256 {
+    return nil
+  }
+  return append(append(color.Palette{}, p...), color.Transparent)
+}
+
+// gifFrames calls f with each frame of the GIF as it is displayed. Each
+// frame in the file can cover only part of the image and is drawn over what
+// is left from the previous frames, depending on the previous disposal
+// method. We reuse the image we pass to f, so f must not keep it.
+func gifFrames(g *gif.GIF, f func(i int, frame image.Image)) {
+  canvas := image.NewNRGBA(image.Rect(0, 0, g.Config.Width, g.Config.Height))
+  var previous *image.NRGBA     // Only allocated if we need it
+  for i, frame := range g.Image {
+    disposal := byte(0)
+    if i < len(g.Disposal) {
+      disposal = g.Disposal[i]
+    }
+    if disposal == gif.DisposalPrevious {
+      if previous == nil {
+        previous = image.NewNRGBA(canvas.Bounds())
+      }
+      copy(previous.Pix, canvas.Pix)
+    }
+    draw.Draw(canvas, frame.Bounds(), frame, frame.Bounds().Min, draw.Over)
+    f(i, canvas)
+    switch disposal {
+    case gif.DisposalBackground:
+      draw.Draw(canvas, frame.Bounds(), image.Transparent, image.Point{}, draw.Src)
+    case gif.DisposalPrevious:
+      copy(canvas.Pix, previous.Pix)
+    }
+  }
+}
+
+// palettedImage converts the image to use the palette, with dithering.
+func palettedImage(im image.Image, p color.Palette) *image.Paletted {
+  b := im.Bounds()
+  pm := image.NewPaletted(image.Rect(0, 0, b.Dx(), b.Dy()), p)
+  draw.FloydSteinberg.Draw(pm, pm.Bounds(), im, b.Min)
+  return pm
+}
+
+// gifFrameCount returns the number of frames in the GIF data, counting
+// no further than max. We read the block structure of the file without
+// decoding the images, so this is much faster than gif.DecodeAll.
+func gifFrameCount(r io.Reader, max int) (int, error) {
+  br := bufio.NewReader(r)
+  header := make([]byte, 13)    // Signature, version and logical screen descriptor
+  if _, err := io.ReadFull(br, header); err != nil {
+    return 0, err
+  }
+  if string(header[:3]) != "GIF" {
+    return 0, fmt.Errorf("not a GIF file")
+  }
+  if header[10] & 0x80 != 0 {
+    if _, err := br.Discard(3 << (header[10] & 0x07 + 1)); err != nil {   // Global color table
+      return 0, err
+    }
+  }
+  frames := 0
+  for frames < max {
+    b, err := br.ReadByte()
+    if err != nil {
+      return frames, err
+    }
+    switch b {
+    case 0x21:          // Extension: label, then sub-blocks
+      if _, err := br.ReadByte(); err != nil {
+        return frames, err
+      }
+      if err := skipGifSubBlocks(br); err != nil {
+        return frames, err
+      }
+    case 0x2C:          // Image descriptor, then color table and image data
+      desc := make([]byte, 9)
+      if _, err := io.ReadFull(br, desc); err != nil {
+        return frames, err
+      }
+      if desc[8] & 0x80 != 0 {
+        if _, err := br.Discard(3 << (desc[8] & 0x07 + 1)); err != nil {
+          return frames, err
+        }
+      }
+      if _, err := br.ReadByte(); err != nil {  // LZW minimum code size
+        return frames, err
+      }
+      if err := skipGifSubBlocks(br); err != nil {
+        return frames, err
+      }
+      frames++
+    case 0x3B:          // Trailer
+      return frames, nil
+    default:
+      return frames, fmt.Errorf("bad GIF block type %#x", b)
+    }
+  }
+  return frames, nil
+}
+
+func skipGifSubBlocks(br *bufio.Reader) error {
+  for {
+    size, err := br.ReadByte()
+    if err != nil {
+      return err
+    }
+    if size == 0 {
+      return nil
+    }
+    if _, err := br.Discard(int(size)); err != nil {
+      return err
+    }
+  }
+}
+
+// isAnimatedGif returns true if the file is a GIF with more than one frame.
+func isAnimatedGif(filePath string) bool {
+  f, err := os.Open(filePath)
+  if err != nil {
+    return false
+  }
+  defer f.Close()
+  n, _ := gifFrameCount(f, 2)
+  return n > 1
+}
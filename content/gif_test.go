@@ -0,0 +1,186 @@
+package content
+
+import (
+  "bytes"
+  "image"
+  "image/color"
+  "image/gif"
+  "os"
+  "testing"
+)
+
+func TestAnimatedGif(t *testing.T) {
+  testDir := "testdata/tmp"
+  os.RemoveAll(testDir)
+  if err := os.MkdirAll(testDir, 0744); err != nil {
+    t.Fatalf("Unable to create test directory: %v", err)
+  }
+  defer os.RemoveAll(testDir)
+
+  p := color.Palette{color.Transparent, color.NRGBA{255, 0, 0, 255}, color.NRGBA{0, 0, 255, 255}}
+  full := image.NewPaletted(image.Rect(0, 0, 40, 20), p)
+  for i := range full.Pix {
+    full.Pix[i] = 1     // All red
+  }
+  // The second frame is blue on the left and transparent on the right,
+  // and the third only covers the left half.
+  clearRight := image.NewPaletted(image.Rect(0, 0, 40, 20), p)
+  for y := 0; y < 20; y++ {
+    for x := 0; x < 20; x++ {
+      clearRight.SetColorIndex(x, y, 2)
+    }
+  }
+  half := image.NewPaletted(image.Rect(0, 0, 20, 20), p)
+  for i := range half.Pix {
+    half.Pix[i] = 2     // Blue
+  }
+  animated := &gif.GIF{
+    Image: []*image.Paletted{full, clearRight, half},
+    Delay: []int{10, 20, 30},
+    Disposal: []byte{gif.DisposalNone, gif.DisposalBackground, gif.DisposalNone},
+    LoopCount: 0,
+  }
+  writeGif := func(name string, g *gif.GIF) {
+    f, err := os.Create(testDir + "/" + name)
+    if err != nil {
+      t.Fatalf("Unable to create test image: %v", err)
+    }
+    defer f.Close()
+    if err := gif.EncodeAll(f, g); err != nil {
+      t.Fatalf("Unable to write test image: %v", err)
+    }
+  }
+  writeGif("anim.gif", animated)
+  writeGif("still.gif", &gif.GIF{Image: []*image.Paletted{full}, Delay: []int{0}})
+
+  f, err := os.Open(testDir + "/anim.gif")
+  if err != nil {
+    t.Fatalf("Unable to open test image: %v", err)
+  }
+  n, err := gifFrameCount(f, 10)
+  f.Close()
+  if err != nil || n != 3 {
+    t.Errorf("gifFrameCount: got %d, %v, want 3 frames", n, err)
+  }
+
+  h := NewHandler(&Config{
+    ContentRoot: testDir,
+  });
+  list, err, _ := h.List("", ListOptions{})
+  if err != nil {
+    t.Fatalf("List failed: %v", err)
+  }
+  for _, item := range list.Items {
+    if got, want := item.Animated, item.Name == "anim.gif"; got != want {
+      t.Errorf("List %s Animated: got %v, want %v", item.Name, got, want)
+    }
+  }
+
+  // Rotated counterclockwise and fit into 10x10, the frames are 5x10.
+  if err, _ := h.UpdateImageIndex("index.mpr", UpdateCommand{Item: "anim.gif", Action: "deltarotation", Value: "+r", Autocreate: true}); err != nil {
+    t.Fatalf("failed to rotate image: %v", err)
+  }
+  b, contentType, err, _ := h.ImageBytes("anim.gif", 10, 10, 0, ImageOptions{})
+  if err != nil {
+    t.Fatalf("ImageBytes(anim.gif) failed: %v", err)
+  }
+  if got, want := contentType, "image/gif"; got != want {
+    t.Errorf("ImageBytes(anim.gif) content type: got %s, want %s", got, want)
+  }
+  g, err := gif.DecodeAll(bytes.NewReader(b))
+  if err != nil {
+    t.Fatalf("ImageBytes(anim.gif) result does not decode: %v", err)
+  }
+  if got, want := len(g.Image), 3; got != want {
+    t.Fatalf("ImageBytes(anim.gif) frames: got %d, want %d", got, want)
+  }
+  red := color.NRGBA{255, 0, 0, 255}
+  blue := color.NRGBA{0, 0, 255, 255}
+  clear := color.NRGBA{0, 0, 0, 0}
+  // After rotating, the left half of the original is at the bottom.
+  wantColors := []struct{ top, bottom color.NRGBA }{
+    { red, red },
+    { red, blue },
+    { clear, blue },    // The second frame was cleared to the background.
+  }
+  for i, frame := range g.Image {
+    fb := frame.Bounds()
+    if fb.Dx() != 5 || fb.Dy() != 10 {
+      t.Errorf("frame %d size: got %dx%d, want 5x10", i, fb.Dx(), fb.Dy())
+      continue
+    }
+    top := color.NRGBAModel.Convert(frame.At(2, 1)).(color.NRGBA)
+    bottom := color.NRGBAModel.Convert(frame.At(2, 8)).(color.NRGBA)
+    if top != wantColors[i].top || bottom != wantColors[i].bottom {
+      t.Errorf("frame %d colors: got %v and %v, want %v and %v", i, top, bottom, wantColors[i].top, wantColors[i].bottom)
+    }
+    if got, want := g.Delay[i], animated.Delay[i]; got != want {
+      t.Errorf("frame %d delay: got %d, want %d", i, got, want)
+    }
+  }
+
+  _, contentType, err, _ = h.ImageBytes("still.gif", 10, 10, 0, ImageOptions{})
+  if err != nil {
+    t.Fatalf("ImageBytes(still.gif) failed: %v", err)
+  }
+  if got, want := contentType, "image/png"; got != want {
+    t.Errorf("ImageBytes(still.gif) content type: got %s, want %s", got, want)
+  }
+  _, contentType, err, _ = h.ImageBytes("anim.gif", 10, 10, 0, ImageOptions{Format: ImageFormatJpeg})
+  if err != nil {
+    t.Fatalf("ImageBytes(anim.gif) as JPEG failed: %v", err)
+  }
+  if got, want := contentType, "image/jpeg"; got != want {
+    t.Errorf("ImageBytes(anim.gif) as JPEG content type: got %s, want %s", got, want)
+  }
+}
+
+func TestAnimatedGifLocalPalette(t *testing.T) {
+  testDir := "testdata/tmp"
+  os.RemoveAll(testDir)
+  if err := os.MkdirAll(testDir, 0744); err != nil {
+    t.Fatalf("Unable to create test directory: %v", err)
+  }
+  defer os.RemoveAll(testDir)
+
+  red := color.NRGBA{255, 0, 0, 255}
+  green := color.NRGBA{0, 255, 0, 255}
+  // The second frame only covers the left half, and its own palette
+  // has no red, which still shows on the right.
+  full := image.NewPaletted(image.Rect(0, 0, 40, 20), color.Palette{red, green})
+  half := image.NewPaletted(image.Rect(0, 0, 20, 20), color.Palette{green})
+  animated := &gif.GIF{
+    Image: []*image.Paletted{full, half},
+    Delay: []int{10, 10},
+    Config: image.Config{ColorModel: color.Palette{red, green}, Width: 40, Height: 20},
+  }
+  f, err := os.Create(testDir + "/anim.gif")
+  if err != nil {
+    t.Fatalf("Unable to create test image: %v", err)
+  }
+  err = gif.EncodeAll(f, animated)
+  f.Close()
+  if err != nil {
+    t.Fatalf("Unable to write test image: %v", err)
+  }
+
+  h := NewHandler(&Config{
+    ContentRoot: testDir,
+  });
+  b, _, err, _ := h.ImageBytes("anim.gif", 20, 20, 0, ImageOptions{})
+  if err != nil {
+    t.Fatalf("ImageBytes(anim.gif) failed: %v", err)
+  }
+  g, err := gif.DecodeAll(bytes.NewReader(b))
+  if err != nil {
+    t.Fatalf("ImageBytes(anim.gif) result does not decode: %v", err)
+  }
+  if got, want := len(g.Image), 2; got != want {
+    t.Fatalf("ImageBytes(anim.gif) frames: got %d, want %d", got, want)
+  }
+  left := color.NRGBAModel.Convert(g.Image[1].At(2, 5)).(color.NRGBA)
+  right := color.NRGBAModel.Convert(g.Image[1].At(17, 5)).(color.NRGBA)
+  if left != green || right != red {
+    t.Errorf("second frame colors: got %v and %v, want %v and %v", left, right, green, red)
+  }
+}
@@ -0,0 +1,326 @@
+package content
+
+import (
+  "bufio"
+  "fmt"
+  "io"
+  "io/ioutil"
+  "log"
+  "net/http"
+  "os"
+  "os/exec"
+  "path/filepath"
+  "strconv"
+  "strings"
+  "sync"
+)
+
+const (
+  // HlsPlaylistName is the name of the master playlist for a video,
+  // which lists the playlists for each of the variants.
+  HlsPlaylistName = "playlist.m3u8"
+  hlsVariantPlaylistName = "index.m3u8"
+  hlsDirExtension = ".hls"
+  hlsSegmentSeconds = 6
+
+  // States for HlsStatus, in addition to JobStateQueued,
+  // JobStateRunning and JobStateFailed while there is a job for it.
+  HlsStateReady = "ready"
+)
+
+// hlsVariant describes one of the bitrates at which we segment videos.
+type hlsVariant struct {
+  name string            // Subdirectory for the variant's playlist and segments
+  height int             // Maximum frame height; smaller videos are not scaled up
+  videoBitrate int       // kbits per second
+  audioBitrate int       // kbits per second
+}
+
+var hlsVariants = []hlsVariant{
+  { "360p", 360, 800, 96 },
+  { "720p", 720, 2800, 128 },
+}
+
+// HlsStatus tells the client whether the HLS playlist for a video is
+// ready to play, and if not, how far along we are in creating it.
+type HlsStatus struct {
+  State string          // HlsStateReady or the state of the job creating it
+  Progress float64      // From 0 to 1
+  Error string          // Why segmentation failed
+}
+
+// Hls returns the status of the HLS playlist for the video. If the
+// playlist has not yet been created, it queues a job to create it in the
+// background; call Hls again to follow its progress.
+func (h *Handler) Hls(path string) (*HlsStatus, error, int) {
+  if !h.isVideoFile(path) {
+    return nil, fmt.Errorf("not a video file: %s", path), http.StatusBadRequest
+  }
+  videoFilePath := fmt.Sprintf("%s/%s", h.config.ContentRoot, path)
+  if _, err := os.Stat(videoFilePath); err != nil {
+    return nil, fmt.Errorf("failed to stat file: %v", err), http.StatusNotFound
+  }
+  job := h.startHls(path)
+  if job == nil {
+    return &HlsStatus{State: HlsStateReady, Progress: 1}, nil, 0
+  }
+  return &HlsStatus{
+    State: job.State,
+    Progress: job.Progress,
+    Error: job.Error,
+  }, nil, 0
+}
+
+// startHls queues a job to segment the video if its playlist is not
+// ready, and returns a copy of the job, or nil if the playlist is ready.
+func (h *Handler) startHls(path string) *Job {
+  hlsDir := h.hlsDirInCache(path)
+  // The job renames the directory before it finishes, so we check for
+  // the job first to report that it is done only after it is.
+  if job := h.jobs.status(hlsDir); job != nil {
+    return job
+  }
+  if _, err := os.Stat(filepath.Join(hlsDir, HlsPlaylistName)); err == nil {
+    return nil
+  }
+  videoFilePath := fmt.Sprintf("%s/%s", h.config.ContentRoot, path)
+  job := h.jobs.submit(JobKindHls, path, hlsDir, func(progress func(float64)) error {
+    return segmentVideo(videoFilePath, hlsDir, progress)
+  })
+  return h.jobs.snapshot(job)
+}
+
+// HlsFilePath returns the path on disk to a file in the HLS cache
+// directory for the video, such as HlsPlaylistName. The playlist must
+// be ready, as reported by Hls.
+func (h *Handler) HlsFilePath(path, name string) (string, error, int) {
+  if name == "" || name != cleanApiPath(name) || strings.HasPrefix(name, "..") {
+    return "", fmt.Errorf("bad HLS file name: %s", name), http.StatusBadRequest
+  }
+  filePath := filepath.Join(h.hlsDirInCache(path), filepath.FromSlash(name))
+  if _, err := os.Stat(filePath); err != nil {
+    return "", fmt.Errorf("failed to stat file: %v", err), http.StatusNotFound
+  }
+  return filePath, nil, 0
+}
+
+// SplitHlsPath splits an api path such as "dir/video.mts/360p/index.m3u8"
+// into the path to the video and the name of the file in its HLS cache
+// directory. A directory can have a video extension, so we split after the
+// first part with a video extension that is a file, or, if there is none,
+// after the last part with a video extension. If the path does not contain
+// a video, the video path is empty.
+func (h *Handler) SplitHlsPath(apiPath string) (string, string) {
+  parts := strings.Split(strings.Trim(apiPath, "/"), "/")
+  split := -1
+  for i, part := range parts {
+    if !h.isVideoFile(part) {
+      continue
+    }
+    split = i
+    filePath := fmt.Sprintf("%s/%s", h.config.ContentRoot, strings.Join(parts[:i+1], "/"))
+    if f, err := os.Stat(filePath); err == nil && f.Mode().IsRegular() {
+      break
+    }
+  }
+  if split < 0 {
+    return "", ""
+  }
+  return strings.Join(parts[:split+1], "/"), strings.Join(parts[split+1:], "/")
+}
+
+// hlsDirInCache returns the directory in which we put the HLS playlists
+// and segments for the video. We keep the extension in the name so that
+// videos that differ only by their extensions don't collide.
+func (h *Handler) hlsDirInCache(path string) string {
+  inputFilePath := fmt.Sprintf("%s/%s", h.config.ContentRoot, path)
+  dir, filename := filepath.Split(inputFilePath)
+  return dir + cacheDir + filename + hlsDirExtension
+}
+
+// removeHlsCache removes the HLS playlists and segments for the video,
+// so that we create them again the next time they are requested.
+func (h *Handler) removeHlsCache(path string) {
+  hlsDir := h.hlsDirInCache(path)
+  os.RemoveAll(hlsDir)
+  h.jobs.forget(hlsDir)
+}
+
+// segmentVideo creates the playlists and segments for each of our variants.
+// We write them all in a temporary directory, then rename that to hlsDir,
+// so that we never serve a partial playlist.
+func segmentVideo(videoFilePath, hlsDir string, progress func(float64)) error {
+  tmpDir := hlsDir + ".tmp"
+  if err := os.RemoveAll(tmpDir); err != nil {       // Left over from a crash
+    return err
+  }
+  if err := os.MkdirAll(tmpDir, 0700); err != nil {
+    return err
+  }
+  for i, v := range hlsVariants {
+    variantDir := filepath.Join(tmpDir, v.name)
+    if err := os.Mkdir(variantDir, 0700); err != nil {
+      os.RemoveAll(tmpDir)
+      return err
+    }
+    log.Printf("Segmenting video file %s at %dkbps", videoFilePath, v.videoBitrate)
+    variantProgress := func(p float64) {
+      progress((float64(i) + p) / float64(len(hlsVariants)))
+    }
+    if err := runFfmpegWithProgress(hlsVariantArgs(videoFilePath, variantDir, v), variantProgress); err != nil {
+      os.RemoveAll(tmpDir)
+      return err
+    }
+  }
+  if err := ioutil.WriteFile(filepath.Join(tmpDir, HlsPlaylistName), []byte(hlsMasterPlaylist()), 0600); err != nil {
+    os.RemoveAll(tmpDir)
+    return err
+  }
+  os.RemoveAll(hlsDir)
+  if err := os.Rename(tmpDir, hlsDir); err != nil {
+    os.RemoveAll(tmpDir)
+    return err
+  }
+  log.Printf("Done segmenting video file %s", videoFilePath)
+  return nil
+}
+
+// hlsVariantArgs returns the ffmpeg arguments to write the playlist and
+// segments for one variant of the video. We put a key frame at the start
+// of every segment so that players can switch between variants.
+func hlsVariantArgs(videoFilePath, variantDir string, v hlsVariant) []string {
+  return []string{
+      "-y",
+      "-i", videoFilePath,
+      "-vf", fmt.Sprintf("scale=-2:'min(%d,trunc(ih/2)*2)'", v.height),
+      "-c:v", "libx264",
+      "-preset", "veryfast",
+      "-b:v", fmt.Sprintf("%dk", v.videoBitrate),
+      "-maxrate", fmt.Sprintf("%dk", v.videoBitrate * 107 / 100),
+      "-bufsize", fmt.Sprintf("%dk", v.videoBitrate * 3 / 2),
+      "-force_key_frames", fmt.Sprintf("expr:gte(t,n_forced*%d)", hlsSegmentSeconds),
+      "-c:a", "aac",
+      "-b:a", fmt.Sprintf("%dk", v.audioBitrate),
+      "-ac", "2",
+      "-f", "hls",
+      "-hls_time", strconv.Itoa(hlsSegmentSeconds),
+      "-hls_playlist_type", "vod",
+      "-hls_segment_filename", filepath.Join(variantDir, "seg%05d.ts"),
+      filepath.Join(variantDir, hlsVariantPlaylistName),
+  }
+}
+
+// hlsMasterPlaylist returns the playlist that lists our variants.
+func hlsMasterPlaylist() string {
+  var b strings.Builder
+  b.WriteString("#EXTM3U\n")
+  for _, v := range hlsVariants {
+    fmt.Fprintf(&b, "#EXT-X-STREAM-INF:BANDWIDTH=%d\n", (v.videoBitrate + v.audioBitrate) * 1000)
+    fmt.Fprintf(&b, "%s/%s\n", v.name, hlsVariantPlaylistName)
+  }
+  return b.String()
+}
+
+// runFfmpegWithProgress runs ffmpeg with the arguments, calling progress
+// with the fraction of the input it has processed as it goes along.
+// We get the duration of the input from the log ffmpeg writes to stderr,
+// and the position in the input from its -progress output.
+func runFfmpegWithProgress(args []string, progress func(float64)) error {
+  args = append([]string{"-nostats", "-progress", "pipe:1"}, args...)
+  cmd := exec.Command(ffmpegCommand, args...)
+  stdout, err := cmd.StdoutPipe()
+  if err != nil {
+    return err
+  }
+  stderr, err := cmd.StderrPipe()
+  if err != nil {
+    return err
+  }
+  if err := cmd.Start(); err != nil {
+    return fmt.Errorf("failed to start ffmpeg: %v", err)
+  }
+
+  var mu sync.Mutex
+  duration := 0.0
+  lastLines := make([]string, 0, 5)     // From stderr, to explain a failure
+  var wg sync.WaitGroup
+  wg.Add(2)
+  go func() {
+    defer wg.Done()
+    scanner := bufio.NewScanner(stderr)
+    for scanner.Scan() {
+      line := strings.TrimSpace(scanner.Text())
+      mu.Lock()
+      if d, ok := ffmpegDuration(line); ok && duration == 0 {
+        duration = d
+      }
+      if len(lastLines) == cap(lastLines) {
+        lastLines = append(lastLines[:0], lastLines[1:]...)
+      }
+      lastLines = append(lastLines, line)
+      mu.Unlock()
+    }
+    io.Copy(ioutil.Discard, stderr)
+  }()
+  go func() {
+    defer wg.Done()
+    scanner := bufio.NewScanner(stdout)
+    for scanner.Scan() {
+      value := strings.TrimPrefix(scanner.Text(), "out_time=")
+      if value == scanner.Text() {
+        continue
+      }
+      t, ok := parseFfmpegTime(value)
+      mu.Lock()
+      d := duration
+      mu.Unlock()
+      if ok && d > 0 {
+        progress(minFloat(t / d, 1))
+      }
+    }
+    io.Copy(ioutil.Discard, stdout)
+  }()
+  wg.Wait()
+  if err := cmd.Wait(); err != nil {
+    return fmt.Errorf("ffmpeg failed: %v: %s", err, strings.Join(lastLines, "; "))
+  }
+  progress(1)
+  return nil
+}
+
+// ffmpegDuration returns the duration in seconds from an ffmpeg log line
+// such as "Duration: 00:01:02.50, start: 0.000000, bitrate: 1234 kb/s".
+func ffmpegDuration(line string) (float64, bool) {
+  if !strings.HasPrefix(line, "Duration: ") {
+    return 0, false
+  }
+  value := strings.TrimPrefix(line, "Duration: ")
+  if i := strings.Index(value, ","); i >= 0 {
+    value = value[:i]
+  }
+  return parseFfmpegTime(value)
+}
+
+// parseFfmpegTime parses a time in the form HH:MM:SS.frac into seconds.
+func parseFfmpegTime(value string) (float64, bool) {
+  parts := strings.Split(strings.TrimSpace(value), ":")
+  if len(parts) != 3 {
+    return 0, false
+  }
+  seconds := 0.0
+  for _, part := range parts {
+    n, err := strconv.ParseFloat(part, 64)
+    if err != nil || n < 0 {
+      return 0, false
+    }
+    seconds = seconds * 60 + n
+  }
+  return seconds, true
+}
+
+func minFloat(a, b float64) float64 {
+  if a < b {
+    return a
+  }
+  return b
+}
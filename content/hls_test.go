@@ -0,0 +1,163 @@
+package content
+
+import (
+  "io/ioutil"
+  "net/http"
+  "os"
+  "path/filepath"
+  "strings"
+  "testing"
+  "time"
+)
+
+func TestParseFfmpegTime(t *testing.T) {
+  testCases := []struct{
+    line string
+    want float64
+    ok bool
+  }{
+    { "Duration: 00:01:02.50, start: 0.000000, bitrate: 1234 kb/s", 62.5, true },
+    { "Duration: 01:00:00.00", 3600, true },
+    { "Duration: N/A, bitrate: N/A", 0, false },
+    { "Stream #0:0: Video: h264", 0, false },
+  }
+  for _, tc := range testCases {
+    got, ok := ffmpegDuration(tc.line)
+    if got != tc.want || ok != tc.ok {
+      t.Errorf("ffmpegDuration(%q): got %v, %v, want %v, %v", tc.line, got, ok, tc.want, tc.ok)
+    }
+  }
+}
+
+func TestSplitHlsPath(t *testing.T) {
+  testDir := "testdata/tmp"
+  os.RemoveAll(testDir)
+  if err := os.MkdirAll(testDir + "/trip.mp4", 0744); err != nil {
+    t.Fatalf("Unable to create test directory: %v", err)
+  }
+  defer os.RemoveAll(testDir)
+  if err := ioutil.WriteFile(testDir + "/trip.mp4/clip.mts", []byte("not really a video"), 0644); err != nil {
+    t.Fatalf("Unable to write test video: %v", err)
+  }
+
+  h := NewHandler(&Config{
+    ContentRoot: testDir,
+  });
+  testCases := []struct{
+    path string
+    wantVideo string
+    wantName string
+  }{
+    { "d1/clip.mts/playlist.m3u8", "d1/clip.mts", "playlist.m3u8" },
+    { "clip.MP4/360p/seg00001.ts", "clip.MP4", "360p/seg00001.ts" },
+    { "/d1/clip.mts", "d1/clip.mts", "" },
+    { "d1/image1.jpg/playlist.m3u8", "", "" },
+    // A directory with a video extension is not the video.
+    { "trip.mp4/clip.mts/playlist.m3u8", "trip.mp4/clip.mts", "playlist.m3u8" },
+    { "trip.mp4/other.mts/360p/index.m3u8", "trip.mp4/other.mts", "360p/index.m3u8" },
+  }
+  for _, tc := range testCases {
+    video, name := h.SplitHlsPath(tc.path)
+    if video != tc.wantVideo || name != tc.wantName {
+      t.Errorf("SplitHlsPath(%q): got %q, %q, want %q, %q", tc.path, video, name, tc.wantVideo, tc.wantName)
+    }
+  }
+}
+
+// waitForHls calls Hls until the job for the playlist has finished.
+func waitForHls(t *testing.T, h Handler, path string) *HlsStatus {
+  deadline := time.Now().Add(10 * time.Second)
+  for {
+    status, err, _ := h.Hls(path)
+    if err != nil {
+      t.Fatalf("Hls(%s) failed: %v", path, err)
+    }
+    if status.State != JobStateQueued && status.State != JobStateRunning {
+      return status
+    }
+    if time.Now().After(deadline) {
+      t.Fatalf("Hls(%s) still running at %v", path, status.Progress)
+    }
+    time.Sleep(10 * time.Millisecond)
+  }
+}
+
+func TestHls(t *testing.T) {
+  testDir := "testdata/tmp"
+  os.RemoveAll(testDir)
+  if err := os.MkdirAll(testDir, 0744); err != nil {
+    t.Fatalf("Unable to create test directory: %v", err)
+  }
+  defer os.RemoveAll(testDir)
+
+  for name, script := range map[string]string{"ffmpeg": fakeFfmpegScript, "badffmpeg": failingFfmpegScript} {
+    if err := ioutil.WriteFile(testDir + "/" + name, []byte(script), 0755); err != nil {
+      t.Fatalf("Unable to write test script: %v", err)
+    }
+  }
+  defer func(command string) { ffmpegCommand = command }(ffmpegCommand)
+  ffmpegCommand = testDir + "/ffmpeg"
+  if err := ioutil.WriteFile(testDir + "/clip.mts", []byte("not really a video"), 0644); err != nil {
+    t.Fatalf("Unable to write test video: %v", err)
+  }
+
+  h := NewHandler(&Config{
+    ContentRoot: testDir,
+  });
+  if _, err, status := h.Hls("nosuch.mts"); status != http.StatusNotFound {
+    t.Errorf("Hls of missing file: got status %d (%v), want %d", status, err, http.StatusNotFound)
+  }
+  if _, err, status := h.Hls("ffmpeg"); status != http.StatusBadRequest {
+    t.Errorf("Hls of non-video file: got status %d (%v), want %d", status, err, http.StatusBadRequest)
+  }
+
+  status := waitForHls(t, h, "clip.mts")
+  if status.State != HlsStateReady || status.Progress != 1 {
+    t.Fatalf("Hls(clip.mts): got %+v, want ready", status)
+  }
+  playlistPath, err, _ := h.HlsFilePath("clip.mts", HlsPlaylistName)
+  if err != nil {
+    t.Fatalf("HlsFilePath of playlist failed: %v", err)
+  }
+  b, err := ioutil.ReadFile(playlistPath)
+  if err != nil {
+    t.Fatalf("Unable to read playlist: %v", err)
+  }
+  for _, v := range hlsVariants {
+    if !strings.Contains(string(b), v.name + "/" + hlsVariantPlaylistName) {
+      t.Errorf("Playlist does not include variant %s: %s", v.name, b)
+    }
+    if _, err, _ := h.HlsFilePath("clip.mts", v.name + "/" + hlsVariantPlaylistName); err != nil {
+      t.Errorf("HlsFilePath of variant %s failed: %v", v.name, err)
+    }
+  }
+  if _, err := os.Stat(h.hlsDirInCache("clip.mts") + ".tmp"); !os.IsNotExist(err) {
+    t.Errorf("Temporary HLS directory was not removed: %v", err)
+  }
+  badNames := []string{"", "../clip.mts", "360p/../../clip.mts", "/etc/passwd", "360p/seg99999.ts"}
+  for _, name := range badNames {
+    if _, err, _ := h.HlsFilePath("clip.mts", name); err == nil {
+      t.Errorf("HlsFilePath(%q) should fail", name)
+    }
+  }
+
+  // When the video changes, we make the playlist again.
+  ffmpegCommand = testDir + "/badffmpeg"
+  h.fileChanged("clip.mts")
+  if _, err := os.Stat(filepath.Dir(playlistPath)); !os.IsNotExist(err) {
+    t.Errorf("HLS directory was not removed when the video changed: %v", err)
+  }
+  status = waitForHls(t, h, "clip.mts")
+  if status.State != JobStateFailed || !strings.Contains(status.Error, "Invalid data") {
+    t.Errorf("Hls with failing ffmpeg: got %+v, want failed", status)
+  }
+  // We don't keep trying a video that failed.
+  if status, _, _ := h.Hls("clip.mts"); status.State != JobStateFailed {
+    t.Errorf("Hls after failure: got %+v, want failed", status)
+  }
+  ffmpegCommand = testDir + "/ffmpeg"
+  h.fileChanged("clip.mts")
+  if status := waitForHls(t, h, "clip.mts"); status.State != HlsStateReady {
+    t.Errorf("Hls after the video changed: got %+v, want ready", status)
+  }
+}
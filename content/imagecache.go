@@ -0,0 +1,248 @@
+package content
+
+import (
+  "container/list"
+  "crypto/sha256"
+  "fmt"
+  "io/ioutil"
+  "log"
+  "os"
+  "path/filepath"
+  "sort"
+  "strings"
+  "sync"
+)
+
+const (
+  // Neutral, since renditions can be JPEG, PNG or GIF.
+  imageCacheExtension = ".img"
+  // What we used before we cached formats other than JPEG.
+  oldImageCacheExtension = ".jpg"
+  imageCacheTempPrefix = ".new-"
+)
+
+// imageCache is a size-limited on-disk cache of rendered images, so that we
+// don't have to decode and resize the original file every time a client
+// asks for a thumbnail. Each rendition is stored in a file whose name is
+// a hash of the source file's path, modification time and size plus the
+// rendering parameters, so a changed source file never matches an old entry.
+// All renditions of one source file are kept in one subdirectory, which
+// allows us to drop them all at once when we know the source has changed.
+// When the total size of the cache goes over maxBytes, we remove the
+// least recently used entries.
+type imageCache struct {
+  dir string
+  maxBytes int64
+
+  mu sync.Mutex
+  totalBytes int64
+  lru *list.List                  // Most recently used entry at the front.
+  entries map[string]*list.Element // Keyed by cache file path.
+}
+
+type imageCacheEntry struct {
+  path string
+  size int64
+}
+
+// newImageCache creates an image cache in dir, creating that directory if
+// necessary and loading the list of entries already in it.
+func newImageCache(dir string, maxBytes int64) (*imageCache, error) {
+  if err := os.MkdirAll(dir, 0700); err != nil {
+    return nil, fmt.Errorf("failed to create image cache directory %s: %v", dir, err)
+  }
+  c := &imageCache{
+    dir: dir,
+    maxBytes: maxBytes,
+    lru: list.New(),
+    entries: make(map[string]*list.Element),
+  }
+  c.load()
+  return c, nil
+}
+
+// load scans the cache directory and adds all the files there to our list,
+// using the file modification time as a stand-in for the last access time.
+func (c *imageCache) load() {
+  type cacheFile struct {
+    path string
+    info os.FileInfo
+  }
+  files := make([]cacheFile, 0)
+  filepath.Walk(c.dir, func(p string, f os.FileInfo, err error) error {
+    if err != nil {
+      return nil
+    }
+    if f.IsDir() {
+      return nil
+    }
+    if filepath.Ext(p) == oldImageCacheExtension || strings.HasPrefix(f.Name(), imageCacheTempPrefix) {
+      // An entry we can no longer find, or left over from a failed put.
+      os.Remove(p)
+      return nil
+    }
+    if filepath.Ext(p) != imageCacheExtension {
+      return nil
+    }
+    files = append(files, cacheFile{p, f})
+    return nil
+  })
+  // Oldest first, so that pushing to the front leaves the newest at the front.
+  sort.Slice(files, func(i, j int) bool { return files[i].info.ModTime().Before(files[j].info.ModTime()) })
+  c.mu.Lock()
+  defer c.mu.Unlock()
+  for _, f := range files {
+    c.add(f.path, f.info.Size())
+  }
+  c.evict()
+  log.Printf("Image cache %s has %d entries using %d bytes", c.dir, len(c.entries), c.totalBytes)
+}
+
+// get returns the cached rendition of sourcePath for the given variant,
+// or false if we don't have one.
+func (c *imageCache) get(sourcePath, variant string) ([]byte, bool) {
+  if c == nil {
+    return nil, false
+  }
+  cachePath, err := c.cachePath(sourcePath, variant)
+  if err != nil {
+    return nil, false
+  }
+  b, err := ioutil.ReadFile(cachePath)
+  if err != nil {
+    if !os.IsNotExist(err) {
+      log.Printf("Error reading image cache file %s: %v", cachePath, err)
+    }
+    return nil, false
+  }
+  c.mu.Lock()
+  defer c.mu.Unlock()
+  if e, ok := c.entries[cachePath]; ok {
+    c.lru.MoveToFront(e)
+  } else {
+    c.add(cachePath, int64(len(b)))
+  }
+  return b, true
+}
+
+// put saves a rendition of sourcePath for the given variant, then evicts
+// old entries if the cache is too big.
+func (c *imageCache) put(sourcePath, variant string, b []byte) {
+  if c == nil {
+    return
+  }
+  cachePath, err := c.cachePath(sourcePath, variant)
+  if err != nil {
+    log.Printf("Can't cache image for %s: %v", sourcePath, err)
+    return
+  }
+  if err := os.MkdirAll(filepath.Dir(cachePath), 0700); err != nil {
+    log.Printf("Error creating image cache directory for %s: %v", sourcePath, err)
+    return
+  }
+  // Write to a temp file first so that a reader never sees a partial file.
+  // Each put has its own, since two requests may render the same variant.
+  tmp, err := ioutil.TempFile(filepath.Dir(cachePath), imageCacheTempPrefix)
+  if err != nil {
+    log.Printf("Error creating image cache file for %s: %v", sourcePath, err)
+    return
+  }
+  tmpPath := tmp.Name()
+  _, err = tmp.Write(b)
+  if closeErr := tmp.Close(); err == nil {
+    err = closeErr
+  }
+  if err != nil {
+    log.Printf("Error writing image cache file %s: %v", tmpPath, err)
+    os.Remove(tmpPath)
+    return
+  }
+  if err := os.Rename(tmpPath, cachePath); err != nil {
+    log.Printf("Error renaming image cache file %s: %v", tmpPath, err)
+    os.Remove(tmpPath)
+    return
+  }
+  c.mu.Lock()
+  defer c.mu.Unlock()
+  if e, ok := c.entries[cachePath]; ok {
+    c.remove(e)
+  }
+  c.add(cachePath, int64(len(b)))
+  c.evict()
+}
+
+// invalidate removes all of the cached renditions of sourcePath.
+func (c *imageCache) invalidate(sourcePath string) {
+  if c == nil {
+    return
+  }
+  sourceDir := c.sourceDir(sourcePath)
+  c.mu.Lock()
+  defer c.mu.Unlock()
+  for p, e := range c.entries {
+    if strings.HasPrefix(p, sourceDir + string(filepath.Separator)) {
+      c.remove(e)
+    }
+  }
+  if err := os.RemoveAll(sourceDir); err != nil {
+    log.Printf("Error removing image cache directory %s: %v", sourceDir, err)
+  }
+}
+
+// add adds an entry to the front of the list. The caller must hold c.mu.
+func (c *imageCache) add(cachePath string, size int64) {
+  e := c.lru.PushFront(&imageCacheEntry{
+    path: cachePath,
+    size: size,
+  })
+  c.entries[cachePath] = e
+  c.totalBytes += size
+}
+
+// remove removes an entry from the list. The caller must hold c.mu.
+// The caller is responsible for removing the file.
+func (c *imageCache) remove(e *list.Element) {
+  entry := c.lru.Remove(e).(*imageCacheEntry)
+  delete(c.entries, entry.path)
+  c.totalBytes -= entry.size
+}
+
+// evict removes the least recently used entries until the cache is no
+// bigger than maxBytes. The caller must hold c.mu.
+func (c *imageCache) evict() {
+  for c.totalBytes > c.maxBytes && c.lru.Len() > 0 {
+    e := c.lru.Back()
+    entry := e.Value.(*imageCacheEntry)
+    c.remove(e)
+    if err := os.Remove(entry.path); err != nil && !os.IsNotExist(err) {
+      log.Printf("Error removing image cache file %s: %v", entry.path, err)
+    }
+    // Remove the source directory too if that was its last entry;
+    // this fails harmlessly if the directory is not empty.
+    os.Remove(filepath.Dir(entry.path))
+  }
+}
+
+// cachePath returns the location in the cache for the given variant of
+// sourcePath. The name includes the modification time and size of
+// the source file, so we return an error if we can't stat that file.
+func (c *imageCache) cachePath(sourcePath, variant string) (string, error) {
+  f, err := os.Stat(sourcePath)
+  if err != nil {
+    return "", err
+  }
+  key := fmt.Sprintf("%d|%d|%s", f.ModTime().UnixNano(), f.Size(), variant)
+  return filepath.Join(c.sourceDir(sourcePath), hashString(key) + imageCacheExtension), nil
+}
+
+// sourceDir returns the directory in the cache that holds all of the
+// renditions of sourcePath. We use two levels so that we don't end up
+// with a huge number of entries in the top-level cache directory.
+func (c *imageCache) sourceDir(sourcePath string) string {
+  h := hashString(filepath.Clean(sourcePath))
+  return filepath.Join(c.dir, h[:2], h)
+}
+
+func hashString(s string) string {
+  return fmt.Sprintf("%x", sha256.Sum256([]byte(s)))
+}
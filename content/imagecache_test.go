@@ -0,0 +1,178 @@
+package content
+
+import (
+  "bytes"
+  "image"
+  "image/color"
+  "image/jpeg"
+  "io/ioutil"
+  "os"
+  "path/filepath"
+  "sync"
+  "testing"
+)
+
+func TestImageCache(t *testing.T) {
+  cacheDir, err := ioutil.TempDir("", "mimsrv-cache")
+  if err != nil {
+    t.Fatalf("failed to create temp cache dir: %v", err)
+  }
+  defer os.RemoveAll(cacheDir)
+
+  c, err := newImageCache(cacheDir, 25)
+  if err != nil {
+    t.Fatalf("failed to create image cache: %v", err)
+  }
+
+  src1 := "testdata/d1/image1.jpg"
+  src2 := "testdata/d1/image2.jpg"
+  if _, ok := c.get(src1, "v1"); ok {
+    t.Errorf("empty cache should not have entry")
+  }
+  if _, ok := c.get("testdata/no-such-file.jpg", "v1"); ok {
+    t.Errorf("cache should not have entry for non-existent file")
+  }
+
+  c.put(src1, "v1", []byte("0123456789"))
+  b, ok := c.get(src1, "v1")
+  if !ok {
+    t.Fatalf("cache should have entry for src1 v1")
+  }
+  if got, want := string(b), "0123456789"; got != want {
+    t.Errorf("cached data for src1 v1: got %s, want %s", got, want)
+  }
+  if _, ok := c.get(src1, "v2"); ok {
+    t.Errorf("cache should not have entry for src1 v2")
+  }
+
+  c.put(src1, "v2", []byte("abcdefghij"))
+  c.get(src1, "v1")     // Make v2 the least recently used.
+  c.put(src2, "v1", []byte("ABCDEFGHIJ"))
+  if got, want := c.totalBytes, int64(20); got != want {
+    t.Errorf("cache size after eviction: got %d, want %d", got, want)
+  }
+  if _, ok := c.get(src1, "v2"); ok {
+    t.Errorf("src1 v2 should have been evicted")
+  }
+  if _, ok := c.get(src1, "v1"); !ok {
+    t.Errorf("src1 v1 should not have been evicted")
+  }
+
+  c.invalidate(src1)
+  if _, ok := c.get(src1, "v1"); ok {
+    t.Errorf("src1 v1 should have been invalidated")
+  }
+  if _, ok := c.get(src2, "v1"); !ok {
+    t.Errorf("src2 v1 should not have been invalidated")
+  }
+
+  // Entries with our old extension and leftover temp files are removed.
+  leftovers := []string{
+    filepath.Join(c.sourceDir(src2), "0123.jpg"),
+    filepath.Join(c.sourceDir(src2), imageCacheTempPrefix + "123"),
+  }
+  for _, p := range leftovers {
+    if err := ioutil.WriteFile(p, []byte("stale"), 0600); err != nil {
+      t.Fatalf("failed to write stale cache file: %v", err)
+    }
+  }
+
+  // A new cache in the same directory should see what we left behind.
+  c2, err := newImageCache(cacheDir, 25)
+  if err != nil {
+    t.Fatalf("failed to reopen image cache: %v", err)
+  }
+  if got, want := c2.totalBytes, int64(10); got != want {
+    t.Errorf("reopened cache size: got %d, want %d", got, want)
+  }
+  for _, p := range leftovers {
+    if _, err := os.Stat(p); !os.IsNotExist(err) {
+      t.Errorf("stale cache file %s should have been removed", p)
+    }
+  }
+
+  // Concurrent puts of the same variant each use their own temp file.
+  var wg sync.WaitGroup
+  for i := 0; i < 10; i++ {
+    wg.Add(1)
+    go func() {
+      defer wg.Done()
+      c2.put(src2, "v3", []byte("0123456789"))
+    }()
+  }
+  wg.Wait()
+  if b, ok := c2.get(src2, "v3"); !ok || string(b) != "0123456789" {
+    t.Errorf("cached data for src2 v3: got %q, %v", b, ok)
+  }
+  files, err := ioutil.ReadDir(c2.sourceDir(src2))
+  if err != nil {
+    t.Fatalf("failed to read cache dir: %v", err)
+  }
+  for _, f := range files {
+    if filepath.Ext(f.Name()) != imageCacheExtension {
+      t.Errorf("unexpected file %s in cache dir", f.Name())
+    }
+  }
+}
+
+func TestImageJpegCache(t *testing.T) {
+  testDir := "testdata/tmp"
+  cacheDir := testDir + "/cache"
+  os.RemoveAll(testDir)
+  if err := os.MkdirAll(cacheDir, 0744); err != nil {
+    t.Fatalf("Unable to create test directory: %v", err)
+  }
+  defer os.RemoveAll(testDir)
+  if err := writeTestJpeg(testDir + "/img.jpg", 40, 20); err != nil {
+    t.Fatalf("Unable to create test image: %v", err)
+  }
+
+  h := NewHandler(&Config{
+    ContentRoot: testDir,
+    ImageCacheDir: cacheDir,
+    ImageCacheMaxBytes: 1000000,
+  })
+  b, err, _ := h.ImageJpeg("img.jpg", 20, 20, 0, ImageOptions{})
+  if err != nil {
+    t.Fatalf("failed to get image: %v", err)
+  }
+  im, err := jpeg.Decode(bytes.NewReader(b))
+  if err != nil {
+    t.Fatalf("failed to decode returned image: %v", err)
+  }
+  if got, want := im.Bounds().Dx(), 20; got != want {
+    t.Errorf("resized image width: got %d, want %d", got, want)
+  }
+  if got, want := len(h.imageCache.entries), 1; got != want {
+    t.Errorf("image cache entries: got %d, want %d", got, want)
+  }
+
+  b2, err, _ := h.ImageJpeg("img.jpg", 20, 20, 0, ImageOptions{})
+  if err != nil {
+    t.Fatalf("failed to get cached image: %v", err)
+  }
+  if !bytes.Equal(b, b2) {
+    t.Errorf("cached image does not match original")
+  }
+  if got, want := len(h.imageCache.entries), 1; got != want {
+    t.Errorf("image cache entries after second request: got %d, want %d", got, want)
+  }
+}
+
+func writeTestJpeg(filename string, width, height int) error {
+  im := image.NewRGBA(image.Rect(0, 0, width, height))
+  for x := 0; x < width; x++ {
+    for y := 0; y < height; y++ {
+      im.Set(x, y, color.RGBA{uint8(x * 4), uint8(y * 4), 128, 255})
+    }
+  }
+  f, err := os.Create(filename)
+  if err != nil {
+    return err
+  }
+  if err := jpeg.Encode(f, im, nil); err != nil {
+    f.Close()
+    return err
+  }
+  return f.Close()
+}
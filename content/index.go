@@ -5,10 +5,13 @@ import (
   "io/ioutil"
   "log"
   "net/http"
+  "net/url"
   "os"
   "path"
   "path/filepath"
+  "strconv"
   "strings"
+  "unicode"
 )
 
 type UpdateCommand struct {
@@ -24,13 +27,28 @@ type ImageIndex struct {
   filenames []string    // Filenames in the order listed in the file.
 }
 
+// imageEntry is one line of an index file. The format of the line is
+// the filename, then optionally a semicolon and the rotation, then
+// optionally any number of attributes, each a semicolon then key=value.
+// Attribute values are escaped so that they can contain semicolons and
+// newlines.
 type imageEntry struct {
   filename string
   rotation string
+  attributes []entryAttribute   // In the order they appear in the line
+}
+
+type entryAttribute struct {
+  key string
+  value string
 }
 
 const (
   indexExtension = ".mpr"
+  // An index file that has entries with attributes starts with a line
+  // giving the format version. Files without that line are version 1.
+  indexVersionPrefix = "#mpr "
+  indexVersion = 2
 )
 
 func (h *Handler) UpdateImageIndex(apiPath string, command UpdateCommand) (error, int) {
@@ -39,27 +57,38 @@ func (h *Handler) UpdateImageIndex(apiPath string, command UpdateCommand) (error
   return h.updateImageIndexItem(indexPath, command)
 }
 
+// UpdateImageIndexBatch applies all of the commands, in order, to the
+// index file, then writes it out once. If any command fails, the index
+// file is not changed.
+func (h *Handler) UpdateImageIndexBatch(apiPath string, commands []UpdateCommand) (error, int) {
+  contentRoot := strings.TrimSuffix(h.config.ContentRoot, "/")
+  indexPath := fmt.Sprintf("%s/%s", contentRoot, apiPath)
+  return h.updateImageIndexItems(indexPath, commands)
+}
+
 func (h *Handler) updateImageIndexItem(indexPath string, command UpdateCommand) (error, int) {
+  return h.updateImageIndexItems(indexPath, []UpdateCommand{command})
+}
+
+func (h *Handler) updateImageIndexItems(indexPath string, commands []UpdateCommand) (error, int) {
   if filepath.Ext(indexPath) != indexExtension {
     return fmt.Errorf("index operations can only apply to %s files, not to %s", indexExtension, indexPath), http.StatusBadRequest
   }
-  if command.Action == "" {
-    return fmt.Errorf("no action specified"), http.StatusBadRequest
-  }
-  if command.Action != "deltarotation" && command.Action != "drop" {
-    return fmt.Errorf("action %s is not valid", command.Action), http.StatusBadRequest
+  if len(commands) == 0 {
+    return fmt.Errorf("no commands specified"), http.StatusBadRequest
   }
-  if command.Item == "" {
-    return fmt.Errorf("no item specified"), http.StatusBadRequest
-  }
-  if command.Value == "" && command.Action != "drop" {
-    return fmt.Errorf("value is required for %s action", command.Action), http.StatusBadRequest
+  autocreate := false
+  for _, command := range commands {
+    if err := validateUpdateCommand(command); err != nil {
+      return err, http.StatusBadRequest
+    }
+    autocreate = autocreate || command.Autocreate
   }
 
   lines, err := readFileLines(indexPath)
-  if os.IsNotExist(err) && command.Autocreate {
+  if os.IsNotExist(err) && autocreate {
     // We only allow auto-creation of the standard index.mpr file.
-    // Custom index files must be manually created directly in the filesystem.
+    // Custom index files must be created explicitly, with UpdateAlbum.
     if filepath.Base(indexPath) != "index.mpr" {
       return fmt.Errorf("index file %s does not exist and can not be autocreated", indexPath), http.StatusBadRequest
     }
@@ -79,34 +108,255 @@ func (h *Handler) updateImageIndexItem(indexPath string, command UpdateCommand)
     return err, http.StatusInternalServerError
   }
 
+  if v := indexFileVersion(lines); v > indexVersion {
+    return fmt.Errorf("index file %s is version %d, which is too new to update", indexPath, v), http.StatusBadRequest
+  }
+
+  // Any change to the index entry can change how we render the image.
+  changedPaths := []string{}
+  for _, command := range commands {
+    var status int
+    lines, err, status = h.applyUpdateCommand(indexPath, lines, command)
+    if err != nil {
+      return err, status
+    }
+    changedPaths = append(changedPaths, path.Join(filepath.Dir(indexPath), command.Item))
+    if command.Action == "rename" {
+      changedPaths = append(changedPaths, path.Join(filepath.Dir(indexPath), command.Value))
+    }
+  }
+  err = backupAndWriteFileLines(indexPath, withIndexVersion(lines))
+  if err != nil {
+    return err, http.StatusInternalServerError
+  }
+  for _, p := range changedPaths {
+    h.imageCache.invalidate(p)
+  }
+  return nil, http.StatusOK
+}
+
+// validateUpdateCommand checks that the command has the fields it needs.
+func validateUpdateCommand(command UpdateCommand) error {
+  if command.Action == "" {
+    return fmt.Errorf("no action specified")
+  }
+  valueRequired := false
+  switch command.Action {
+  case "deltarotation", "movebefore", "moveafter", "rename", "setattribute", "rating", "flag", "crop", "adjust", "poster":
+    valueRequired = true
+  case "drop", "add", "undrop":
+  default:
+    return fmt.Errorf("action %s is not valid", command.Action)
+  }
+  if command.Item == "" {
+    return fmt.Errorf("no item specified")
+  }
+  if command.Value == "" && valueRequired {
+    return fmt.Errorf("value is required for %s action", command.Action)
+  }
+  return nil
+}
+
+// applyUpdateCommand returns the lines of the index file updated
+// according to the command. The lines passed in are not modified.
+func (h *Handler) applyUpdateCommand(indexPath string, lines []string, command UpdateCommand) ([]string, error, int) {
+  switch command.Action {
+  case "add", "undrop":
+    // These are the only actions for which the item is not already in the index.
+    if i, _ := findEntry(lines, command.Item); i >= 0 {
+      return nil, fmt.Errorf("item %s is already in index", command.Item), http.StatusBadRequest
+    }
+    if err, status := h.checkIndexItemFile(indexPath, command.Item); err != nil {
+      return nil, err, status
+    }
+    entry := &imageEntry{
+      filename: command.Item,
+      rotation: "xo",
+    }
+    if command.Action == "undrop" {
+      if strings.Contains(command.Item, "/") {
+        return nil, fmt.Errorf("undrop item %s must be in the same directory as the index", command.Item), http.StatusBadRequest
+      }
+      return insertLine(lines, undropPosition(lines, command.Item), entry.toString()), nil, http.StatusOK
+    }
+    // Add at the end unless we are given an item to insert it before.
+    position := len(lines)
+    if command.Value != "" {
+      position, _ = findEntry(lines, command.Value)
+      if position < 0 {
+        return nil, fmt.Errorf("item %s not found in index", command.Value), http.StatusBadRequest
+      }
+    }
+    log.Printf("Adding to index file %q line %d: %s\n", indexPath, position, entry.toString())
+    return insertLine(lines, position, entry.toString()), nil, http.StatusOK
+  }
+
+  switch command.Action {
+  case "crop", "adjust", "poster":
+    // When we display an image, we only look for these in the index.mpr
+    // file in its own directory, so they would have no effect in an album.
+    if filepath.Base(indexPath) != "index.mpr" || strings.Contains(command.Item, "/") {
+      return nil, fmt.Errorf("%s can only be set in the index.mpr file in the directory of %s", command.Action, command.Item), http.StatusBadRequest
+    }
+  }
   itemIndex, entry := findEntry(lines, command.Item)
   if itemIndex < 0 {
-    return fmt.Errorf("item %s not found in index", command.Item), http.StatusBadRequest
+    return nil, fmt.Errorf("item %s not found in index", command.Item), http.StatusBadRequest
   }
   switch command.Action {
   case "deltarotation":
-    entry.rotation, err = combineRotations(entry.rotation, command.Value)
+    rotation, err := combineRotations(entry.rotation, command.Value)
     if err != nil {
-      return err, http.StatusBadRequest
+      return nil, err, http.StatusBadRequest
     }
-    lines[itemIndex] = entry.toString()
-    err = backupAndWriteFileLines(indexPath, lines)
-    if err != nil {
-      return err, http.StatusInternalServerError
-    }
-    return nil, http.StatusOK
+    entry.rotation = rotation
+    return replaceLine(lines, itemIndex, entry.toString()), nil, http.StatusOK
   case "drop":
     // Remove the specified item from the index list for this file.
     log.Printf("Removing from index file %q line %d: %s\n", indexPath, itemIndex, lines[itemIndex])
-    updatedLines := append(lines[0:itemIndex:itemIndex], lines[itemIndex+1:]...)
-    err = backupAndWriteFileLines(indexPath, updatedLines)
-    if err != nil {
-      return err, http.StatusInternalServerError
+    return removeLine(lines, itemIndex), nil, http.StatusOK
+  case "movebefore", "moveafter":
+    if command.Value == command.Item {
+      return nil, fmt.Errorf("can not move item %s relative to itself", command.Item), http.StatusBadRequest
+    }
+    updatedLines := removeLine(lines, itemIndex)
+    position, _ := findEntry(updatedLines, command.Value)
+    if position < 0 {
+      return nil, fmt.Errorf("item %s not found in index", command.Value), http.StatusBadRequest
     }
-    return nil, http.StatusOK
+    if command.Action == "moveafter" {
+      position++
+    }
+    return insertLine(updatedLines, position, lines[itemIndex]), nil, http.StatusOK
+  case "setattribute":
+    // The value is key=value, with an empty value to remove the attribute.
+    i := strings.Index(command.Value, "=")
+    if i < 0 {
+      return nil, fmt.Errorf("setattribute value must be key=value"), http.StatusBadRequest
+    }
+    if err := entry.setAttribute(command.Value[:i], command.Value[i+1:]); err != nil {
+      return nil, err, http.StatusBadRequest
+    }
+    return replaceLine(lines, itemIndex, entry.toString()), nil, http.StatusOK
+  case "rating":
+    rating, err := strconv.Atoi(command.Value)
+    if err != nil || rating < 0 || rating > maxRating {
+      return nil, fmt.Errorf("rating must be a number from 0 to %d", maxRating), http.StatusBadRequest
+    }
+    value := ""         // Zero stars is the same as not rated.
+    if rating > 0 {
+      value = command.Value
+    }
+    entry.setAttribute(ratingAttribute, value)
+    return replaceLine(lines, itemIndex, entry.toString()), nil, http.StatusOK
+  case "flag":
+    if !validFlag(command.Value) {
+      return nil, fmt.Errorf("flag must be %s, %s or %s", FlagPick, FlagReject, FlagNone), http.StatusBadRequest
+    }
+    value := command.Value
+    if value == FlagNone {
+      value = ""
+    }
+    entry.setAttribute(flagAttribute, value)
+    return replaceLine(lines, itemIndex, entry.toString()), nil, http.StatusOK
+  case "crop":
+    // The value is x,y,w,h as fractions of the displayed image, or none.
+    value := ""
+    if command.Value != cropNone {
+      crop, err := parseCrop(command.Value)
+      if err != nil {
+        return nil, err, http.StatusBadRequest
+      }
+      value = crop.String()
+    }
+    entry.setAttribute(cropAttribute, value)
+    return replaceLine(lines, itemIndex, entry.toString()), nil, http.StatusOK
+  case "adjust":
+    if err := entry.setAdjustments(command.Value); err != nil {
+      return nil, err, http.StatusBadRequest
+    }
+    return replaceLine(lines, itemIndex, entry.toString()), nil, http.StatusOK
+  case "poster":
+    // The value is the time of the frame to show for a video, or none.
+    if !h.isVideoFile(entry.filename) {
+      return nil, fmt.Errorf("item %s is not a video", command.Item), http.StatusBadRequest
+    }
+    value := ""
+    if command.Value != posterNone {
+      seconds, err := parsePosterTime(command.Value)
+      if err != nil {
+        return nil, err, http.StatusBadRequest
+      }
+      value = formatPosterTime(seconds)
+    }
+    entry.setAttribute(posterAttribute, value)
+    return replaceLine(lines, itemIndex, entry.toString()), nil, http.StatusOK
+  case "rename":
+    if i, _ := findEntry(lines, command.Value); i >= 0 {
+      return nil, fmt.Errorf("item %s is already in index", command.Value), http.StatusBadRequest
+    }
+    if err, status := h.checkIndexItemFile(indexPath, command.Value); err != nil {
+      return nil, err, status
+    }
+    entry.filename = command.Value
+    return replaceLine(lines, itemIndex, entry.toString()), nil, http.StatusOK
   }
 
-  return nil, http.StatusNotImplemented
+  return nil, fmt.Errorf("action %s is not implemented", command.Action), http.StatusNotImplemented
+}
+
+// checkIndexItemFile returns an error if the item, which is a path relative
+// to the directory containing the index file, is not an image or video
+// file within our content root.
+func (h *Handler) checkIndexItemFile(indexPath, item string) (error, int) {
+  if !h.isMediaFile(item) {
+    return fmt.Errorf("item %s is not an image or video file", item), http.StatusBadRequest
+  }
+  filePath := path.Join(filepath.Dir(indexPath), item)
+  rel, err := filepath.Rel(path.Clean(h.config.ContentRoot), filePath)
+  if err != nil || rel == ".." || strings.HasPrefix(rel, "../") {
+    return fmt.Errorf("item %s is not within the content root", item), http.StatusBadRequest
+  }
+  if _, err := os.Stat(filePath); err != nil {
+    return fmt.Errorf("item %s does not exist", item), http.StatusBadRequest
+  }
+  return nil, 0
+}
+
+// undropPosition returns where to put a file back into the index: before
+// the first file from the same directory whose name sorts after it, so
+// that a file dropped from a sorted index goes back where it was.
+func undropPosition(lines []string, item string) int {
+  for i, line := range lines {
+    if !isEntryLine(line) {
+      continue
+    }
+    entry := entryFromLine(line)
+    if !strings.Contains(entry.filename, "/") && entry.filename > item {
+      return i
+    }
+  }
+  return len(lines)
+}
+
+// insertLine returns a copy of lines with line inserted at position i.
+func insertLine(lines []string, i int, line string) []string {
+  updatedLines := make([]string, 0, len(lines) + 1)
+  updatedLines = append(updatedLines, lines[:i]...)
+  updatedLines = append(updatedLines, line)
+  return append(updatedLines, lines[i:]...)
+}
+
+// removeLine returns a copy of lines without the line at position i.
+func removeLine(lines []string, i int) []string {
+  return append(lines[0:i:i], lines[i+1:]...)
+}
+
+// replaceLine returns a copy of lines with the line at position i replaced.
+func replaceLine(lines []string, i int, line string) []string {
+  updatedLines := append([]string{}, lines...)
+  updatedLines[i] = line
+  return updatedLines
 }
 
 // Create an index file at the specified location by looking for all the image files
@@ -167,7 +417,7 @@ func combineRotations(fileRotation, deltaRotation string) (string, error) {
 func findEntry(lines []string, item string) (int, *imageEntry) {
   // Look for the matching line
   for i, line := range lines {
-    if line != "" {
+    if isEntryLine(line) {
       entry := entryFromLine(line)
       if entry.filename == item {
         return i, entry
@@ -185,6 +435,31 @@ func (h *Handler) imageIndex(dir string) *ImageIndex {
   return h.loadIndexFile(dir, indexName)
 }
 
+/* Returns the line from the index file in the same directory as the
+ * specified image that applies to that image, or the empty string if
+ * there is no index file or the image is not listed in it.
+ */
+func (h *Handler) indexEntryStringForImage(imageFilePath string) string {
+  entry := h.indexEntryForImage(imageFilePath)
+  if entry == nil {
+    return ""
+  }
+  return entry.toString()
+}
+
+// indexEntryForImage returns the entry for the image from the index file
+// in the same directory, or nil if there is none.
+func (h *Handler) indexEntryForImage(imageFilePath string) *imageEntry {
+  base := filepath.Base(imageFilePath)
+  dir := filepath.Dir(imageFilePath)
+  lines, err := readFileLines(fmt.Sprintf("%s/%s", dir, "index.mpr"))
+  if err != nil {
+    return nil
+  }
+  _, entry := findEntry(lines, base)
+  return entry
+}
+
 /* Reads the image index in the specified file, or nil
  * if not found.
  */
@@ -198,7 +473,7 @@ func (h *Handler) loadIndexFile(dirPath, indexName string) *ImageIndex {
   entries := make(map[string]*imageEntry)
   filenames := make([]string, 0)
   for i := range indexLines {
-    if indexLines[i] != "" {
+    if isEntryLine(indexLines[i]) {
       entry := entryFromLine(indexLines[i])
       entries[entry.filename] = entry
       filenames = append(filenames, entry.filename)
@@ -229,9 +504,66 @@ func entryFromLine(line string) *imageEntry {
   if len(fields) > 1 {
     entry.rotation = fields[1]
   }
+  if len(fields) > 2 {
+    for _, field := range fields[2:] {
+      if field == "" {
+        continue
+      }
+      a := entryAttribute{
+        key: field,
+      }
+      if i := strings.Index(field, "="); i >= 0 {
+        a.key = field[:i]
+        a.value = field[i+1:]
+        // If it doesn't unescape, someone probably typed it in by hand.
+        if v, err := url.PathUnescape(a.value); err == nil {
+          a.value = v
+        }
+      }
+      entry.attributes = append(entry.attributes, a)
+    }
+  }
   return entry
 }
 
+// isEntryLine returns true if the line from an index file is an entry,
+// rather than a blank line or a comment such as the version line.
+func isEntryLine(line string) bool {
+  return line != "" && !strings.HasPrefix(line, "#")
+}
+
+// indexFileVersion returns the format version of the index file.
+func indexFileVersion(lines []string) int {
+  for _, line := range lines {
+    if strings.HasPrefix(line, indexVersionPrefix) {
+      v, err := strconv.Atoi(strings.TrimSpace(strings.TrimPrefix(line, indexVersionPrefix)))
+      if err != nil {
+        return indexVersion + 1       // We don't know what it is, so don't touch it.
+      }
+      return v
+    }
+  }
+  return 1
+}
+
+// withIndexVersion returns lines with a version line added at the
+// start if any of the entries need a format newer than version 1.
+func withIndexVersion(lines []string) []string {
+  needsVersion := false
+  for _, line := range lines {
+    if strings.HasPrefix(line, indexVersionPrefix) {
+      return lines
+    }
+    if isEntryLine(line) && len(entryFromLine(line).attributes) > 0 {
+      needsVersion = true
+    }
+  }
+  if !needsVersion {
+    return lines
+  }
+  return insertLine(lines, 0, fmt.Sprintf("%s%d", indexVersionPrefix, indexVersion))
+}
+
 func backupAndWriteFileLines(filename string, lines []string) error {
   newFilename := filename + ".new"
   err := writeFileLines(newFilename, lines)
@@ -267,12 +599,85 @@ func writeFileLines(filename string, lines []string) error {
 
 func (e *imageEntry) toString() string {
   s := e.filename
-  if e.rotation != "" {
+  if e.rotation != "" || len(e.attributes) > 0 {
     s = s + ";" + e.rotation
   }
+  for _, a := range e.attributes {
+    s = s + ";" + a.key
+    if a.value != "" {
+      s = s + "=" + attributeValueEscaper.Replace(a.value)
+    }
+  }
   return s
 }
 
+// attributeValueEscaper escapes just the characters that would break
+// the format of an index line, so that the file stays easy to read.
+var attributeValueEscaper = strings.NewReplacer(
+    "%", "%25", ";", "%3B", "\n", "%0A", "\r", "%0D")
+
+// setAttribute sets the value of an attribute, adding it at the end if it
+// is not already there, or removes the attribute if the value is empty.
+func (e *imageEntry) setAttribute(key, value string) error {
+  if !validAttributeKey(key) {
+    return fmt.Errorf("invalid attribute name %q", key)
+  }
+  for i, a := range e.attributes {
+    if a.key == key {
+      if value == "" {
+        e.attributes = append(e.attributes[:i:i], e.attributes[i+1:]...)
+      } else {
+        e.attributes[i].value = value
+      }
+      return nil
+    }
+  }
+  if value != "" {
+    e.attributes = append(e.attributes, entryAttribute{key, value})
+  }
+  return nil
+}
+
+// attribute returns the value of the attribute, or the empty string
+// if the entry does not have it.
+func (e *imageEntry) attribute(key string) string {
+  if e == nil {
+    return ""
+  }
+  for _, a := range e.attributes {
+    if a.key == key {
+      return a.value
+    }
+  }
+  return ""
+}
+
+// attributeMap returns the attributes as a map, or nil if there are none.
+func (e *imageEntry) attributeMap() map[string]string {
+  if e == nil || len(e.attributes) == 0 {
+    return nil
+  }
+  m := make(map[string]string, len(e.attributes))
+  for _, a := range e.attributes {
+    m[a.key] = a.value
+  }
+  return m
+}
+
+// validAttributeKey returns true if the key is made of letters, digits,
+// underscores, dashes and dots.
+func validAttributeKey(key string) bool {
+  if key == "" {
+    return false
+  }
+  for _, c := range key {
+    if !unicode.IsLetter(c) && !unicode.IsDigit(c) && c != '_' && c != '-' && c != '.' {
+      return false
+    }
+  }
+  return true
+}
+
 func (i *ImageIndex) filter(files []os.FileInfo) []os.FileInfo {
   filteredFiles := make([]os.FileInfo, 0, len(files))
   for _, f := range(files) {
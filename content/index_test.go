@@ -166,6 +166,233 @@ func TestUpdateImageIndex(t *testing.T) {
   }
 }
 
+func TestUpdateImageIndexActions(t *testing.T) {
+  testTmpDir := "testdata/tmp"
+  testIndexFilename := testTmpDir + "/a/index.mpr"
+  os.RemoveAll(testTmpDir)
+  for _, d := range []string{"/a", "/b"} {
+    if err := os.MkdirAll(testTmpDir + d, 0744); err != nil {
+      t.Fatal(err)
+    }
+  }
+  defer os.RemoveAll(testTmpDir)
+  for _, fn := range []string{"a/img1.jpg", "a/img2.jpg", "a/img3.jpg", "a/img4.jpg", "b/other.jpg"} {
+    f, err := os.Create(testTmpDir + "/" + fn)
+    if err != nil {
+      t.Fatal(err)
+    }
+    f.Close()
+  }
+  h := NewHandler(&Config{
+    ContentRoot: testTmpDir,
+  });
+
+  testCases := []struct{
+    start string
+    commands []UpdateCommand
+    want string
+  }{
+    {
+      "img1.jpg\nimg2.jpg;+r\nimg3.jpg\n",
+      []UpdateCommand{{Item: "img3.jpg", Action: "movebefore", Value: "img1.jpg"}},
+      "img3.jpg\nimg1.jpg\nimg2.jpg;+r\n",
+    },
+    {
+      "img1.jpg\nimg2.jpg;+r\nimg3.jpg\n",
+      []UpdateCommand{{Item: "img1.jpg", Action: "moveafter", Value: "img2.jpg"}},
+      "img2.jpg;+r\nimg1.jpg\nimg3.jpg\n",
+    },
+    {
+      "img1.jpg\nimg3.jpg\n",
+      []UpdateCommand{
+        {Item: "../b/other.jpg", Action: "add"},
+        {Item: "img4.jpg", Action: "add", Value: "img3.jpg"},
+        {Item: "img2.jpg", Action: "undrop"},
+      },
+      "img1.jpg\nimg2.jpg;xo\nimg4.jpg;xo\nimg3.jpg\n../b/other.jpg;xo\n",
+    },
+    {
+      "img1.jpg\nimg2.jpg;+r\n",
+      []UpdateCommand{
+        {Item: "img2.jpg", Action: "rename", Value: "img4.jpg"},
+        {Item: "img4.jpg", Action: "deltarotation", Value: "+r"},
+        {Item: "img1.jpg", Action: "drop"},
+      },
+      "img4.jpg;+rr\n",
+    },
+  }
+  for _, tc := range testCases {
+    if err := ioutil.WriteFile(testIndexFilename, []byte(tc.start), 0644); err != nil {
+      t.Fatal(err)
+    }
+    err, _ := h.UpdateImageIndexBatch("a/index.mpr", tc.commands)
+    if err != nil {
+      t.Errorf("update of %q with %v failed: %v", tc.start, tc.commands, err)
+      continue
+    }
+    b, err := ioutil.ReadFile(testIndexFilename)
+    if err != nil {
+      t.Fatal(err)
+    }
+    if got, want := string(b), tc.want; got != want {
+      t.Errorf("update of %q with %v: got %q, want %q", tc.start, tc.commands, got, want)
+    }
+  }
+
+  // If any command fails, the index file should not be changed.
+  start := "img1.jpg\nimg2.jpg\n"
+  failingCommands := [][]UpdateCommand{
+    {{Item: "img2.jpg", Action: "drop"}, {Item: "nosuchimage.jpg", Action: "drop"}},
+    {{Item: "img1.jpg", Action: "movebefore", Value: "nosuchimage.jpg"}},
+    {{Item: "img1.jpg", Action: "moveafter", Value: "img1.jpg"}},
+    {{Item: "img2.jpg", Action: "add"}},
+    {{Item: "nosuchimage.jpg", Action: "add"}},
+    {{Item: "../../index_test.go", Action: "add"}},
+    {{Item: "../../../outside.jpg", Action: "add"}},
+    {{Item: "../b/other.jpg", Action: "undrop"}},
+    {{Item: "img1.jpg", Action: "rename", Value: "img2.jpg"}},
+    {{Item: "img1.jpg", Action: "rename"}},
+    {},
+  }
+  for _, commands := range failingCommands {
+    if err := ioutil.WriteFile(testIndexFilename, []byte(start), 0644); err != nil {
+      t.Fatal(err)
+    }
+    err, status := h.UpdateImageIndexBatch("a/index.mpr", commands)
+    if err == nil {
+      t.Errorf("update with %v should fail", commands)
+    }
+    if got, want := status, http.StatusBadRequest; got != want {
+      t.Errorf("update with %v: got status %d, want %d", commands, got, want)
+    }
+    b, err := ioutil.ReadFile(testIndexFilename)
+    if err != nil {
+      t.Fatal(err)
+    }
+    if got, want := string(b), start; got != want {
+      t.Errorf("failed update with %v changed index file: got %q, want %q", commands, got, want)
+    }
+  }
+}
+
+func TestEntryAttributes(t *testing.T) {
+  testCases := []struct{
+    line string
+    filename, rotation string
+    attributes map[string]string
+  }{
+    { "img1.jpg", "img1.jpg", "", nil },
+    { "img1.jpg;+r", "img1.jpg", "+r", nil },
+    { "img1.jpg;;rating=3", "img1.jpg", "", map[string]string{"rating": "3"} },
+    { "img1.jpg;xo-r;rating=3;future=a%3Bb%0Ac;hidden", "img1.jpg", "xo-r",
+        map[string]string{"rating": "3", "future": "a;b\nc", "hidden": ""} },
+  }
+  for _, tc := range testCases {
+    entry := entryFromLine(tc.line)
+    if got, want := entry.filename, tc.filename; got != want {
+      t.Errorf("filename for %q: got %s, want %s", tc.line, got, want)
+    }
+    if got, want := entry.rotation, tc.rotation; got != want {
+      t.Errorf("rotation for %q: got %s, want %s", tc.line, got, want)
+    }
+    if got, want := fmt.Sprint(entry.attributeMap()), fmt.Sprint(tc.attributes); got != want {
+      t.Errorf("attributes for %q: got %s, want %s", tc.line, got, want)
+    }
+    if got, want := entry.toString(), tc.line; got != want {
+      t.Errorf("rewrite of %q: got %q", tc.line, got)
+    }
+  }
+
+  entry := entryFromLine("img1.jpg;+r;a=1;b=2")
+  if err := entry.setAttribute("a", ""); err != nil {
+    t.Fatalf("failed to remove attribute: %v", err)
+  }
+  if err := entry.setAttribute("c", "x;y"); err != nil {
+    t.Fatalf("failed to add attribute: %v", err)
+  }
+  if err := entry.setAttribute("b", "3"); err != nil {
+    t.Fatalf("failed to change attribute: %v", err)
+  }
+  if got, want := entry.toString(), "img1.jpg;+r;b=3;c=x%3By"; got != want {
+    t.Errorf("entry after setting attributes: got %q, want %q", got, want)
+  }
+  if err := entry.setAttribute("bad key", "3"); err == nil {
+    t.Errorf("setting attribute with invalid key should fail")
+  }
+}
+
+func TestSetAttribute(t *testing.T) {
+  testTmpDir := "testdata/tmp"
+  testIndexFilename := testTmpDir + "/index.mpr"
+  os.RemoveAll(testTmpDir)
+  if err := os.Mkdir(testTmpDir, 0744); err != nil {
+    t.Fatal(err)
+  }
+  defer os.RemoveAll(testTmpDir)
+  for _, fn := range []string{"img1.jpg", "img2.jpg"} {
+    if err := ioutil.WriteFile(testTmpDir + "/" + fn, []byte{}, 0644); err != nil {
+      t.Fatal(err)
+    }
+  }
+  if err := ioutil.WriteFile(testIndexFilename, []byte("img1.jpg;+r\nimg2.jpg\n"), 0644); err != nil {
+    t.Fatal(err)
+  }
+  h := NewHandler(&Config{
+    ContentRoot: testTmpDir,
+  });
+
+  err, _ := h.UpdateImageIndex("index.mpr", UpdateCommand{
+    Item: "img2.jpg",
+    Action: "setattribute",
+    Value: "caption=Best; ever",
+  })
+  if err != nil {
+    t.Fatalf("setattribute failed: %v", err)
+  }
+  b, err := ioutil.ReadFile(testIndexFilename)
+  if err != nil {
+    t.Fatal(err)
+  }
+  if got, want := string(b), "#mpr 2\nimg1.jpg;+r\nimg2.jpg;;caption=Best%3B ever\n"; got != want {
+    t.Errorf("index after setattribute: got %q, want %q", got, want)
+  }
+
+  list, err, _ := h.List("", ListOptions{})
+  if err != nil {
+    t.Fatalf("failed to list: %v", err)
+  }
+  if got, want := len(list.Items), 2; got != want {
+    t.Fatalf("list item count: got %d, want %d", got, want)
+  }
+  if list.Items[0].Attributes != nil {
+    t.Errorf("attributes for img1.jpg: got %v, want nil", list.Items[0].Attributes)
+  }
+  if got, want := list.Items[1].Attributes["caption"], "Best; ever"; got != want {
+    t.Errorf("caption attribute for img2.jpg: got %q, want %q", got, want)
+  }
+  list, err, _ = h.ListFromIndex("index.mpr", ListOptions{})
+  if err != nil {
+    t.Fatalf("failed to list from index: %v", err)
+  }
+  if got, want := len(list.Items), 2; got != want {
+    t.Fatalf("list from index item count: got %d, want %d", got, want)
+  }
+  if got, want := list.Items[1].Attributes["caption"], "Best; ever"; got != want {
+    t.Errorf("caption attribute from index for img2.jpg: got %q, want %q", got, want)
+  }
+
+  if err := ioutil.WriteFile(testIndexFilename, []byte("#mpr 3\nimg1.jpg\n"), 0644); err != nil {
+    t.Fatal(err)
+  }
+  err, _ = h.UpdateImageIndex("index.mpr", UpdateCommand{
+    Item: "img1.jpg",
+    Action: "drop",
+  })
+  if err == nil {
+    t.Errorf("updating an index file with a newer version should fail")
+  }
+}
+
 func compareFiles(newFilename, refFilename string) error {
   got, err := ioutil.ReadFile(newFilename)
   if err != nil {
@@ -0,0 +1,235 @@
+package content
+
+import (
+  "fmt"
+  "io/ioutil"
+  "log"
+  "net/http"
+  "os"
+  "sort"
+  "strings"
+  "sync"
+  "time"
+)
+
+const (
+  // Kinds of jobs.
+  JobKindTranscode = "transcode"
+  JobKindHls = "hls"
+
+  // States for Job. Jobs that succeed are removed from the queue.
+  JobStateQueued = "queued"
+  JobStateRunning = "running"
+  JobStateFailed = "failed"
+
+  // How many jobs we run at once if the Config doesn't say.
+  defaultJobWorkers = 2
+)
+
+// Job is a video transcoding job that runs in the background.
+type Job struct {
+  Kind string            // JobKindTranscode or JobKindHls
+  Path string            // Api path of the video
+  State string           // JobStateQueued, JobStateRunning or JobStateFailed
+  Progress float64       // From 0 to 1
+  Error string           // Why the job failed
+  Queued time.Time
+
+  output string          // Where the job writes its result
+  run func(progress func(float64)) error
+  err error
+  done chan struct{}     // Closed when the job has finished
+}
+
+// PrewarmOptions says which cached files Prewarm creates.
+type PrewarmOptions struct {
+  Recursive bool        // Include the videos in subdirectories
+  Hls bool              // Create the HLS segments as well as transcoded mp4 files
+}
+
+// jobQueue runs jobs in the background, no more than a fixed number at
+// a time. There is only ever one job for an output, so a second request
+// for the same file waits for the first job rather than starting another.
+// We remember jobs that have failed so that we don't keep trying them.
+type jobQueue struct {
+  mu sync.Mutex
+  jobs map[string]*Job          // Keyed by output
+  workers chan struct{}         // Holds a value for each running job
+}
+
+func newJobQueue(workers int) *jobQueue {
+  if workers <= 0 {
+    workers = defaultJobWorkers
+  }
+  return &jobQueue{
+    jobs: make(map[string]*Job),
+    workers: make(chan struct{}, workers),
+  }
+}
+
+// submit queues a job to write output by calling run, unless there
+// is already a job for that output, in which case it returns that job.
+func (q *jobQueue) submit(kind, apiPath, output string, run func(progress func(float64)) error) *Job {
+  q.mu.Lock()
+  defer q.mu.Unlock()
+  if job, ok := q.jobs[output]; ok {
+    return job
+  }
+  job := &Job{
+    Kind: kind,
+    Path: apiPath,
+    State: JobStateQueued,
+    Queued: time.Now(),
+    output: output,
+    run: run,
+    done: make(chan struct{}),
+  }
+  q.jobs[output] = job
+  go q.runJob(job)
+  return job
+}
+
+func (q *jobQueue) runJob(job *Job) {
+  q.workers <- struct{}{}
+  q.mu.Lock()
+  job.State = JobStateRunning
+  q.mu.Unlock()
+  err := job.run(func(progress float64) {
+    q.mu.Lock()
+    job.Progress = progress
+    q.mu.Unlock()
+  })
+  <-q.workers
+  if err != nil {
+    log.Printf("Error in %s job for %s: %v", job.Kind, job.Path, err)
+  }
+
+  q.mu.Lock()
+  defer q.mu.Unlock()
+  job.err = err
+  if err == nil {
+    job.Progress = 1
+    delete(q.jobs, job.output)
+  } else {
+    job.State = JobStateFailed
+    job.Error = err.Error()
+  }
+  close(job.done)
+}
+
+// wait waits for the job to finish and returns its error.
+func (q *jobQueue) wait(job *Job) error {
+  <-job.done
+  q.mu.Lock()
+  defer q.mu.Unlock()
+  return job.err
+}
+
+// snapshot returns a copy of the job as it is now.
+func (q *jobQueue) snapshot(job *Job) *Job {
+  q.mu.Lock()
+  defer q.mu.Unlock()
+  jobCopy := *job
+  return &jobCopy
+}
+
+// status returns a copy of the job for the output, or nil if there is
+// no job for it.
+func (q *jobQueue) status(output string) *Job {
+  q.mu.Lock()
+  defer q.mu.Unlock()
+  if job, ok := q.jobs[output]; ok {
+    jobCopy := *job
+    return &jobCopy
+  }
+  return nil
+}
+
+// forget removes a failed job for the output, so that we will try
+// again the next time the output is requested.
+func (q *jobQueue) forget(output string) {
+  q.mu.Lock()
+  defer q.mu.Unlock()
+  if job, ok := q.jobs[output]; ok && job.State == JobStateFailed {
+    delete(q.jobs, output)
+  }
+}
+
+// list returns copies of the queued, running and failed jobs, oldest first.
+func (q *jobQueue) list() []Job {
+  q.mu.Lock()
+  defer q.mu.Unlock()
+  jobs := make([]Job, 0, len(q.jobs))
+  for _, job := range q.jobs {
+    jobs = append(jobs, *job)
+  }
+  sort.Slice(jobs, func(i, j int) bool {
+    if !jobs[i].Queued.Equal(jobs[j].Queued) {
+      return jobs[i].Queued.Before(jobs[j].Queued)
+    }
+    return jobs[i].output < jobs[j].output
+  })
+  return jobs
+}
+
+// Jobs returns the transcoding jobs that are queued, running or have failed.
+func (h *Handler) Jobs() []Job {
+  return h.jobs.list()
+}
+
+// Prewarm queues jobs to create the cached files for the videos in the
+// directory, so that they are ready before anyone asks for them. It returns
+// the jobs for the videos that are not already cached.
+func (h *Handler) Prewarm(dirApiPath string, options PrewarmOptions) ([]Job, error, int) {
+  dirApiPath = cleanApiPath(dirApiPath)
+  root := strings.TrimSuffix(h.config.ContentRoot, "/")
+  dirPath := fmt.Sprintf("%s/%s", root, dirApiPath)
+  f, err := os.Stat(dirPath)
+  if err != nil {
+    return nil, fmt.Errorf("failed to stat directory: %v", err), http.StatusNotFound
+  }
+  if !f.IsDir() {
+    return nil, fmt.Errorf("not a directory: %s", dirApiPath), http.StatusBadRequest
+  }
+
+  jobs := []Job{}
+  var visit func(dirApiPath string) error
+  visit = func(dirApiPath string) error {
+    files, err := ioutil.ReadDir(fmt.Sprintf("%s/%s", root, dirApiPath))
+    if err != nil {
+      return err
+    }
+    for _, f := range files {
+      if strings.HasPrefix(f.Name(), ".") {
+        continue
+      }
+      apiPath := cleanApiPath(dirApiPath + "/" + f.Name())
+      if f.IsDir() {
+        if options.Recursive {
+          if err := visit(apiPath); err != nil {
+            return err
+          }
+        }
+        continue
+      }
+      if !h.isVideoFile(f.Name()) {
+        continue
+      }
+      if h.needsTranscode(f.Name()) {
+        if job := h.startTranscode(apiPath); job != nil {
+          jobs = append(jobs, *job)
+        }
+      }
+      if options.Hls {
+        if job := h.startHls(apiPath); job != nil {
+          jobs = append(jobs, *job)
+        }
+      }
+    }
+    return nil
+  }
+  if err := visit(dirApiPath); err != nil {
+    return nil, fmt.Errorf("failed to read directory: %v", err), http.StatusInternalServerError
+  }
+  return jobs, nil, 0
+}
@@ -0,0 +1,170 @@
+package content
+
+import (
+  "fmt"
+  "io/ioutil"
+  "net/http"
+  "os"
+  "strings"
+  "sync"
+  "testing"
+)
+
+// Rather than running ffmpeg, write a tiny file where it would write
+// its output, which is always the last argument.
+const fakeFfmpegScript = `#!/bin/sh
+echo "  Duration: 00:00:10.00, start: 0.000000, bitrate: 100 kb/s" >&2
+echo "out_time=00:00:05.000000"
+for last; do :; done
+printf '#EXTM3U\n' > "$last"
+`
+
+const failingFfmpegScript = `#!/bin/sh
+echo "clip.mts: Invalid data found when processing input" >&2
+exit 1
+`
+
+func TestJobQueue(t *testing.T) {
+  q := newJobQueue(1)
+  release := make(chan struct{})
+  var mu sync.Mutex
+  runs := 0
+  run := func(progress func(float64)) error {
+    mu.Lock()
+    runs++
+    mu.Unlock()
+    progress(0.5)
+    <-release
+    return nil
+  }
+  first := q.submit(JobKindTranscode, "a.mts", "out/a.mp4", run)
+  if again := q.submit(JobKindTranscode, "a.mts", "out/a.mp4", run); again != first {
+    t.Errorf("Second submit for the same output should return the first job")
+  }
+  second := q.submit(JobKindTranscode, "b.mts", "out/b.mp4", run)
+
+  jobs := q.list()
+  if got, want := len(jobs), 2; got != want {
+    t.Fatalf("Number of jobs: got %d, want %d", got, want)
+  }
+  if jobs[0].Path != "a.mts" || jobs[1].Path != "b.mts" {
+    t.Errorf("Jobs out of order: %+v", jobs)
+  }
+  // With only one worker, one of the jobs has to wait for the other.
+  if jobs[0].State == JobStateRunning && jobs[1].State == JobStateRunning {
+    t.Errorf("Two jobs running with only one worker")
+  }
+
+  close(release)
+  if err := q.wait(first); err != nil {
+    t.Errorf("First job failed: %v", err)
+  }
+  if err := q.wait(second); err != nil {
+    t.Errorf("Second job failed: %v", err)
+  }
+  if got, want := runs, 2; got != want {
+    t.Errorf("Number of runs: got %d, want %d", got, want)
+  }
+  if got := q.list(); len(got) != 0 {
+    t.Errorf("Jobs that succeeded should be removed: %+v", got)
+  }
+
+  failing := q.submit(JobKindHls, "c.mts", "out/c.hls", func(progress func(float64)) error {
+    return fmt.Errorf("bad video")
+  })
+  if err := q.wait(failing); err == nil {
+    t.Errorf("Failing job should return an error")
+  }
+  status := q.status("out/c.hls")
+  if status == nil || status.State != JobStateFailed || status.Error != "bad video" {
+    t.Errorf("Failed job status: got %+v", status)
+  }
+  q.forget("out/c.hls")
+  if status := q.status("out/c.hls"); status != nil {
+    t.Errorf("Failed job should be forgotten: %+v", status)
+  }
+}
+
+func TestTranscodeAndPrewarm(t *testing.T) {
+  testDir := "testdata/tmp"
+  os.RemoveAll(testDir)
+  if err := os.MkdirAll(testDir + "/sub", 0744); err != nil {
+    t.Fatalf("Unable to create test directory: %v", err)
+  }
+  defer os.RemoveAll(testDir)
+  for name, script := range map[string]string{"ffmpeg": fakeFfmpegScript, "badffmpeg": failingFfmpegScript} {
+    if err := ioutil.WriteFile(testDir + "/" + name, []byte(script), 0755); err != nil {
+      t.Fatalf("Unable to write test script: %v", err)
+    }
+  }
+  for _, name := range []string{"clip.mts", "movie.mp4", "sub/old.mpg"} {
+    if err := ioutil.WriteFile(testDir + "/" + name, []byte("not really a video"), 0644); err != nil {
+      t.Fatalf("Unable to write test video: %v", err)
+    }
+  }
+  defer func(command string) { ffmpegCommand = command }(ffmpegCommand)
+  ffmpegCommand = testDir + "/badffmpeg"
+
+  h := NewHandler(&Config{
+    ContentRoot: testDir,
+  });
+  if _, err := h.VideoFilePath("clip.mts"); err == nil {
+    t.Errorf("VideoFilePath with failing ffmpeg should fail")
+  }
+  mp4Path := h.mp4PathInCache("clip.mts")
+  for _, p := range []string{mp4Path, mp4Path + ".tmp"} {
+    if _, err := os.Stat(p); !os.IsNotExist(err) {
+      t.Errorf("Failed transcode should not leave %s: %v", p, err)
+    }
+  }
+  jobs := h.Jobs()
+  if len(jobs) != 1 || jobs[0].State != JobStateFailed || jobs[0].Kind != JobKindTranscode {
+    t.Errorf("Jobs after failed transcode: got %+v", jobs)
+  }
+
+  ffmpegCommand = testDir + "/ffmpeg"
+  h.fileChanged("clip.mts")
+  got, err := h.VideoFilePath("clip.mts")
+  if err != nil {
+    t.Fatalf("VideoFilePath failed: %v", err)
+  }
+  if got != mp4Path {
+    t.Errorf("VideoFilePath: got %s, want %s", got, mp4Path)
+  }
+  if _, err := os.Stat(mp4Path); err != nil {
+    t.Errorf("Transcoded file is missing: %v", err)
+  }
+
+  if _, err, status := h.Prewarm("clip.mts", PrewarmOptions{}); status != http.StatusBadRequest {
+    t.Errorf("Prewarm of a file: got status %d (%v), want %d", status, err, http.StatusBadRequest)
+  }
+  testCases := []struct{
+    options PrewarmOptions
+    want []string
+  }{
+    { PrewarmOptions{}, []string{} },
+    { PrewarmOptions{Recursive: true}, []string{"transcode sub/old.mpg"} },
+    { PrewarmOptions{Hls: true}, []string{"hls clip.mts", "hls movie.mp4"} },
+  }
+  for _, tc := range testCases {
+    jobs, err, _ := h.Prewarm("", tc.options)
+    if err != nil {
+      t.Fatalf("Prewarm(%+v) failed: %v", tc.options, err)
+    }
+    queued := make([]string, len(jobs))
+    for i, job := range jobs {
+      queued[i] = job.Kind + " " + job.Path
+    }
+    if strings.Join(queued, ",") != strings.Join(tc.want, ",") {
+      t.Errorf("Prewarm(%+v): got %v, want %v", tc.options, queued, tc.want)
+    }
+  }
+  for _, p := range []string{"clip.mts", "movie.mp4"} {
+    if status := waitForHls(t, h, p); status.State != HlsStateReady {
+      t.Errorf("Hls(%s) after prewarm: got %+v, want ready", p, status)
+    }
+  }
+  if got, err := h.VideoFilePath("sub/old.mpg"); err != nil || got != h.mp4PathInCache("sub/old.mpg") {
+    t.Errorf("VideoFilePath(sub/old.mpg) after prewarm: got %s, %v", got, err)
+  }
+}
@@ -0,0 +1,171 @@
+package content
+
+import (
+  "bytes"
+  "fmt"
+  "image"
+  "log"
+  "os/exec"
+  "path/filepath"
+  "sort"
+  "strings"
+  "sync"
+)
+
+// Kinds of media types, which we use as the ListItem.Type.
+const (
+  MediaKindImage = "image"
+  MediaKindVideo = "video"
+  MediaKindIndex = "index"
+)
+
+// MediaType describes one type of file that we list and serve. How we
+// list, thumbnail and serve a file follows from its Kind; a type can only
+// change that with the fields below.
+type MediaType struct {
+  Name string           // Used to enable an optional type in Config.MediaTypes
+  Kind string           // MediaKindImage, MediaKindVideo or MediaKindIndex
+  Extensions []string   // Lower case, including the dot
+  Optional bool         // Only used if enabled in Config.MediaTypes
+  // ContentType is for sending an image file as it is, as for
+  // ImageFormatOriginal; empty if browsers can't display the file.
+  ContentType string
+  // Transcode is true for videos that browsers can't play,
+  // which we transcode to mp4.
+  Transcode bool
+  // Decode returns the image in the file, or a frame from a video, along
+  // with its EXIF orientation, or -1 if none. If nil, we use the standard
+  // image decoders for images, and a poster frame for videos.
+  Decode func(filePath string) (image.Image, int, error)
+}
+
+// mediaTypes are all the types we know about. The optional ones
+// are only used when enabled in the Config.
+var mediaTypesMu sync.Mutex     // Protects mediaTypes
+var mediaTypes = []*MediaType{
+  { Name: "jpeg", Kind: MediaKindImage, Extensions: []string{".jpg", ".jpeg"}, ContentType: "image/jpeg" },
+  { Name: "png", Kind: MediaKindImage, Extensions: []string{".png"}, ContentType: "image/png" },
+  { Name: "gif", Kind: MediaKindImage, Extensions: []string{".gif"}, ContentType: "image/gif" },
+  { Name: "mp4", Kind: MediaKindVideo, Extensions: []string{".mp4"} },
+  { Name: "mpeg", Kind: MediaKindVideo, Extensions: []string{".mpg"}, Transcode: true },
+  { Name: "mts", Kind: MediaKindVideo, Extensions: []string{".mts"}, Transcode: true },
+  { Name: "index", Kind: MediaKindIndex, Extensions: []string{indexExtension} },
+
+  { Name: "webm", Kind: MediaKindVideo, Extensions: []string{".webm"}, Optional: true },
+  { Name: "mov", Kind: MediaKindVideo, Extensions: []string{".mov"}, Optional: true, Transcode: true },
+  { Name: "tiff", Kind: MediaKindImage, Extensions: []string{".tif", ".tiff"}, Optional: true, Decode: decodeWithFfmpeg },
+  { Name: "heic", Kind: MediaKindImage, Extensions: []string{".heic", ".heif"}, Optional: true, Decode: decodeWithFfmpeg },
+}
+
+// RegisterMediaType adds a media type, which is used by handlers created
+// after this call if it is not optional or if it is enabled in their Config.
+// Handlers that already exist don't see it, so it is usually called from
+// an init function. If it has an extension of an existing type, it replaces
+// that type for that extension.
+func RegisterMediaType(t *MediaType) {
+  mediaTypesMu.Lock()
+  defer mediaTypesMu.Unlock()
+  mediaTypes = append(mediaTypes, t)
+}
+
+// mediaRegistry holds the media types a Handler uses, by extension.
+type mediaRegistry struct {
+  byExt map[string]*MediaType
+}
+
+// newMediaRegistry returns a registry with the standard media types
+// and the optional ones whose names are in enabled.
+func newMediaRegistry(enabled []string) *mediaRegistry {
+  want := make(map[string]bool)
+  for _, name := range enabled {
+    want[strings.ToLower(strings.TrimSpace(name))] = true
+  }
+  m := &mediaRegistry{
+    byExt: make(map[string]*MediaType),
+  }
+  mediaTypesMu.Lock()
+  defer mediaTypesMu.Unlock()
+  for _, t := range mediaTypes {
+    if t.Optional && !want[t.Name] {
+      continue
+    }
+    delete(want, t.Name)
+    for _, ext := range t.Extensions {
+      m.byExt[strings.ToLower(ext)] = t
+    }
+  }
+  for name := range want {
+    if name != "" {
+      log.Printf("Unknown media type %s", name)
+    }
+  }
+  return m
+}
+
+// lookup returns the media type for the file name, or nil if none.
+func (m *mediaRegistry) lookup(name string) *MediaType {
+  return m.byExt[strings.ToLower(filepath.Ext(name))]
+}
+
+// extensions returns the extensions for the media types of the kinds, sorted.
+func (m *mediaRegistry) extensions(kinds ...string) []string {
+  exts := []string{}
+  for ext, t := range m.byExt {
+    for _, kind := range kinds {
+      if t.Kind == kind {
+        exts = append(exts, ext)
+      }
+    }
+  }
+  sort.Strings(exts)
+  return exts
+}
+
+// mediaType returns the media type for the file name, or nil if
+// it is not a type we handle.
+func (h *Handler) mediaType(name string) *MediaType {
+  return h.media.lookup(name)
+}
+
+// isImageFile returns true if the name has one of our image extensions.
+func (h *Handler) isImageFile(name string) bool {
+  t := h.mediaType(name)
+  return t != nil && t.Kind == MediaKindImage
+}
+
+// isVideoFile returns true if the name has one of our video extensions.
+func (h *Handler) isVideoFile(name string) bool {
+  t := h.mediaType(name)
+  return t != nil && t.Kind == MediaKindVideo
+}
+
+// isMediaFile returns true if the name has one of our image or video extensions.
+func (h *Handler) isMediaFile(name string) bool {
+  return h.isImageFile(name) || h.isVideoFile(name)
+}
+
+// needsTranscode returns true for videos that browsers can't play,
+// so that we have to transcode them to mp4.
+func (h *Handler) needsTranscode(name string) bool {
+  t := h.mediaType(name)
+  return t != nil && t.Kind == MediaKindVideo && t.Transcode
+}
+
+// decodeWithFfmpeg decodes an image that the Go image packages can't, by
+// having ffmpeg convert it to PNG.
+func decodeWithFfmpeg(filePath string) (image.Image, int, error) {
+  cmd := exec.Command(ffmpegCommand,
+      "-i", filePath,
+      "-frames:v", "1",
+      "-f", "image2pipe",
+      "-c:v", "png",
+      "-")
+  var stdout, stderr bytes.Buffer
+  cmd.Stdout = &stdout
+  cmd.Stderr = &stderr
+  if err := cmd.Run(); err != nil {
+    return nil, -1, fmt.Errorf("Error converting image file %v: %v: %s", filePath, err, lastLine(stderr.Bytes()))
+  }
+  im, _, err := image.Decode(&stdout)
+  return im, -1, err
+}
@@ -0,0 +1,152 @@
+package content
+
+import (
+  "fmt"
+  "image"
+  "io/ioutil"
+  "os"
+  "strings"
+  "sync"
+  "testing"
+)
+
+func TestMediaRegistry(t *testing.T) {
+  testCases := []struct{
+    enabled []string
+    name string
+    wantKind string       // Empty if the file is not one of our types
+  }{
+    { nil, "img.JPG", MediaKindImage },
+    { nil, "clip.mts", MediaKindVideo },
+    { nil, "index.mpr", MediaKindIndex },
+    { nil, "notes.txt", "" },
+    { nil, "clip.webm", "" },
+    { nil, "scan.tiff", "" },
+    { []string{"webm", " TIFF"}, "clip.webm", MediaKindVideo },
+    { []string{"webm", " TIFF"}, "scan.tif", MediaKindImage },
+    { []string{"webm", " TIFF"}, "photo.heic", "" },
+    { []string{"nosuchtype"}, "img.jpg", MediaKindImage },
+  }
+  for _, tc := range testCases {
+    m := newMediaRegistry(tc.enabled)
+    kind := ""
+    if mt := m.lookup(tc.name); mt != nil {
+      kind = mt.Kind
+    }
+    if kind != tc.wantKind {
+      t.Errorf("lookup(%s) with %v: got %q, want %q", tc.name, tc.enabled, kind, tc.wantKind)
+    }
+  }
+
+  m := newMediaRegistry([]string{"mov"})
+  if got, want := strings.Join(m.extensions(MediaKindVideo), ","), ".mov,.mp4,.mpg,.mts"; got != want {
+    t.Errorf("Video extensions: got %s, want %s", got, want)
+  }
+  h := NewHandler(&Config{
+    ContentRoot: "testdata",
+    MediaTypes: []string{"mov"},
+  });
+  if !h.needsTranscode("clip.MOV") || h.needsTranscode("clip.mp4") {
+    t.Errorf("needsTranscode should be true only for mov")
+  }
+}
+
+func TestRegisterMediaType(t *testing.T) {
+  testDir := "testdata/tmp"
+  os.RemoveAll(testDir)
+  if err := os.MkdirAll(testDir, 0744); err != nil {
+    t.Fatalf("Unable to create test directory: %v", err)
+  }
+  defer os.RemoveAll(testDir)
+
+  // A made-up image format where the file holds the width and height.
+  defer func(types []*MediaType) { mediaTypes = types }(mediaTypes)
+  RegisterMediaType(&MediaType{
+    Name: "box",
+    Kind: MediaKindImage,
+    Extensions: []string{".box"},
+    Optional: true,
+    Decode: func(filePath string) (image.Image, int, error) {
+      b, err := ioutil.ReadFile(filePath)
+      if err != nil {
+        return nil, -1, err
+      }
+      var w, h int
+      if _, err := fmt.Sscanf(string(b), "%dx%d", &w, &h); err != nil {
+        return nil, -1, fmt.Errorf("not a box file: %v", err)
+      }
+      return image.NewNRGBA(image.Rect(0, 0, w, h)), -1, nil
+    },
+  })
+  if err := ioutil.WriteFile(testDir + "/a.box", []byte("30x20"), 0644); err != nil {
+    t.Fatalf("Unable to write test image: %v", err)
+  }
+
+  // Not listed unless it is enabled.
+  h := NewHandler(&Config{
+    ContentRoot: testDir,
+  });
+  list, err, _ := h.List("", ListOptions{})
+  if err != nil {
+    t.Fatalf("List failed: %v", err)
+  }
+  if got := len(list.Items); got != 0 {
+    t.Errorf("List without box type enabled: got %d items, want 0", got)
+  }
+
+  h = NewHandler(&Config{
+    ContentRoot: testDir,
+    MediaTypes: []string{"box"},
+  });
+  list, err, _ = h.List("", ListOptions{})
+  if err != nil {
+    t.Fatalf("List failed: %v", err)
+  }
+  if len(list.Items) != 1 || list.Items[0].Type != MediaKindImage {
+    t.Fatalf("List with box type enabled: got %+v, want one image", list.Items)
+  }
+  if r := h.catalogRecordForPath("a.box"); r == nil || r.Width != 30 || r.Height != 20 {
+    t.Errorf("Catalog record for box image: got %+v, want 30x20", r)
+  }
+  im, err, _ := h.Image("a.box", 15, 0, 0, ImageOptions{})
+  if err != nil {
+    t.Fatalf("Image of box file failed: %v", err)
+  }
+  if b := im.Bounds(); b.Dx() != 15 || b.Dy() != 10 {
+    t.Errorf("Image of box file: got %dx%d, want 15x10", b.Dx(), b.Dy())
+  }
+  if _, contentType, err, _ := h.ImageBytes("a.box", 0, 0, 0, ImageOptions{Format: ImageFormatOriginal}); err != nil || contentType != "image/jpeg" {
+    t.Errorf("ImageBytes of box file as original: got %s, %v, want image/jpeg", contentType, err)
+  }
+
+  if err, _ := h.Upload("", "b.box", strings.NewReader("4x3"), UploadOptions{}); err != nil {
+    t.Errorf("Upload of box file failed: %v", err)
+  }
+  if err, _ := h.Upload("", "c.box", strings.NewReader("square"), UploadOptions{}); err == nil {
+    t.Errorf("Upload of bad box file should fail")
+  }
+}
+
+func TestRegisterMediaTypeConcurrent(t *testing.T) {
+  defer func(types []*MediaType) { mediaTypes = types }(mediaTypes)
+  var wg sync.WaitGroup
+  for i := 0; i < 10; i++ {
+    wg.Add(2)
+    go func(i int) {
+      defer wg.Done()
+      RegisterMediaType(&MediaType{
+        Name: fmt.Sprintf("type%d", i),
+        Kind: MediaKindImage,
+        Extensions: []string{fmt.Sprintf(".t%d", i)},
+      })
+    }(i)
+    go func() {
+      defer wg.Done()
+      newMediaRegistry(nil)
+    }()
+  }
+  wg.Wait()
+  if got, want := len(newMediaRegistry(nil).extensions(MediaKindImage)), 14; got != want {
+    t.Errorf("image extensions after registering: got %d, want %d", got, want)
+  }
+}
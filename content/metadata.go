@@ -0,0 +1,253 @@
+package content
+
+import (
+  "bufio"
+  "bytes"
+  "encoding/binary"
+  "encoding/xml"
+  "fmt"
+  "io"
+  "io/ioutil"
+  "os"
+  "strings"
+  "unicode/utf8"
+)
+
+const (
+  xmpApp1Header = "http://ns.adobe.com/xap/1.0/\x00"
+  photoshopApp13Header = "Photoshop 3.0\x00"
+  iptcResourceId = 0x0404       // Photoshop image resource holding IPTC data
+  iptcKeywords = 25             // Dataset 2:25
+  iptcCaption = 120             // Dataset 2:120
+  // How far into a non-JPEG file we look for an XMP packet.
+  maxXmpScanBytes = 4 << 20
+
+  xmpDcNamespace = "http://purl.org/dc/elements/1.1/"
+  xmpRdfNamespace = "http://www.w3.org/1999/02/22-rdf-syntax-ns#"
+)
+
+// embeddedMetadata is the descriptive information that other programs,
+// such as photo organizers, store in image files as XMP or IPTC data.
+type embeddedMetadata struct {
+  Keywords []string
+  Caption string
+  CaptionSource string          // TextSourceXmp or TextSourceIptc
+}
+
+// readEmbeddedMetadata reads the XMP and IPTC data from an image file.
+// For JPEG files we look in the APP1 and APP13 segments; for other files,
+// including XMP sidecar files, we look for an XMP packet near the start
+// of the file. It is not an error for a file to have no metadata.
+func readEmbeddedMetadata(filePath string) (*embeddedMetadata, error) {
+  f, err := os.Open(filePath)
+  if err != nil {
+    return nil, err
+  }
+  defer f.Close()
+  md := &embeddedMetadata{}
+  r := bufio.NewReader(f)
+  if head, err := r.Peek(2); err == nil && head[0] == 0xFF && head[1] == 0xD8 {
+    return md, md.readJpegSegments(r)
+  }
+  b, err := ioutil.ReadAll(io.LimitReader(r, maxXmpScanBytes))
+  if err != nil {
+    return nil, err
+  }
+  if packet := findXmpPacket(b); packet != nil {
+    md.parseXmp(packet)
+  }
+  return md, nil
+}
+
+// readJpegSegments reads the segments before the image data, looking for
+// XMP and IPTC data.
+func (md *embeddedMetadata) readJpegSegments(r *bufio.Reader) error {
+  if _, err := r.Discard(2); err != nil {       // SOI
+    return err
+  }
+  for {
+    b, err := r.ReadByte()
+    if err != nil {
+      return fmt.Errorf("error reading JPEG segment: %v", err)
+    }
+    if b != 0xFF {
+      return fmt.Errorf("bad JPEG segment marker %#x", b)
+    }
+    marker, err := r.ReadByte()
+    for err == nil && marker == 0xFF {          // Fill bytes
+      marker, err = r.ReadByte()
+    }
+    if err != nil {
+      return fmt.Errorf("error reading JPEG segment: %v", err)
+    }
+    if marker == 0xDA || marker == 0xD9 {       // SOS or EOI
+      return nil
+    }
+    if marker == 0x01 || (marker >= 0xD0 && marker <= 0xD7) {
+      continue                                  // No length or data
+    }
+    var length uint16
+    if err := binary.Read(r, binary.BigEndian, &length); err != nil {
+      return fmt.Errorf("error reading JPEG segment length: %v", err)
+    }
+    if length < 2 {
+      return fmt.Errorf("bad JPEG segment length %d", length)
+    }
+    if marker != 0xE1 && marker != 0xED {
+      if _, err := r.Discard(int(length) - 2); err != nil {
+        return fmt.Errorf("error reading JPEG segment: %v", err)
+      }
+      continue
+    }
+    data := make([]byte, int(length) - 2)
+    if _, err := io.ReadFull(r, data); err != nil {
+      return fmt.Errorf("error reading JPEG segment: %v", err)
+    }
+    if marker == 0xE1 && bytes.HasPrefix(data, []byte(xmpApp1Header)) {
+      md.parseXmp(data[len(xmpApp1Header):])
+    } else if marker == 0xED && bytes.HasPrefix(data, []byte(photoshopApp13Header)) {
+      md.parsePhotoshopResources(data[len(photoshopApp13Header):])
+    }
+  }
+}
+
+// findXmpPacket returns the x:xmpmeta element from the data, or nil.
+func findXmpPacket(b []byte) []byte {
+  start := bytes.Index(b, []byte("<x:xmpmeta"))
+  if start < 0 {
+    return nil
+  }
+  endTag := []byte("</x:xmpmeta>")
+  end := bytes.Index(b[start:], endTag)
+  if end < 0 {
+    return nil
+  }
+  return b[start:start + end + len(endTag)]
+}
+
+// parseXmp collects the keywords and caption from an XMP packet. The
+// keywords are the rdf:li values in the dc:subject property, and the
+// caption is the dc:description, preferring the x-default language.
+// If the XML is bad, we keep whatever we got before the error.
+func (md *embeddedMetadata) parseXmp(packet []byte) {
+  d := xml.NewDecoder(bytes.NewReader(packet))
+  property := ""        // Local name of the dc property we are in
+  propertyDepth := 0
+  depth := 0
+  var li *strings.Builder
+  liLang := ""
+  for {
+    tok, err := d.Token()
+    if err != nil {
+      return
+    }
+    switch t := tok.(type) {
+    case xml.StartElement:
+      depth++
+      if property == "" && t.Name.Space == xmpDcNamespace && (t.Name.Local == "subject" || t.Name.Local == "description") {
+        property = t.Name.Local
+        propertyDepth = depth
+      } else if property != "" && t.Name.Space == xmpRdfNamespace && t.Name.Local == "li" {
+        li = &strings.Builder{}
+        liLang = ""
+        for _, attr := range t.Attr {
+          if attr.Name.Local == "lang" {
+            liLang = attr.Value
+          }
+        }
+      }
+    case xml.EndElement:
+      if li != nil && t.Name.Space == xmpRdfNamespace && t.Name.Local == "li" {
+        if property == "subject" {
+          md.addKeyword(li.String())
+        } else if text := strings.TrimSpace(li.String()); text != "" {
+          if md.CaptionSource != TextSourceXmp || liLang == "x-default" {
+            md.Caption = text
+            md.CaptionSource = TextSourceXmp
+          }
+        }
+        li = nil
+      }
+      if depth == propertyDepth {
+        property = ""
+        propertyDepth = 0
+      }
+      depth--
+    case xml.CharData:
+      if li != nil {
+        li.Write(t)
+      }
+    }
+  }
+}
+
+// parsePhotoshopResources looks for IPTC data in the Photoshop image
+// resource blocks from an APP13 segment.
+func (md *embeddedMetadata) parsePhotoshopResources(b []byte) {
+  for len(b) >= 12 && string(b[:4]) == "8BIM" {
+    id := binary.BigEndian.Uint16(b[4:6])
+    // The name is a Pascal string padded to an even length.
+    n := 6 + ((1 + int(b[6]) + 1) &^ 1)
+    if len(b) < n + 4 {
+      return
+    }
+    size := int(binary.BigEndian.Uint32(b[n:n + 4]))
+    n += 4
+    if size < 0 || len(b) < n + size {
+      return
+    }
+    if id == iptcResourceId {
+      md.parseIptc(b[n:n + size])
+    }
+    n += (size + 1) &^ 1
+    if n > len(b) {
+      return
+    }
+    b = b[n:]
+  }
+}
+
+// parseIptc collects the keywords and caption from IPTC-IIM data sets.
+// If there is also an XMP caption, we use that one.
+func (md *embeddedMetadata) parseIptc(b []byte) {
+  for len(b) >= 5 && b[0] == 0x1C {
+    record, dataset := b[1], b[2]
+    size := int(binary.BigEndian.Uint16(b[3:5]))
+    if size & 0x8000 != 0 {
+      return    // Extended data sets are never used for text.
+    }
+    if len(b) < 5 + size {
+      return
+    }
+    if record == 2 && dataset == iptcKeywords {
+      md.addKeyword(iptcString(b[5:5 + size]))
+    }
+    if record == 2 && dataset == iptcCaption && md.CaptionSource == "" {
+      if text := strings.TrimSpace(iptcString(b[5:5 + size])); text != "" {
+        md.Caption = text
+        md.CaptionSource = TextSourceIptc
+      }
+    }
+    b = b[5 + size:]
+  }
+}
+
+func (md *embeddedMetadata) addKeyword(keyword string) {
+  keyword = strings.TrimSpace(keyword)
+  if keyword != "" {
+    md.Keywords = append(md.Keywords, keyword)
+  }
+}
+
+// iptcString converts IPTC text to a string. Most newer files use UTF-8;
+// older ones are usually Latin-1.
+func iptcString(b []byte) string {
+  if utf8.Valid(b) {
+    return string(b)
+  }
+  runes := make([]rune, len(b))
+  for i, c := range b {
+    runes[i] = rune(c)
+  }
+  return string(runes)
+}
@@ -0,0 +1,193 @@
+package content
+
+import (
+  "fmt"
+  "image"
+  "io/ioutil"
+  "log"
+  "math"
+  "os"
+  "os/exec"
+  "path/filepath"
+  "strconv"
+  "strings"
+)
+
+const (
+  posterAttribute = "poster"
+  posterNone = "none"   // Only used when setting; not stored
+  posterExtension = ".jpg"
+  // Where we take the poster frame if none has been chosen, as a fraction
+  // of the duration. The first frame is often black.
+  defaultPosterFraction = 0.1
+)
+
+// parsePosterTime parses the time for a poster frame, which is either
+// a number of seconds, such as "12.5", or a time such as "1:02.5" or
+// "0:01:02.5".
+func parsePosterTime(value string) (float64, error) {
+  value = strings.TrimSpace(value)
+  parts := strings.Split(value, ":")
+  if len(parts) > 3 {
+    return 0, fmt.Errorf("poster time must be seconds or [hh:]mm:ss")
+  }
+  seconds := 0.0
+  for _, part := range parts {
+    n, err := strconv.ParseFloat(part, 64)
+    if err != nil || math.IsNaN(n) || math.IsInf(n, 0) || n < 0 {
+      return 0, fmt.Errorf("poster time must be seconds or [hh:]mm:ss")
+    }
+    seconds = seconds * 60 + n
+  }
+  return seconds, nil
+}
+
+// formatPosterTime returns the poster time in the form we store it,
+// in seconds to the millisecond.
+func formatPosterTime(seconds float64) string {
+  return strconv.FormatFloat(math.Round(seconds * 1000) / 1000, 'f', -1, 64)
+}
+
+// posterFramePath returns the path to the cached poster frame for the
+// video. The name includes the chosen time, if any, so that we don't use
+// the old frame after the time is changed.
+func (h *Handler) posterFramePath(path string, posterTime string) string {
+  inputFilePath := fmt.Sprintf("%s/%s", h.config.ContentRoot, path)
+  dir, filename := filepath.Split(inputFilePath)
+  if posterTime != "" {
+    filename = filename + ".poster-" + posterTime
+  } else {
+    filename = filename + ".poster"
+  }
+  return dir + cacheDir + filename + posterExtension
+}
+
+// removePosterFrames removes the cached poster frames for the video,
+// except for the one at keepPath.
+func (h *Handler) removePosterFrames(path string, keepPath string) {
+  inputFilePath := fmt.Sprintf("%s/%s", h.config.ContentRoot, path)
+  dir, filename := filepath.Split(inputFilePath)
+  files, err := ioutil.ReadDir(dir + cacheDir)
+  if err != nil {
+    return
+  }
+  for _, f := range files {
+    name := f.Name()
+    if !strings.HasPrefix(name, filename + ".poster") || !strings.HasSuffix(name, posterExtension) {
+      continue
+    }
+    if p := dir + cacheDir + name; p != keepPath {
+      os.Remove(p)
+    }
+  }
+}
+
+// posterFrame returns the poster frame for the video: the frame at the
+// time chosen with the poster action, or a little way into the video if
+// none has been chosen. We extract the frame once and save it in the
+// cache directory next to the video.
+func (h *Handler) posterFrame(path string) (image.Image, error) {
+  videoFilePath := fmt.Sprintf("%s/%s", h.config.ContentRoot, path)
+  // The index file may have been edited by hand, so we don't trust the
+  // value to be safe to put in the file name.
+  posterTime := ""
+  seconds, err := parsePosterTime(h.indexEntryForImage(videoFilePath).attribute(posterAttribute))
+  if err == nil {
+    posterTime = formatPosterTime(seconds)
+  }
+  posterPath := h.posterFramePath(path, posterTime)
+  if pf, err := os.Stat(posterPath); err == nil {
+    if vf, err := os.Stat(videoFilePath); err == nil && !pf.ModTime().Before(vf.ModTime()) {
+      if im, err := decodeImageFile(posterPath); err == nil {
+        return im, nil
+      }
+    }
+  }
+
+  if posterTime == "" {
+    seconds = 0
+    if r := h.catalogRecordForPath(path); r != nil && r.Video != nil && r.Video.Duration > 0 {
+      seconds = r.Video.Duration * defaultPosterFraction
+    } else if duration, ok := videoDuration(videoFilePath); ok {
+      seconds = duration * defaultPosterFraction
+    }
+  }
+  posterDir := filepath.Dir(posterPath)
+  if err := os.MkdirAll(posterDir, 0700); err != nil {
+    return nil, err
+  }
+  tmp, err := ioutil.TempFile(posterDir, "poster")
+  if err != nil {
+    return nil, err
+  }
+  tmpPath := tmp.Name()
+  tmp.Close()
+  defer os.Remove(tmpPath)
+  err = extractVideoFrame(videoFilePath, seconds, tmpPath)
+  if err != nil && seconds > 0 {
+    // The chosen time may be past the end of the video.
+    log.Printf("No frame at %v in video file %s, using the first frame: %v", seconds, path, err)
+    err = extractVideoFrame(videoFilePath, 0, tmpPath)
+  }
+  if err != nil {
+    return nil, err
+  }
+  im, err := decodeImageFile(tmpPath)
+  if err != nil {
+    return nil, fmt.Errorf("failed to decode frame from video file %v: %v", path, err)
+  }
+  if err := os.Rename(tmpPath, posterPath); err != nil {
+    log.Printf("Error caching poster frame for %s: %v", path, err)
+  }
+  h.removePosterFrames(path, posterPath)
+  return im, nil
+}
+
+// extractVideoFrame writes the frame at the time in the video as a JPEG file.
+func extractVideoFrame(videoFilePath string, seconds float64, outputPath string) error {
+  cmd := exec.Command(ffmpegCommand,
+      "-y",
+      "-ss", strconv.FormatFloat(seconds, 'f', 3, 64),
+      "-i", videoFilePath,
+      "-frames:v", "1",
+      "-q:v", "2",
+      "-f", "mjpeg",
+      outputPath)
+  if out, err := cmd.CombinedOutput(); err != nil {
+    return fmt.Errorf("Error extracting image from video file %v: %v: %s", videoFilePath, err, lastLine(out))
+  }
+  if f, err := os.Stat(outputPath); err != nil || f.Size() == 0 {
+    return fmt.Errorf("no frame at %v in video file %v", seconds, videoFilePath)
+  }
+  return nil
+}
+
+// videoDuration returns the duration of the video in seconds, from the
+// information ffmpeg prints about its input. The bool is false if we
+// can't get the duration.
+func videoDuration(videoFilePath string) (float64, bool) {
+  // Without an output file, ffmpeg prints the information and fails.
+  out, _ := exec.Command(ffmpegCommand, "-i", videoFilePath).CombinedOutput()
+  for _, line := range strings.Split(string(out), "\n") {
+    if d, ok := ffmpegDuration(strings.TrimSpace(line)); ok {
+      return d, true
+    }
+  }
+  return 0, false
+}
+
+func decodeImageFile(filePath string) (image.Image, error) {
+  f, err := os.Open(filePath)
+  if err != nil {
+    return nil, err
+  }
+  defer f.Close()
+  im, _, err := image.Decode(f)
+  return im, err
+}
+
+// lastLine returns the last non-empty line of the output.
+func lastLine(out []byte) string {
+  lines := strings.Split(strings.TrimSpace(string(out)), "\n")
+  return lines[len(lines) - 1]
+}
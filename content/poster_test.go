@@ -0,0 +1,169 @@
+package content
+
+import (
+  "io/ioutil"
+  "os"
+  "strings"
+  "testing"
+)
+
+func TestParsePosterTime(t *testing.T) {
+  testCases := []struct{
+    value string
+    want string          // Empty if the value is not valid
+  }{
+    { "12.5", "12.5" },
+    { "1:02.25", "62.25" },
+    { "1:00:00", "3600" },
+    { " 3 ", "3" },
+    { "0.0004", "0" },
+    { "-1", "" },
+    { "1:2:3:4", "" },
+    { "abc", "" },
+    { "", "" },
+  }
+  for _, tc := range testCases {
+    seconds, err := parsePosterTime(tc.value)
+    if tc.want == "" {
+      if err == nil {
+        t.Errorf("parsePosterTime(%q) should fail", tc.value)
+      }
+      continue
+    }
+    if err != nil {
+      t.Errorf("parsePosterTime(%q) failed: %v", tc.value, err)
+      continue
+    }
+    if got := formatPosterTime(seconds); got != tc.want {
+      t.Errorf("parsePosterTime(%q): got %s, want %s", tc.value, got, tc.want)
+    }
+  }
+}
+
+func TestPosterFrame(t *testing.T) {
+  testDir := "testdata/tmp"
+  os.RemoveAll(testDir)
+  if err := os.MkdirAll(testDir, 0744); err != nil {
+    t.Fatalf("Unable to create test directory: %v", err)
+  }
+  defer os.RemoveAll(testDir)
+
+  // Rather than running ffmpeg, log the arguments and copy a JPEG file to
+  // the output. Given only an input, ffmpeg prints its duration and fails.
+  fakeFfmpeg := `#!/bin/sh
+echo "$*" >> testdata/tmp/ffmpeg.log
+if [ $# -eq 2 ]; then
+  echo "  Duration: 00:00:10.00, start: 0.000000, bitrate: 100 kb/s" >&2
+  exit 1
+fi
+for last; do :; done
+cp testdata/tmp/frame.jpg "$last"
+`
+  if err := ioutil.WriteFile(testDir + "/ffmpeg", []byte(fakeFfmpeg), 0755); err != nil {
+    t.Fatalf("Unable to write test script: %v", err)
+  }
+  defer func(command string) { ffmpegCommand = command }(ffmpegCommand)
+  ffmpegCommand = testDir + "/ffmpeg"
+  if err := writeTestJpeg(testDir + "/frame.jpg", 20, 10); err != nil {
+    t.Fatalf("Unable to write test image: %v", err)
+  }
+  if err := ioutil.WriteFile(testDir + "/clip.mp4", []byte("not really a video"), 0644); err != nil {
+    t.Fatalf("Unable to write test video: %v", err)
+  }
+  ffmpegRuns := func() []string {
+    b, _ := ioutil.ReadFile(testDir + "/ffmpeg.log")
+    return strings.Split(strings.TrimSpace(string(b)), "\n")
+  }
+
+  h := NewHandler(&Config{
+    ContentRoot: testDir,
+  });
+  im, err, _ := h.Image("clip.mp4", 0, 0, 0, ImageOptions{})
+  if err != nil {
+    t.Fatalf("Image of video failed: %v", err)
+  }
+  if b := im.Bounds(); b.Dx() != 20 || b.Dy() != 10 {
+    t.Errorf("Image of video size: got %dx%d, want 20x10", b.Dx(), b.Dy())
+  }
+  runs := ffmpegRuns()
+  if got, want := runs[len(runs) - 1], "-ss 1.000 "; !strings.Contains(got, want) {
+    t.Errorf("Default poster frame: got ffmpeg %q, want %q", got, want)
+  }
+  defaultPosterPath := h.posterFramePath("clip.mp4", "")
+  if _, err := os.Stat(defaultPosterPath); err != nil {
+    t.Errorf("Poster frame was not cached: %v", err)
+  }
+  // The second time, we use the cached frame.
+  if _, err, _ := h.Image("clip.mp4", 10, 10, 0, ImageOptions{}); err != nil {
+    t.Fatalf("Image of video failed: %v", err)
+  }
+  if got, want := len(ffmpegRuns()), len(runs); got != want {
+    t.Errorf("Number of ffmpeg runs: got %d, want %d", got, want)
+  }
+
+  command := UpdateCommand{Item: "clip.mp4", Action: "poster", Value: "0:03.5", Autocreate: true}
+  if err, _ := h.UpdateImageIndex("index.mpr", command); err != nil {
+    t.Fatalf("Failed to set poster: %v", err)
+  }
+  if got, want := h.indexEntryStringForImage(testDir + "/clip.mp4"), "clip.mp4;xo;poster=3.5"; got != want {
+    t.Errorf("Index entry after poster: got %q, want %q", got, want)
+  }
+  if _, err, _ := h.Image("clip.mp4", 0, 0, 0, ImageOptions{}); err != nil {
+    t.Fatalf("Image of video failed: %v", err)
+  }
+  runs = ffmpegRuns()
+  if got, want := runs[len(runs) - 1], "-ss 3.500 "; !strings.Contains(got, want) {
+    t.Errorf("Chosen poster frame: got ffmpeg %q, want %q", got, want)
+  }
+  if _, err := os.Stat(h.posterFramePath("clip.mp4", "3.5")); err != nil {
+    t.Errorf("Chosen poster frame was not cached: %v", err)
+  }
+  if _, err := os.Stat(defaultPosterPath); !os.IsNotExist(err) {
+    t.Errorf("Old poster frame was not removed: %v", err)
+  }
+
+  badCommands := []UpdateCommand{
+    {Item: "clip.mp4", Action: "poster", Value: "soon"},
+    {Item: "clip.mp4", Action: "poster", Value: ""},
+    {Item: "frame.jpg", Action: "poster", Value: "1"},
+  }
+  for _, command := range badCommands {
+    if err, _ := h.UpdateImageIndex("index.mpr", command); err == nil {
+      t.Errorf("UpdateImageIndex(%+v) should fail", command)
+    }
+  }
+  command = UpdateCommand{Item: "clip.mp4", Action: "poster", Value: posterNone}
+  if err, _ := h.UpdateImageIndex("index.mpr", command); err != nil {
+    t.Fatalf("Failed to clear poster: %v", err)
+  }
+  if got, want := h.indexEntryStringForImage(testDir + "/clip.mp4"), "clip.mp4;xo"; got != want {
+    t.Errorf("Index entry after clearing poster: got %q, want %q", got, want)
+  }
+
+  // A poster time edited by hand in the index file must not put the
+  // poster frame outside the cache directory.
+  setPosterByHand := func(value string) {
+    b, err := ioutil.ReadFile(testDir + "/index.mpr")
+    if err != nil {
+      t.Fatalf("Unable to read index file: %v", err)
+    }
+    index := strings.Replace(string(b), "clip.mp4;xo", "clip.mp4;xo;poster=" + value, 1)
+    if err := ioutil.WriteFile(testDir + "/index.mpr", []byte(index), 0644); err != nil {
+      t.Fatalf("Unable to write index file: %v", err)
+    }
+  }
+  setPosterByHand("../../../x")
+  if _, err := h.posterFrame("clip.mp4"); err != nil {
+    t.Fatalf("posterFrame with bad poster time failed: %v", err)
+  }
+  if _, err := os.Stat(defaultPosterPath); err != nil {
+    t.Errorf("Bad poster time should use the default poster frame: %v", err)
+  }
+  setPosterByHand("0:02.50")
+  if _, err := h.posterFrame("clip.mp4"); err != nil {
+    t.Fatalf("posterFrame with hand-edited poster time failed: %v", err)
+  }
+  if _, err := os.Stat(h.posterFramePath("clip.mp4", "2.5")); err != nil {
+    t.Errorf("Hand-edited poster time should be normalized: %v", err)
+  }
+}
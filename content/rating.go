@@ -0,0 +1,68 @@
+package content
+
+import (
+  "fmt"
+  "strconv"
+)
+
+const (
+  maxRating = 5
+  ratingAttribute = "rating"
+  flagAttribute = "flag"
+
+  // Values for the flag on an image, used while culling.
+  FlagPick = "pick"
+  FlagReject = "reject"
+  FlagNone = "none"     // Only used when setting or filtering; not stored
+)
+
+func validFlag(flag string) bool {
+  return flag == FlagPick || flag == FlagReject || flag == FlagNone
+}
+
+// checkListFilter returns an error if the filter options are not valid.
+func checkListFilter(options ListOptions) error {
+  if options.MinRating < 0 || options.MinRating > maxRating {
+    return fmt.Errorf("minRating must be from 0 to %d", maxRating)
+  }
+  if options.Flag != "" && !validFlag(options.Flag) {
+    return fmt.Errorf("flag must be %s, %s or %s", FlagPick, FlagReject, FlagNone)
+  }
+  return nil
+}
+
+// setIndexEntry sets the fields of the item that come from its index entry.
+func (item *ListItem) setIndexEntry(entry *imageEntry) {
+  item.Attributes = entry.attributeMap()
+  item.Rating, _ = strconv.Atoi(entry.attribute(ratingAttribute))
+  item.Flag = entry.attribute(flagAttribute)
+}
+
+// filterListItems returns the items that pass the rating and flag filters
+// in the options. Directories are always included.
+func filterListItems(items []ListItem, options ListOptions) []ListItem {
+  if options.MinRating == 0 && options.Flag == "" {
+    return items
+  }
+  filtered := make([]ListItem, 0, len(items))
+  for _, item := range items {
+    if item.IsDir {
+      filtered = append(filtered, item)
+      continue
+    }
+    if item.Rating < options.MinRating {
+      continue
+    }
+    if options.Flag != "" {
+      flag := item.Flag
+      if flag == "" {
+        flag = FlagNone
+      }
+      if flag != options.Flag {
+        continue
+      }
+    }
+    filtered = append(filtered, item)
+  }
+  return filtered
+}
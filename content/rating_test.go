@@ -0,0 +1,98 @@
+package content
+
+import (
+  "io/ioutil"
+  "net/http"
+  "os"
+  "strings"
+  "testing"
+)
+
+func TestRatingAndFlag(t *testing.T) {
+  testDir := "testdata/tmp"
+  os.RemoveAll(testDir)
+  if err := os.MkdirAll(testDir + "/sub", 0744); err != nil {
+    t.Fatalf("Unable to create test directory: %v", err)
+  }
+  defer os.RemoveAll(testDir)
+  for _, fn := range []string{"img1.jpg", "img2.jpg", "img3.jpg", "img4.jpg"} {
+    if err := ioutil.WriteFile(testDir + "/" + fn, []byte{}, 0644); err != nil {
+      t.Fatalf("Unable to create test file: %v", err)
+    }
+  }
+  h := NewHandler(&Config{
+    ContentRoot: testDir,
+  });
+
+  commands := []UpdateCommand{
+    {Item: "img1.jpg", Action: "rating", Value: "5", Autocreate: true},
+    {Item: "img2.jpg", Action: "rating", Value: "3"},
+    {Item: "img3.jpg", Action: "rating", Value: "1"},
+    {Item: "img1.jpg", Action: "flag", Value: "pick"},
+    {Item: "img3.jpg", Action: "flag", Value: "reject"},
+    {Item: "img4.jpg", Action: "flag", Value: "reject"},
+    {Item: "img4.jpg", Action: "flag", Value: "none"},
+  }
+  if err, _ := h.UpdateImageIndexBatch("index.mpr", commands); err != nil {
+    t.Fatalf("failed to set ratings: %v", err)
+  }
+
+  badCommands := []UpdateCommand{
+    {Item: "img1.jpg", Action: "rating", Value: "6"},
+    {Item: "img1.jpg", Action: "rating", Value: "-1"},
+    {Item: "img1.jpg", Action: "rating", Value: "x"},
+    {Item: "img1.jpg", Action: "flag", Value: "maybe"},
+  }
+  for _, command := range badCommands {
+    if err, _ := h.UpdateImageIndex("index.mpr", command); err == nil {
+      t.Errorf("%s with value %s should fail", command.Action, command.Value)
+    }
+  }
+
+  testCases := []struct{
+    options ListOptions
+    want string
+  }{
+    { ListOptions{}, "img1.jpg:5:pick,img2.jpg:3:,img3.jpg:1:reject,img4.jpg:0:,sub" },
+    { ListOptions{MinRating: 3}, "img1.jpg:5:pick,img2.jpg:3:,sub" },
+    { ListOptions{Flag: FlagPick}, "img1.jpg:5:pick,sub" },
+    { ListOptions{Flag: FlagNone}, "img2.jpg:3:,img4.jpg:0:,sub" },
+    { ListOptions{MinRating: 1, Flag: FlagReject}, "img3.jpg:1:reject,sub" },
+  }
+  for _, tc := range testCases {
+    list, err, _ := h.List("", tc.options)
+    if err != nil {
+      t.Fatalf("failed to list with %v: %v", tc.options, err)
+    }
+    if got, want := ratedItemsString(list.Items), tc.want; got != want {
+      t.Errorf("list with %v: got %s, want %s", tc.options, got, want)
+    }
+  }
+
+  list, err, _ := h.ListFromIndex("index.mpr", ListOptions{MinRating: 2})
+  if err != nil {
+    t.Fatalf("failed to list from index: %v", err)
+  }
+  if got, want := ratedItemsString(list.Items), "img1.jpg:5:pick,img2.jpg:3:,sub"; got != want {
+    t.Errorf("list from index with minRating: got %s, want %s", got, want)
+  }
+
+  if _, _, status := h.List("", ListOptions{MinRating: 6}); status != http.StatusBadRequest {
+    t.Errorf("list with bad minRating: got status %d, want %d", status, http.StatusBadRequest)
+  }
+  if _, _, status := h.List("", ListOptions{Flag: "maybe"}); status != http.StatusBadRequest {
+    t.Errorf("list with bad flag: got status %d, want %d", status, http.StatusBadRequest)
+  }
+}
+
+func ratedItemsString(items []ListItem) string {
+  s := make([]string, len(items))
+  for i, item := range items {
+    if item.IsDir {
+      s[i] = item.Name
+    } else {
+      s[i] = strings.Join([]string{item.Name, string('0' + rune(item.Rating)), item.Flag}, ":")
+    }
+  }
+  return strings.Join(s, ",")
+}
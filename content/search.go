@@ -0,0 +1,258 @@
+package content
+
+import (
+  "fmt"
+  "io/ioutil"
+  "log"
+  "net/http"
+  "os"
+  "path"
+  "path/filepath"
+  "sort"
+  "strings"
+  "sync"
+  "unicode"
+)
+
+// searchIndex is an inverted index of the words in all of the caption text
+// files (image.txt and summary.txt) under the content root, and in the
+// captions of media files that have no text file, from their XMP sidecar
+// files or their own metadata. It is built the first time someone searches,
+// and after that it is updated as text files are written and catalog
+// records are updated, so that we don't have to rescan the whole tree.
+type searchIndex struct {
+  root string
+  // captionFor returns the caption to index for a media file that doesn't
+  // come from its text file, or the empty string if there is none.
+  captionFor func(apiPath, filePath string, f os.FileInfo) string
+
+  mu sync.Mutex
+  built bool
+  docs map[string]map[string]struct{}  // text or media file api path -> words in it
+  words map[string]map[string]struct{} // word -> api paths of text or media files
+}
+
+func newSearchIndex(root string, captionFor func(apiPath, filePath string, f os.FileInfo) string) *searchIndex {
+  return &searchIndex{
+    root: root,
+    captionFor: captionFor,
+  }
+}
+
+// Search returns a list of the items under the specified directory whose
+// caption text contains all of the words in the query. A query word
+// matches any word in the text that starts with it, ignoring case.
+func (h *Handler) Search(dirApiPath, query string) (*ListResult, error, int) {
+  terms := searchWords(query)
+  if len(terms) == 0 {
+    return nil, fmt.Errorf("no search terms given"), http.StatusBadRequest
+  }
+  dirApiPath = cleanApiPath(dirApiPath)
+  textPaths := h.searchIndex.search(terms)
+
+  apiPaths := make([]string, 0, len(textPaths))
+  for _, textPath := range textPaths {
+    if dirApiPath != "" && !strings.HasPrefix(textPath, dirApiPath + "/") {
+      continue
+    }
+    itemApiPath := textPath
+    if !h.isMediaFile(textPath) {
+      itemApiPath = h.itemForSidecarFile(textPath)
+    }
+    if itemApiPath == "" {
+      continue          // A text file with no image, so nothing to show.
+    }
+    apiPaths = append(apiPaths, itemApiPath)
+  }
+  return &ListResult{
+    Items: h.apiPathsToListItems(apiPaths, ListOptions{}),
+  }, nil, 0
+}
+
+// itemForSidecarFile returns the api path of the directory or media file
+// that the specified text, tags or XMP file belongs to, or the empty string
+// if there is no such item.
+func (h *Handler) itemForSidecarFile(sidecarApiPath string) string {
+  dir, name := path.Split(sidecarApiPath)
+  dir = strings.TrimSuffix(dir, "/")
+  base := strings.TrimSuffix(name, path.Ext(name))
+  if base == "summary" {
+    return dir
+  }
+  contentRoot := strings.TrimSuffix(h.config.ContentRoot, "/")
+  if h.isMediaFile(base) {
+    // An XMP sidecar named for the whole file name, such as img.jpg.xmp.
+    if _, err := os.Stat(path.Join(contentRoot, dir, base)); err == nil {
+      return path.Join(dir, base)
+    }
+  }
+  for _, ext := range h.media.extensions(MediaKindImage, MediaKindVideo) {
+    for _, e := range []string{ext, strings.ToUpper(ext)} {
+      itemApiPath := path.Join(dir, base + e)
+      if _, err := os.Stat(path.Join(contentRoot, itemApiPath)); err == nil {
+        return itemApiPath
+      }
+    }
+  }
+  return ""
+}
+
+// searchCaption returns the caption from the catalog record to put in the
+// search index for the media file. Captions from text files are indexed
+// with the text files, so we don't index them again here.
+func searchCaption(r *catalogRecord) string {
+  if r == nil || r.TextSource == TextSourceTxt {
+    return ""
+  }
+  return r.Text
+}
+
+// searchCaptionForFile returns the caption to index for the media file.
+// We don't use catalogRecordForFile, which updates the search index.
+func (h *Handler) searchCaptionForFile(apiPath, filePath string, f os.FileInfo) string {
+  if !h.isMediaFile(filePath) {
+    return ""
+  }
+  r, _ := h.loadCatalogRecord(apiPath, filePath, f)
+  return searchCaption(r)
+}
+
+// updateText updates the index for a text file that has been written, or
+// for the caption of a media file. An empty text means the file has been
+// deleted or no longer has a caption.
+func (x *searchIndex) updateText(textApiPath, text string) {
+  x.mu.Lock()
+  defer x.mu.Unlock()
+  if !x.built {
+    return      // We will pick up the change when we build the index.
+  }
+  x.removeDoc(cleanApiPath(textApiPath))
+  if text != "" {
+    x.addDoc(cleanApiPath(textApiPath), text)
+  }
+}
+
+// search returns the api paths of all the text files that contain all
+// of the given terms, sorted by path.
+func (x *searchIndex) search(terms []string) []string {
+  x.mu.Lock()
+  defer x.mu.Unlock()
+  x.build()
+  var matches map[string]struct{}
+  for _, term := range terms {
+    termMatches := make(map[string]struct{})
+    for word, docs := range x.words {
+      if strings.HasPrefix(word, term) {
+        for doc := range docs {
+          termMatches[doc] = struct{}{}
+        }
+      }
+    }
+    if matches == nil {
+      matches = termMatches
+    } else {
+      for doc := range matches {
+        if _, ok := termMatches[doc]; !ok {
+          delete(matches, doc)
+        }
+      }
+    }
+  }
+  result := make([]string, 0, len(matches))
+  for doc := range matches {
+    result = append(result, doc)
+  }
+  sort.Strings(result)
+  return result
+}
+
+// build reads all of the text files under our root directory into the
+// index, if we have not already done so. The caller must hold x.mu.
+func (x *searchIndex) build() {
+  if x.built {
+    return
+  }
+  x.docs = make(map[string]map[string]struct{})
+  x.words = make(map[string]map[string]struct{})
+  root := filepath.Clean(x.root)
+  filepath.Walk(root, func(p string, f os.FileInfo, err error) error {
+    if err != nil {
+      log.Printf("Error scanning %s for search index: %v", p, err)
+      return nil
+    }
+    if f.IsDir() {
+      // Skip hidden dirs, in particular our cache dir.
+      if p != root && strings.HasPrefix(f.Name(), ".") {
+        return filepath.SkipDir
+      }
+      return nil
+    }
+    rel, err := filepath.Rel(root, p)
+    if err != nil {
+      return nil
+    }
+    if filepath.Ext(p) != textExtension {
+      if caption := x.captionFor(filepath.ToSlash(rel), p, f); caption != "" {
+        x.addDoc(filepath.ToSlash(rel), caption)
+      }
+      return nil
+    }
+    b, err := ioutil.ReadFile(p)
+    if err != nil {
+      log.Printf("Error reading %s for search index: %v", p, err)
+      return nil
+    }
+    x.addDoc(filepath.ToSlash(rel), string(b))
+    return nil
+  })
+  x.built = true
+  log.Printf("Search index built with %d captions and %d words", len(x.docs), len(x.words))
+}
+
+// addDoc adds the words in text to the index. The caller must hold x.mu.
+func (x *searchIndex) addDoc(textApiPath, text string) {
+  docWords := make(map[string]struct{})
+  for _, word := range searchWords(text) {
+    docWords[word] = struct{}{}
+    docs, ok := x.words[word]
+    if !ok {
+      docs = make(map[string]struct{})
+      x.words[word] = docs
+    }
+    docs[textApiPath] = struct{}{}
+  }
+  x.docs[textApiPath] = docWords
+}
+
+// removeDoc removes a text file from the index. The caller must hold x.mu.
+func (x *searchIndex) removeDoc(textApiPath string) {
+  for word := range x.docs[textApiPath] {
+    docs := x.words[word]
+    delete(docs, textApiPath)
+    if len(docs) == 0 {
+      delete(x.words, word)
+    }
+  }
+  delete(x.docs, textApiPath)
+}
+
+// searchWords splits text into lower-case words made of letters and digits.
+// Directive lines in summary files (starting with !) are skipped.
+func searchWords(text string) []string {
+  words := make([]string, 0)
+  for _, line := range strings.Split(text, "\n") {
+    if strings.HasPrefix(line, "!") {
+      continue
+    }
+    words = append(words, strings.FieldsFunc(strings.ToLower(line), func(c rune) bool {
+      return !unicode.IsLetter(c) && !unicode.IsDigit(c)
+    })...)
+  }
+  return words
+}
+
+// cleanApiPath returns the canonical form of an api path: cleaned,
+// with no leading or trailing slash. The root is the empty string.
+func cleanApiPath(apiPath string) string {
+  return strings.TrimPrefix(path.Clean("/" + apiPath), "/")
+}
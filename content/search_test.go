@@ -0,0 +1,172 @@
+package content
+
+import (
+  "io/ioutil"
+  "os"
+  "strings"
+  "testing"
+)
+
+func TestSearch(t *testing.T) {
+  h := NewHandler(&Config{
+    ContentRoot: "testdata",
+  });
+
+  _, err, _ := h.Search("", "  ")
+  if err == nil {
+    t.Errorf("search with no terms should fail")
+  }
+
+  list, err, _ := h.Search("", "SAMP")
+  if err != nil {
+    t.Fatalf("search failed: %v", err)
+  }
+  if got, want := len(list.Items), 1; got != want {
+    t.Fatalf("search result count: got %d, want %d", got, want)
+  }
+  if got, want := list.Items[0].Path, "/d1/image1.jpg"; got != want {
+    t.Errorf("search result path: got %s, want %s", got, want)
+  }
+  if got, want := list.Items[0].Text, "sample1\n"; got != want {
+    t.Errorf("search result text: got %s, want %s", got, want)
+  }
+
+  list, err, _ = h.Search("with-index", "sample1")
+  if err != nil {
+    t.Fatalf("search in with-index failed: %v", err)
+  }
+  if got, want := len(list.Items), 0; got != want {
+    t.Errorf("search result count in with-index: got %d, want %d", got, want)
+  }
+}
+
+func TestSearchAfterPutText(t *testing.T) {
+  testDir := "testdata/tmp"
+  os.RemoveAll(testDir)
+  if err := os.MkdirAll(testDir + "/sub", 0744); err != nil {
+    t.Fatalf("Unable to create test directory: %v", err)
+  }
+  defer os.RemoveAll(testDir)
+  for _, fn := range []string{"img1.jpg", "img2.jpg"} {
+    f, err := os.Create(testDir + "/sub/" + fn)
+    if err != nil {
+      t.Fatalf("Unable to create test file: %v", err)
+    }
+    f.Close()
+  }
+
+  h := NewHandler(&Config{
+    ContentRoot: testDir,
+  });
+  if err, _ := h.PutText("sub/img1.txt", UpdateTextCommand{Content: "Grandma's 80th birthday"}); err != nil {
+    t.Fatalf("failed to write text: %v", err)
+  }
+
+  list, err, _ := h.Search("", "grandma 80th")
+  if err != nil {
+    t.Fatalf("search failed: %v", err)
+  }
+  if got, want := len(list.Items), 1; got != want {
+    t.Fatalf("search result count: got %d, want %d", got, want)
+  }
+  if got, want := list.Items[0].Path, "/sub/img1.jpg"; got != want {
+    t.Errorf("search result path: got %s, want %s", got, want)
+  }
+
+  // Now that the index is built, it should see updates.
+  if err, _ := h.PutText("sub/img2.txt", UpdateTextCommand{Content: "Grandma at the beach"}); err != nil {
+    t.Fatalf("failed to write text: %v", err)
+  }
+  if err, _ := h.PutText("sub/summary.txt", UpdateTextCommand{Content: "Visiting grandma"}); err != nil {
+    t.Fatalf("failed to write summary: %v", err)
+  }
+  list, err, _ = h.Search("", "grandma")
+  if err != nil {
+    t.Fatalf("search failed: %v", err)
+  }
+  if got, want := len(list.Items), 3; got != want {
+    t.Fatalf("search result count after update: got %d, want %d", got, want)
+  }
+  if got, want := list.Items[2].Path, "/sub"; got != want {
+    t.Errorf("summary search result path: got %s, want %s", got, want)
+  }
+  if !list.Items[2].IsDir {
+    t.Errorf("summary search result should be a directory")
+  }
+
+  if err, _ := h.PutText("sub/img1.txt", UpdateTextCommand{Content: ""}); err != nil {
+    t.Fatalf("failed to delete text: %v", err)
+  }
+  list, err, _ = h.Search("", "80th")
+  if err != nil {
+    t.Fatalf("search failed: %v", err)
+  }
+  if got, want := len(list.Items), 0; got != want {
+    t.Errorf("search result count after delete: got %d, want %d", got, want)
+  }
+}
+
+func TestSearchCaptions(t *testing.T) {
+  testDir := "testdata/tmp"
+  os.RemoveAll(testDir)
+  if err := os.MkdirAll(testDir, 0744); err != nil {
+    t.Fatalf("Unable to create test directory: %v", err)
+  }
+  defer os.RemoveAll(testDir)
+  xmpSegment := testJpegSegment(0xE1, append([]byte(xmpApp1Header), testXmpDescription("Harbor seals")...))
+  for _, fn := range []string{"img1.jpg", "img2.jpg", "img3.jpg"} {
+    if err := writeTestJpeg(testDir + "/" + fn, 8, 8); err != nil {
+      t.Fatalf("Unable to create test file: %v", err)
+    }
+  }
+  if err := insertTestJpegSegments(testDir + "/img3.jpg", xmpSegment); err != nil {
+    t.Fatalf("Unable to add metadata to test file: %v", err)
+  }
+  if err := ioutil.WriteFile(testDir + "/img1.xmp", testXmpDescription("Lighthouse at dawn"), 0644); err != nil {
+    t.Fatalf("Unable to create test sidecar file: %v", err)
+  }
+
+  h := NewHandler(&Config{
+    ContentRoot: testDir,
+  });
+  search := func(query string) []string {
+    t.Helper()
+    list, err, _ := h.Search("", query)
+    if err != nil {
+      t.Fatalf("search for %s failed: %v", query, err)
+    }
+    paths := []string{}
+    for _, item := range list.Items {
+      paths = append(paths, item.Path)
+    }
+    return paths
+  }
+  check := func(query string, want ...string) {
+    t.Helper()
+    if got := search(query); strings.Join(got, ",") != strings.Join(want, ",") {
+      t.Errorf("search for %s: got %v, want %v", query, got, want)
+    }
+  }
+
+  // Captions from the sidecar and the image itself are in the index.
+  check("lighthouse", "/img1.jpg")
+  check("seals", "/img3.jpg")
+
+  // Once the index is built, it sees new captions.
+  if err, _ := h.PutText("img2.txt", UpdateTextCommand{Content: "Pelicans", Sidecar: true}); err != nil {
+    t.Fatalf("failed to write sidecar caption: %v", err)
+  }
+  check("pelicans", "/img2.jpg")
+
+  // A text file takes the place of the sidecar caption, until it is removed.
+  if err, _ := h.PutText("img1.txt", UpdateTextCommand{Content: "Foghorn"}); err != nil {
+    t.Fatalf("failed to write text: %v", err)
+  }
+  check("lighthouse")
+  check("foghorn", "/img1.jpg")
+  if err, _ := h.PutText("img1.txt", UpdateTextCommand{Content: ""}); err != nil {
+    t.Fatalf("failed to delete text: %v", err)
+  }
+  check("lighthouse", "/img1.jpg")
+  check("foghorn")
+}
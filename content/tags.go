@@ -0,0 +1,340 @@
+package content
+
+import (
+  "fmt"
+  "io/ioutil"
+  "log"
+  "net/http"
+  "os"
+  "path/filepath"
+  "sort"
+  "strings"
+  "sync"
+)
+
+const (
+  tagsExtension = ".tags"
+  summaryTagsName = "summary.tags"
+
+  // TagAlbumPrefix is the top of the virtual directory hierarchy that
+  // has one directory for each tag, listing the items with that tag.
+  TagAlbumPrefix = "@tags"
+)
+
+// TagsCommand is a change to the tags on an image or directory.
+type TagsCommand struct {
+  Action string         // add, remove or import
+  Tags []string         // The tags to add or remove
+}
+
+// TagCount is a tag and the number of items that have it.
+type TagCount struct {
+  Tag string
+  Count int
+}
+
+// tagIndex maps each tag to the tags files that contain it. Like the
+// searchIndex, it is built the first time we need it, and after that
+// it is updated as tags files are written.
+type tagIndex struct {
+  root string
+
+  mu sync.Mutex
+  built bool
+  docs map[string][]string    // tags file api path -> tags in it
+}
+
+func newTagIndex(root string) *tagIndex {
+  return &tagIndex{
+    root: root,
+  }
+}
+
+// UpdateTags adds or removes tags for an image or directory, or imports
+// them from the keywords in an image file, and returns the new tags.
+// Tags are stored one per line in a file next to the image with the
+// same name and a .tags extension, or in summary.tags for a directory.
+func (h *Handler) UpdateTags(apiPath string, command TagsCommand) ([]string, error, int) {
+  apiPath = cleanApiPath(apiPath)
+  contentRoot := strings.TrimSuffix(h.config.ContentRoot, "/")
+  filePath := fmt.Sprintf("%s/%s", contentRoot, apiPath)
+  f, err := os.Stat(filePath)
+  if err != nil {
+    return nil, fmt.Errorf("%s does not exist", apiPath), http.StatusNotFound
+  }
+  if !f.IsDir() && !h.isMediaFile(f.Name()) {
+    return nil, fmt.Errorf("%s is not an image, video or directory", apiPath), http.StatusBadRequest
+  }
+  tagsPath := tagsFilePathFor(filePath, f.IsDir())
+  tags := readTagsFile(tagsPath)
+
+  switch command.Action {
+  case "add", "remove":
+    if len(command.Tags) == 0 {
+      return nil, fmt.Errorf("no tags specified"), http.StatusBadRequest
+    }
+    for _, tag := range command.Tags {
+      tag, err := normalizeTag(tag)
+      if err != nil {
+        return nil, err, http.StatusBadRequest
+      }
+      if command.Action == "add" {
+        tags = addTag(tags, tag)
+      } else {
+        tags = removeTag(tags, tag)
+      }
+    }
+  case "import":
+    if f.IsDir() || !h.isImageFile(f.Name()) {
+      return nil, fmt.Errorf("tags can only be imported from image files"), http.StatusBadRequest
+    }
+    md, err := readEmbeddedMetadata(filePath)
+    if err != nil {
+      return nil, fmt.Errorf("failed to read keywords from %s: %v", apiPath, err), http.StatusInternalServerError
+    }
+    for _, keyword := range md.Keywords {
+      if tag, err := normalizeTag(keyword); err == nil {
+        tags = addTag(tags, tag)
+      }
+    }
+  case "":
+    return nil, fmt.Errorf("no action specified"), http.StatusBadRequest
+  default:
+    return nil, fmt.Errorf("action %s is not valid", command.Action), http.StatusBadRequest
+  }
+
+  if err := writeTagsFile(tagsPath, tags); err != nil {
+    return nil, fmt.Errorf("failed to write tags for %s: %v", apiPath, err), http.StatusInternalServerError
+  }
+  tagsApiPath := strings.TrimPrefix(strings.TrimPrefix(tagsPath, contentRoot), "/")
+  h.tagIndex.update(tagsApiPath, tags)
+  if tags == nil {
+    tags = []string{}
+  }
+  return tags, nil, http.StatusOK
+}
+
+// Tags returns the tags for an image, video or directory.
+func (h *Handler) Tags(apiPath string) ([]string, error, int) {
+  apiPath = cleanApiPath(apiPath)
+  filePath := fmt.Sprintf("%s/%s", strings.TrimSuffix(h.config.ContentRoot, "/"), apiPath)
+  f, err := os.Stat(filePath)
+  if err != nil {
+    return nil, fmt.Errorf("%s does not exist", apiPath), http.StatusNotFound
+  }
+  tags := readTagsFile(tagsFilePathFor(filePath, f.IsDir()))
+  if tags == nil {
+    tags = []string{}
+  }
+  return tags, nil, 0
+}
+
+// AllTags returns all of the tags we know about, sorted by tag.
+func (h *Handler) AllTags() []TagCount {
+  return h.tagIndex.allTags()
+}
+
+// ListByTag lists one level of the virtual tag hierarchy. The top level,
+// "@tags", has a directory for each tag; "@tags/<tag>" lists all of the
+// images, videos and directories with that tag, each with its full path.
+// The options filter and add to the items for a tag, as for List.
+func (h *Handler) ListByTag(apiPath string, options ListOptions) (*ListResult, error, int) {
+  if err := checkListFilter(options); err != nil {
+    return nil, err, http.StatusBadRequest
+  }
+  apiPath = cleanApiPath(apiPath)
+  if apiPath == TagAlbumPrefix {
+    tagCounts := h.tagIndex.allTags()
+    list := make([]ListItem, len(tagCounts))
+    for i, tc := range tagCounts {
+      list[i] = ListItem{
+        Name: tc.Tag,
+        IsDir: true,
+      }
+    }
+    return &ListResult{
+      Items: list,
+    }, nil, 0
+  }
+  if !strings.HasPrefix(apiPath, TagAlbumPrefix + "/") {
+    return nil, fmt.Errorf("%s is not a tag album path", apiPath), http.StatusBadRequest
+  }
+  tag, err := normalizeTag(strings.TrimPrefix(apiPath, TagAlbumPrefix + "/"))
+  if err != nil {
+    return nil, err, http.StatusNotFound
+  }
+  tagsPaths := h.tagIndex.filesWithTag(tag)
+  apiPaths := make([]string, 0, len(tagsPaths))
+  for _, tagsPath := range tagsPaths {
+    if itemApiPath := h.itemForSidecarFile(tagsPath); itemApiPath != "" {
+      apiPaths = append(apiPaths, itemApiPath)
+    }
+  }
+  return &ListResult{
+    Items: filterListItems(h.apiPathsToListItems(apiPaths, options), options),
+  }, nil, 0
+}
+
+// update updates the index for a tags file that has been written.
+// No tags means the file has been deleted.
+func (x *tagIndex) update(tagsApiPath string, tags []string) {
+  x.mu.Lock()
+  defer x.mu.Unlock()
+  if !x.built {
+    return      // We will pick up the change when we build the index.
+  }
+  if len(tags) == 0 {
+    delete(x.docs, cleanApiPath(tagsApiPath))
+  } else {
+    x.docs[cleanApiPath(tagsApiPath)] = tags
+  }
+}
+
+// filesWithTag returns the api paths of the tags files that contain
+// the tag, sorted by path.
+func (x *tagIndex) filesWithTag(tag string) []string {
+  x.mu.Lock()
+  defer x.mu.Unlock()
+  x.build()
+  result := make([]string, 0)
+  for doc, tags := range x.docs {
+    if containsTag(tags, tag) {
+      result = append(result, doc)
+    }
+  }
+  sort.Strings(result)
+  return result
+}
+
+func (x *tagIndex) allTags() []TagCount {
+  x.mu.Lock()
+  defer x.mu.Unlock()
+  x.build()
+  counts := make(map[string]int)
+  for _, tags := range x.docs {
+    for _, tag := range tags {
+      counts[tag]++
+    }
+  }
+  result := make([]TagCount, 0, len(counts))
+  for tag, count := range counts {
+    result = append(result, TagCount{tag, count})
+  }
+  sort.Slice(result, func(i, j int) bool { return result[i].Tag < result[j].Tag })
+  return result
+}
+
+// build reads all of the tags files under our root directory into the
+// index, if we have not already done so. The caller must hold x.mu.
+func (x *tagIndex) build() {
+  if x.built {
+    return
+  }
+  x.docs = make(map[string][]string)
+  root := filepath.Clean(x.root)
+  filepath.Walk(root, func(p string, f os.FileInfo, err error) error {
+    if err != nil {
+      log.Printf("Error scanning %s for tag index: %v", p, err)
+      return nil
+    }
+    if f.IsDir() {
+      // Skip hidden dirs, in particular our cache dir.
+      if p != root && strings.HasPrefix(f.Name(), ".") {
+        return filepath.SkipDir
+      }
+      return nil
+    }
+    if filepath.Ext(p) != tagsExtension {
+      return nil
+    }
+    rel, err := filepath.Rel(root, p)
+    if err != nil {
+      return nil
+    }
+    if tags := readTagsFile(p); len(tags) > 0 {
+      x.docs[filepath.ToSlash(rel)] = tags
+    }
+    return nil
+  })
+  x.built = true
+  log.Printf("Tag index built with %d tags files", len(x.docs))
+}
+
+// tagsFilePathFor returns the path to the tags file for an image or directory.
+func tagsFilePathFor(filePath string, isDir bool) string {
+  if isDir {
+    return filepath.Join(filePath, summaryTagsName)
+  }
+  return strings.TrimSuffix(filePath, filepath.Ext(filePath)) + tagsExtension
+}
+
+// readTagsFile returns the tags in the file, or nil if there is no file.
+func readTagsFile(tagsPath string) []string {
+  b, err := ioutil.ReadFile(tagsPath)
+  if err != nil {
+    if !os.IsNotExist(err) {
+      log.Printf("Error reading tags file %s: %v", tagsPath, err)
+    }
+    return nil
+  }
+  var tags []string
+  for _, line := range strings.Split(string(b), "\n") {
+    if tag, err := normalizeTag(line); err == nil {
+      tags = addTag(tags, tag)
+    }
+  }
+  return tags
+}
+
+// writeTagsFile writes the tags to the file, one per line,
+// or removes the file if there are no tags.
+func writeTagsFile(tagsPath string, tags []string) error {
+  if len(tags) == 0 {
+    err := os.Remove(tagsPath)
+    if err != nil && !os.IsNotExist(err) {
+      return err
+    }
+    return nil
+  }
+  return ioutil.WriteFile(tagsPath, []byte(strings.Join(tags, "\n") + "\n"), 0644)
+}
+
+// normalizeTag returns the tag in the form we store it: trimmed and lower
+// case. Tags can't contain slashes, since they are used in paths.
+func normalizeTag(tag string) (string, error) {
+  tag = strings.ToLower(strings.TrimSpace(tag))
+  if tag == "" {
+    return "", fmt.Errorf("tag is empty")
+  }
+  if strings.ContainsAny(tag, "/\n\r") || tag == "." || tag == ".." {
+    return "", fmt.Errorf("tag %q is not valid", tag)
+  }
+  return tag, nil
+}
+
+func containsTag(tags []string, tag string) bool {
+  for _, t := range tags {
+    if t == tag {
+      return true
+    }
+  }
+  return false
+}
+
+// addTag returns the tags with tag added at the end, if it is not already there.
+func addTag(tags []string, tag string) []string {
+  if containsTag(tags, tag) {
+    return tags
+  }
+  return append(tags, tag)
+}
+
+func removeTag(tags []string, tag string) []string {
+  result := make([]string, 0, len(tags))
+  for _, t := range tags {
+    if t != tag {
+      result = append(result, t)
+    }
+  }
+  return result
+}
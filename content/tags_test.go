@@ -0,0 +1,243 @@
+package content
+
+import (
+  "bytes"
+  "encoding/binary"
+  "fmt"
+  "io/ioutil"
+  "net/http"
+  "os"
+  "strings"
+  "testing"
+)
+
+func TestTags(t *testing.T) {
+  testDir := "testdata/tmp"
+  os.RemoveAll(testDir)
+  if err := os.MkdirAll(testDir + "/d1/d2", 0744); err != nil {
+    t.Fatalf("Unable to create test directory: %v", err)
+  }
+  defer os.RemoveAll(testDir)
+  for _, fn := range []string{"d1/img1.jpg", "d1/img2.jpg", "d1/d2/img3.jpg"} {
+    if err := writeTestJpeg(testDir + "/" + fn, 8, 8); err != nil {
+      t.Fatalf("Unable to create test file: %v", err)
+    }
+  }
+  h := NewHandler(&Config{
+    ContentRoot: testDir,
+  });
+
+  // Build the index before we add any tags to make sure it gets updated.
+  if got := h.AllTags(); len(got) != 0 {
+    t.Errorf("AllTags before adding: got %v, want none", got)
+  }
+
+  updates := []struct{
+    apiPath string
+    command TagsCommand
+    want string
+  }{
+    { "d1/img1.jpg", TagsCommand{"add", []string{"Beach", " grandma "}}, "beach,grandma" },
+    { "d1/img1.jpg", TagsCommand{"add", []string{"beach", "2019-trip"}}, "beach,grandma,2019-trip" },
+    { "d1/img2.jpg", TagsCommand{"add", []string{"beach"}}, "beach" },
+    { "d1/d2/img3.jpg", TagsCommand{"add", []string{"grandma"}}, "grandma" },
+    { "d1/d2", TagsCommand{"add", []string{"beach"}}, "beach" },
+    { "d1/img1.jpg", TagsCommand{"remove", []string{"2019-trip", "nosuchtag"}}, "beach,grandma" },
+  }
+  for _, u := range updates {
+    tags, err, _ := h.UpdateTags(u.apiPath, u.command)
+    if err != nil {
+      t.Fatalf("UpdateTags(%s, %v) failed: %v", u.apiPath, u.command, err)
+    }
+    if got := strings.Join(tags, ","); got != u.want {
+      t.Errorf("UpdateTags(%s, %v): got %q, want %q", u.apiPath, u.command, got, u.want)
+    }
+  }
+
+  b, err := ioutil.ReadFile(testDir + "/d1/img1.tags")
+  if err != nil {
+    t.Fatalf("Failed to read tags file: %v", err)
+  }
+  if got, want := string(b), "beach\ngrandma\n"; got != want {
+    t.Errorf("tags file: got %q, want %q", got, want)
+  }
+  if _, err := os.Stat(testDir + "/d1/d2/summary.tags"); err != nil {
+    t.Errorf("directory tags file should exist: %v", err)
+  }
+
+  badUpdates := []struct{
+    apiPath string
+    command TagsCommand
+    status int
+  }{
+    { "d1/nosuch.jpg", TagsCommand{"add", []string{"beach"}}, http.StatusNotFound },
+    { "d1/img1.jpg", TagsCommand{"add", []string{"a/b"}}, http.StatusBadRequest },
+    { "d1/img1.jpg", TagsCommand{"add", []string{" "}}, http.StatusBadRequest },
+    { "d1/img1.jpg", TagsCommand{"add", nil}, http.StatusBadRequest },
+    { "d1/img1.jpg", TagsCommand{"frob", []string{"beach"}}, http.StatusBadRequest },
+    { "d1", TagsCommand{"import", nil}, http.StatusBadRequest },
+  }
+  for _, u := range badUpdates {
+    if _, err, status := h.UpdateTags(u.apiPath, u.command); err == nil || status != u.status {
+      t.Errorf("UpdateTags(%s, %v): got status %d and error %v, want status %d", u.apiPath, u.command, status, err, u.status)
+    }
+  }
+
+  list, err, _ := h.List("d1", ListOptions{})
+  if err != nil {
+    t.Fatalf("List failed: %v", err)
+  }
+  tagsByName := make(map[string]string)
+  for _, item := range list.Items {
+    tagsByName[item.Name] = strings.Join(item.Tags, ",")
+  }
+  if got, want := tagsByName["img1.jpg"], "beach,grandma"; got != want {
+    t.Errorf("List tags for img1.jpg: got %q, want %q", got, want)
+  }
+  if got, want := tagsByName["d2"], "beach"; got != want {
+    t.Errorf("List tags for d2: got %q, want %q", got, want)
+  }
+
+  var counts []string
+  for _, tc := range h.AllTags() {
+    counts = append(counts, fmt.Sprintf("%s:%d", tc.Tag, tc.Count))
+  }
+  if got, want := strings.Join(counts, ","), "beach:3,grandma:2"; got != want {
+    t.Errorf("AllTags: got %q, want %q", got, want)
+  }
+
+  top, err, _ := h.ListByTag(TagAlbumPrefix, ListOptions{})
+  if err != nil {
+    t.Fatalf("ListByTag(%s) failed: %v", TagAlbumPrefix, err)
+  }
+  if got, want := len(top.Items), 2; got != want {
+    t.Fatalf("ListByTag(%s) items: got %d, want %d", TagAlbumPrefix, got, want)
+  }
+  if !top.Items[0].IsDir || top.Items[0].Name != "beach" {
+    t.Errorf("ListByTag(%s) first item: got %+v, want dir beach", TagAlbumPrefix, top.Items[0])
+  }
+
+  rating := UpdateCommand{Item: "img1.jpg", Action: "rating", Value: "4", Autocreate: true}
+  if err, _ := h.UpdateImageIndex("d1/index.mpr", rating); err != nil {
+    t.Fatalf("failed to set rating: %v", err)
+  }
+  testCases := []struct{
+    apiPath string
+    options ListOptions
+    want string
+  }{
+    { "@tags/beach", ListOptions{}, "/d1/d2,/d1/img1.jpg,/d1/img2.jpg" },
+    { "@tags/Grandma", ListOptions{}, "/d1/d2/img3.jpg,/d1/img1.jpg" },
+    { "@tags/nosuchtag", ListOptions{}, "" },
+    // Directories are not filtered.
+    { "@tags/beach", ListOptions{MinRating: 3}, "/d1/d2,/d1/img1.jpg" },
+    { "@tags/beach", ListOptions{Flag: FlagPick}, "/d1/d2" },
+  }
+  for _, tc := range testCases {
+    result, err, _ := h.ListByTag(tc.apiPath, tc.options)
+    if err != nil {
+      t.Fatalf("ListByTag(%s) failed: %v", tc.apiPath, err)
+    }
+    paths := make([]string, len(result.Items))
+    for i, item := range result.Items {
+      paths[i] = item.Path
+    }
+    if got := strings.Join(paths, ","); got != tc.want {
+      t.Errorf("ListByTag(%s, %+v): got %q, want %q", tc.apiPath, tc.options, got, tc.want)
+    }
+  }
+  if _, err, status := h.ListByTag("@tags/beach", ListOptions{MinRating: 9}); err == nil || status != http.StatusBadRequest {
+    t.Errorf("ListByTag with bad filter: got status %d, want %d", status, http.StatusBadRequest)
+  }
+
+  // Removing the last tag removes the file and the item from the listing.
+  if _, err, _ := h.UpdateTags("d1/img2.jpg", TagsCommand{"remove", []string{"beach"}}); err != nil {
+    t.Fatalf("UpdateTags remove failed: %v", err)
+  }
+  if _, err := os.Stat(testDir + "/d1/img2.tags"); !os.IsNotExist(err) {
+    t.Errorf("tags file should have been removed")
+  }
+  result, _, _ := h.ListByTag("@tags/beach", ListOptions{})
+  if got, want := len(result.Items), 2; got != want {
+    t.Errorf("ListByTag after remove: got %d items, want %d", got, want)
+  }
+}
+
+func TestTagsImport(t *testing.T) {
+  testDir := "testdata/tmp"
+  os.RemoveAll(testDir)
+  if err := os.MkdirAll(testDir, 0744); err != nil {
+    t.Fatalf("Unable to create test directory: %v", err)
+  }
+  defer os.RemoveAll(testDir)
+  imagePath := testDir + "/img.jpg"
+  if err := writeTestJpeg(imagePath, 8, 8); err != nil {
+    t.Fatalf("Unable to create test file: %v", err)
+  }
+  xmp := `<?xpacket begin="" id="W5M0MpCehiHzreSzNTczkc9d"?>
+<x:xmpmeta xmlns:x="adobe:ns:meta/">
+ <rdf:RDF xmlns:rdf="http://www.w3.org/1999/02/22-rdf-syntax-ns#">
+  <rdf:Description rdf:about="" xmlns:dc="http://purl.org/dc/elements/1.1/">
+   <dc:title><rdf:Alt><rdf:li xml:lang="x-default">Not a keyword</rdf:li></rdf:Alt></dc:title>
+   <dc:subject><rdf:Bag><rdf:li>Beach</rdf:li><rdf:li>Sunset &amp; Sea</rdf:li></rdf:Bag></dc:subject>
+  </rdf:Description>
+ </rdf:RDF>
+</x:xmpmeta>
+<?xpacket end="w"?>`
+  iptc := append(testIptcDataset(2, 25, []byte("grandma")), testIptcDataset(2, 25, []byte("beach"))...)
+  iptc = append(iptc, testIptcDataset(2, 25, []byte("caf\xe9"))...)     // Latin-1
+  iptc = append(iptc, testIptcDataset(2, 120, []byte("A caption"))...)
+  if err := insertTestJpegSegments(imagePath,
+      testJpegSegment(0xE1, append([]byte(xmpApp1Header), xmp...)),
+      testJpegSegment(0xED, append([]byte(photoshopApp13Header), testPhotoshopResource(iptcResourceId, iptc)...))); err != nil {
+    t.Fatalf("Unable to add metadata to test file: %v", err)
+  }
+
+  h := NewHandler(&Config{
+    ContentRoot: testDir,
+  });
+  tags, err, _ := h.UpdateTags("img.jpg", TagsCommand{Action: "import"})
+  if err != nil {
+    t.Fatalf("UpdateTags import failed: %v", err)
+  }
+  if got, want := strings.Join(tags, ","), "beach,sunset & sea,grandma,café"; got != want {
+    t.Errorf("imported tags: got %q, want %q", got, want)
+  }
+}
+
+func testJpegSegment(marker byte, data []byte) []byte {
+  seg := []byte{0xFF, marker, 0, 0}
+  binary.BigEndian.PutUint16(seg[2:], uint16(2 + len(data)))
+  return append(seg, data...)
+}
+
+// testPhotoshopResource returns an image resource block with an empty name.
+func testPhotoshopResource(id uint16, data []byte) []byte {
+  res := []byte("8BIM")
+  res = append(res, byte(id >> 8), byte(id), 0, 0)
+  size := make([]byte, 4)
+  binary.BigEndian.PutUint32(size, uint32(len(data)))
+  res = append(res, size...)
+  res = append(res, data...)
+  if len(data) % 2 == 1 {
+    res = append(res, 0)
+  }
+  return res
+}
+
+func testIptcDataset(record, dataset byte, data []byte) []byte {
+  ds := []byte{0x1C, record, dataset, byte(len(data) >> 8), byte(len(data))}
+  return append(ds, data...)
+}
+
+// insertTestJpegSegments adds the segments to the JPEG file right after the SOI.
+func insertTestJpegSegments(filename string, segments ...[]byte) error {
+  jpg, err := ioutil.ReadFile(filename)
+  if err != nil {
+    return err
+  }
+  out := append([]byte{}, jpg[:2]...)
+  out = append(out, bytes.Join(segments, nil)...)
+  out = append(out, jpg[2:]...)
+  return ioutil.WriteFile(filename, out, 0644)
+}
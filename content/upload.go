@@ -0,0 +1,156 @@
+package content
+
+import (
+  "fmt"
+  "image"
+  "io"
+  "io/ioutil"
+  "log"
+  "net/http"
+  "os"
+  "os/exec"
+  "path/filepath"
+  "strings"
+)
+
+// UploadOptions control what Upload does with an uploaded file.
+type UploadOptions struct {
+  Overwrite bool        // Replace an existing file with the same name
+  AddToIndex bool       // Append the file to index.mpr, if the directory has one
+}
+
+// Upload saves an image or video file into the specified directory.
+// The file must have one of our image or video extensions, and its
+// contents must decode as that kind of file. We write the data to a
+// hidden temp file first, so that a partial or invalid upload never
+// appears in the directory.
+func (h *Handler) Upload(dirApiPath, name string, r io.Reader, options UploadOptions) (error, int) {
+  if name == "" || name != filepath.Base(name) || strings.HasPrefix(name, ".") {
+    return fmt.Errorf("invalid upload file name %q", name), http.StatusBadRequest
+  }
+  for _, dir := range strings.Split(cleanApiPath(dirApiPath), "/") {
+    if strings.HasPrefix(dir, ".") {
+      return fmt.Errorf("invalid upload directory %q", dirApiPath), http.StatusBadRequest
+    }
+  }
+  if !h.isMediaFile(name) {
+    return fmt.Errorf("file %s is not an image or video file", name), http.StatusBadRequest
+  }
+  contentRoot := strings.TrimSuffix(h.config.ContentRoot, "/")
+  dirPath := fmt.Sprintf("%s/%s", contentRoot, cleanApiPath(dirApiPath))
+  if f, err := os.Stat(dirPath); err != nil || !f.IsDir() {
+    return fmt.Errorf("directory %s does not exist", dirApiPath), http.StatusNotFound
+  }
+  filePath := filepath.Join(dirPath, name)
+  if !options.Overwrite {
+    if _, err := os.Stat(filePath); err == nil {
+      return fmt.Errorf("file %s already exists", name), http.StatusConflict
+    }
+  }
+
+  tmp, err := ioutil.TempFile(dirPath, ".upload-")
+  if err != nil {
+    return fmt.Errorf("failed to create temp file: %v", err), http.StatusInternalServerError
+  }
+  tmpPath := tmp.Name()
+  defer os.Remove(tmpPath)      // Fails harmlessly once we have moved it
+  _, err = io.Copy(tmp, r)
+  if closeErr := tmp.Close(); err == nil {
+    err = closeErr
+  }
+  if err != nil {
+    return fmt.Errorf("failed to save upload of %s: %w", name, err), http.StatusInternalServerError
+  }
+  if err := os.Chmod(tmpPath, 0644); err != nil {
+    return fmt.Errorf("failed to set mode of %s: %v", name, err), http.StatusInternalServerError
+  }
+
+  if t := h.mediaType(name); t.Kind == MediaKindImage {
+    err = validateImageFile(tmpPath, t)
+  } else {
+    err = validateVideoFile(tmpPath)
+  }
+  if err != nil {
+    return fmt.Errorf("upload of %s is not valid: %v", name, err), http.StatusBadRequest
+  }
+
+  if options.Overwrite {
+    err = os.Rename(tmpPath, filePath)
+  } else {
+    // Link rather than rename so that we fail if someone else has
+    // created the file since we checked.
+    err = os.Link(tmpPath, filePath)
+    if os.IsExist(err) {
+      return fmt.Errorf("file %s already exists", name), http.StatusConflict
+    }
+  }
+  if err != nil {
+    return fmt.Errorf("failed to move upload to %s: %v", name, err), http.StatusInternalServerError
+  }
+  log.Printf("Uploaded %s", filePath)
+  // Don't wait for the watcher, which may not be running, and which
+  // doesn't see a write to the new name when we link the file.
+  h.filesChanged(dirApiPath, map[string]bool{name: true})
+
+  if options.AddToIndex {
+    if err, status := h.addToIndex(filepath.Join(dirPath, "index.mpr"), name); err != nil {
+      return err, status
+    }
+  }
+  return nil, http.StatusOK
+}
+
+// addToIndex appends an entry for the file to the end of the index file,
+// unless it is already there. If there is no index file, all of the files
+// in the directory are shown, so we don't need to do anything.
+func (h *Handler) addToIndex(indexPath, name string) (error, int) {
+  lines, err := readFileLines(indexPath)
+  if os.IsNotExist(err) {
+    return nil, 0
+  }
+  if err != nil {
+    return fmt.Errorf("failed to read index file %s: %v", indexPath, err), http.StatusInternalServerError
+  }
+  if i, _ := findEntry(lines, name); i >= 0 {
+    return nil, 0
+  }
+  entry := &imageEntry{
+    filename: name,
+    rotation: "xo",
+  }
+  lines = append(lines, entry.toString())
+  if err := backupAndWriteFileLines(indexPath, lines); err != nil {
+    return err, http.StatusInternalServerError
+  }
+  return nil, 0
+}
+
+// validateImageFile returns an error if the file is not an image that we
+// can decode. We decode the whole image so that we catch truncated files.
+func validateImageFile(filePath string, t *MediaType) error {
+  if t.Decode != nil {
+    _, _, err := t.Decode(filePath)
+    return err
+  }
+  f, err := os.Open(filePath)
+  if err != nil {
+    return err
+  }
+  defer f.Close()
+  _, _, err = image.Decode(f)
+  return err
+}
+
+// validateVideoFile returns an error if ffprobe can't read the file.
+// If we don't have ffprobe, we accept the file without checking it.
+func validateVideoFile(filePath string) error {
+  if _, err := exec.LookPath(ffprobeCommand); err != nil {
+    log.Printf("No ffprobe, not validating video file %s", filePath)
+    return nil
+  }
+  cmd := exec.Command(ffprobeCommand, "-v", "error", "-show_format", filePath)
+  if out, err := cmd.CombinedOutput(); err != nil {
+    return fmt.Errorf("%v: %s", err, strings.TrimSpace(string(out)))
+  }
+  return nil
+}
@@ -0,0 +1,95 @@
+package content
+
+import (
+  "bytes"
+  "image"
+  "image/jpeg"
+  "io/ioutil"
+  "net/http"
+  "os"
+  "strings"
+  "testing"
+)
+
+func TestUpload(t *testing.T) {
+  testDir := "testdata/tmp"
+  os.RemoveAll(testDir)
+  for _, d := range []string{"/a", "/.mimcache/images"} {
+    if err := os.MkdirAll(testDir + d, 0744); err != nil {
+      t.Fatalf("Unable to create test directory: %v", err)
+    }
+  }
+  defer os.RemoveAll(testDir)
+  if err := ioutil.WriteFile(testDir + "/a/index.mpr", []byte("old.jpg\n"), 0644); err != nil {
+    t.Fatalf("Unable to create test index file: %v", err)
+  }
+
+  h := NewHandler(&Config{
+    ContentRoot: testDir,
+  });
+  events, cancel := h.Subscribe()
+  defer cancel()
+
+  var buf bytes.Buffer
+  if err := jpeg.Encode(&buf, image.NewGray(image.Rect(0, 0, 20, 10)), nil); err != nil {
+    t.Fatalf("Unable to encode test image: %v", err)
+  }
+  jpg := buf.Bytes()
+
+  testCases := []struct{
+    dir, name string
+    data []byte
+    options UploadOptions
+    wantStatus int
+  }{
+    { "a", "new.jpg", jpg, UploadOptions{AddToIndex: true}, http.StatusOK },
+    { "a", "new.jpg", jpg, UploadOptions{}, http.StatusConflict },
+    { "a", "new.jpg", jpg, UploadOptions{Overwrite: true}, http.StatusOK },
+    { "a", "bad.jpg", []byte("not a jpeg"), UploadOptions{}, http.StatusBadRequest },
+    { "a", "truncated.jpg", jpg[:len(jpg) / 2], UploadOptions{}, http.StatusBadRequest },
+    { "a", "new.txt", []byte("text"), UploadOptions{}, http.StatusBadRequest },
+    { "a", "../up.jpg", jpg, UploadOptions{}, http.StatusBadRequest },
+    { "a", ".hidden.jpg", jpg, UploadOptions{}, http.StatusBadRequest },
+    { "no-such-dir", "new.jpg", jpg, UploadOptions{}, http.StatusNotFound },
+    { ".mimcache/images", "new.jpg", jpg, UploadOptions{}, http.StatusBadRequest },
+    { "a/../.mimcache", "new.jpg", jpg, UploadOptions{}, http.StatusBadRequest },
+  }
+  for _, tc := range testCases {
+    err, status := h.Upload(tc.dir, tc.name, bytes.NewReader(tc.data), tc.options)
+    if got, want := status, tc.wantStatus; got != want {
+      t.Errorf("upload of %s/%s: got status %d (err %v), want %d", tc.dir, tc.name, got, err, want)
+    }
+  }
+
+  // Without a watcher, the uploads still tell subscribers and update the catalog.
+  select {
+  case event := <-events:
+    if event.Dir != "a" || len(event.Names) != 1 || event.Names[0] != "new.jpg" {
+      t.Errorf("change event after upload: got %+v, want new.jpg in a", event)
+    }
+  default:
+    t.Errorf("no change event after upload")
+  }
+  if r := h.catalog.get("a/new.jpg"); r == nil || r.Width != 20 {
+    t.Errorf("catalog record after upload: got %+v, want 20 wide", r)
+  }
+
+  files, err := ioutil.ReadDir(testDir + "/a")
+  if err != nil {
+    t.Fatalf("Unable to read test directory: %v", err)
+  }
+  names := make([]string, len(files))
+  for i, f := range files {
+    names[i] = f.Name()
+  }
+  if got, want := strings.Join(names, ","), "index.mpr,index.mpr~,new.jpg"; got != want {
+    t.Errorf("files after uploads: got %s, want %s", got, want)
+  }
+  index, err := ioutil.ReadFile(testDir + "/a/index.mpr")
+  if err != nil {
+    t.Fatalf("Unable to read index file: %v", err)
+  }
+  if got, want := string(index), "old.jpg\nnew.jpg;xo\n"; got != want {
+    t.Errorf("index file after upload: got %q, want %q", got, want)
+  }
+}
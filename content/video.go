@@ -0,0 +1,135 @@
+package content
+
+import (
+  "encoding/json"
+  "fmt"
+  "os/exec"
+  "strconv"
+  "time"
+)
+
+// The command we run to get information about videos.
+var ffprobeCommand = "ffprobe"
+
+// VideoInfo is what we know about a video from its container and streams.
+type VideoInfo struct {
+  Duration float64      // Seconds
+  Width int             // Displayed frame size in pixels, after rotation
+  Height int
+  VideoCodec string     // Such as h264
+  AudioCodec string     // Such as aac; empty if there is no audio
+  CreationTime time.Time        // From the container metadata; zero if none
+}
+
+// ffprobeOutput is the part of the JSON output from ffprobe that we use.
+type ffprobeOutput struct {
+  Format struct {
+    Duration string `json:"duration"`
+    Tags map[string]string `json:"tags"`
+  } `json:"format"`
+  Streams []struct {
+    CodecType string `json:"codec_type"`
+    CodecName string `json:"codec_name"`
+    Width int `json:"width"`
+    Height int `json:"height"`
+    Tags map[string]string `json:"tags"`
+    SideDataList []struct {
+      Rotation float64 `json:"rotation"`
+    } `json:"side_data_list"`
+  } `json:"streams"`
+}
+
+// probeVideo runs ffprobe to get the information about the video file.
+func probeVideo(filePath string) (*VideoInfo, error) {
+  cmd := exec.Command(ffprobeCommand,
+      "-v", "error",
+      "-print_format", "json",
+      "-show_format",
+      "-show_streams",
+      filePath)
+  out, err := cmd.Output()
+  if err != nil {
+    return nil, fmt.Errorf("Error probing video file %v: %v", filePath, err)
+  }
+  return parseFfprobeOutput(out)
+}
+
+// parseFfprobeOutput gets the video information from the JSON output
+// of ffprobe. We use the first video and audio streams.
+func parseFfprobeOutput(b []byte) (*VideoInfo, error) {
+  var probe ffprobeOutput
+  if err := json.Unmarshal(b, &probe); err != nil {
+    return nil, fmt.Errorf("failed to parse ffprobe output: %v", err)
+  }
+  info := &VideoInfo{}
+  if d, err := strconv.ParseFloat(probe.Format.Duration, 64); err == nil {
+    info.Duration = d
+  }
+  info.CreationTime = parseCreationTime(probe.Format.Tags["creation_time"])
+  hasVideo := false
+  for _, s := range probe.Streams {
+    switch s.CodecType {
+    case "video":
+      if info.VideoCodec != "" {
+        continue
+      }
+      hasVideo = true
+      info.VideoCodec = s.CodecName
+      info.Width = s.Width
+      info.Height = s.Height
+      // Phones record portrait videos as landscape frames that are to be
+      // rotated when played. Older files have a rotate tag, newer ones a
+      // display matrix in the side data.
+      rotation, _ := strconv.Atoi(s.Tags["rotate"])
+      for _, sd := range s.SideDataList {
+        if sd.Rotation != 0 {
+          rotation = int(sd.Rotation)
+        }
+      }
+      if rotation % 180 != 0 {
+        info.Width, info.Height = s.Height, s.Width
+      }
+      if info.CreationTime.IsZero() {
+        info.CreationTime = parseCreationTime(s.Tags["creation_time"])
+      }
+    case "audio":
+      if info.AudioCodec == "" {
+        info.AudioCodec = s.CodecName
+      }
+    }
+  }
+  if !hasVideo {
+    return nil, fmt.Errorf("no video stream")
+  }
+  return info, nil
+}
+
+// parseCreationTime parses the creation_time tag from a video container.
+// Cameras that don't know the time often write the epoch of the format,
+// such as 1904 for QuickTime, so we treat those as no time at all.
+func parseCreationTime(value string) time.Time {
+  for _, layout := range []string{time.RFC3339Nano, "2006-01-02 15:04:05"} {
+    if t, err := time.Parse(layout, value); err == nil {
+      if t.Year() <= 1970 {
+        return time.Time{}
+      }
+      return t
+    }
+  }
+  return time.Time{}
+}
+
+// localCreationTime returns the creation time of a video as a time in the
+// Local location with the clock time where the video was taken, to match
+// the EXIF DateTime of photos. The container time is UTC, so we convert it
+// to loc, the time zone of the video's directory, or Local if nil.
+func localCreationTime(t time.Time, loc *time.Location) time.Time {
+  if t.IsZero() {
+    return t
+  }
+  if loc == nil {
+    loc = time.Local
+  }
+  t = t.In(loc)
+  return time.Date(t.Year(), t.Month(), t.Day(), t.Hour(), t.Minute(), t.Second(), t.Nanosecond(), time.Local)
+}
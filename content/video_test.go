@@ -0,0 +1,158 @@
+package content
+
+import (
+  "io/ioutil"
+  "os"
+  "testing"
+  "time"
+)
+
+const testFfprobeOutput = `{
+    "streams": [
+        {
+            "index": 0,
+            "codec_name": "h264",
+            "codec_type": "video",
+            "width": 1920,
+            "height": 1080,
+            "tags": {
+                "creation_time": "2019-06-01T12:34:56.000000Z"
+            }
+        },
+        {
+            "index": 1,
+            "codec_name": "aac",
+            "codec_type": "audio",
+            "sample_rate": "48000"
+        }
+    ],
+    "format": {
+        "filename": "clip.mp4",
+        "format_name": "mov,mp4,m4a,3gp,3g2,mj2",
+        "duration": "42.508000",
+        "tags": {
+            "creation_time": "2019-06-01T12:34:50.000000Z"
+        }
+    }
+}`
+
+func TestParseFfprobeOutput(t *testing.T) {
+  info, err := parseFfprobeOutput([]byte(testFfprobeOutput))
+  if err != nil {
+    t.Fatalf("parseFfprobeOutput failed: %v", err)
+  }
+  want := VideoInfo{
+    Duration: 42.508,
+    Width: 1920,
+    Height: 1080,
+    VideoCodec: "h264",
+    AudioCodec: "aac",
+    CreationTime: time.Date(2019, 6, 1, 12, 34, 50, 0, time.UTC),
+  }
+  if !info.CreationTime.Equal(want.CreationTime) {
+    t.Errorf("CreationTime: got %v, want %v", info.CreationTime, want.CreationTime)
+  }
+  info.CreationTime = want.CreationTime
+  if *info != want {
+    t.Errorf("parseFfprobeOutput: got %+v, want %+v", *info, want)
+  }
+
+  // No creation time for the container, and the stream has the epoch.
+  info, err = parseFfprobeOutput([]byte(`{"streams": [{"codec_type": "video", "codec_name": "mpeg1video",
+      "width": 320, "height": 240, "tags": {"creation_time": "1904-01-01T00:00:00.000000Z"}}],
+      "format": {"duration": "N/A"}}`))
+  if err != nil {
+    t.Fatalf("parseFfprobeOutput failed: %v", err)
+  }
+  if !info.CreationTime.IsZero() || info.Duration != 0 || info.AudioCodec != "" {
+    t.Errorf("parseFfprobeOutput without times or audio: got %+v", *info)
+  }
+
+  // Rotated portrait videos, with the old rotate tag and the newer display matrix.
+  rotated := []string{
+    `{"streams": [{"codec_type": "video", "codec_name": "h264", "width": 1920, "height": 1080,
+        "tags": {"rotate": "90"}}], "format": {}}`,
+    `{"streams": [{"codec_type": "video", "codec_name": "h264", "width": 1920, "height": 1080,
+        "side_data_list": [{"side_data_type": "Display Matrix", "rotation": -90}]}], "format": {}}`,
+  }
+  for _, out := range rotated {
+    info, err = parseFfprobeOutput([]byte(out))
+    if err != nil {
+      t.Fatalf("parseFfprobeOutput failed: %v", err)
+    }
+    if info.Width != 1080 || info.Height != 1920 {
+      t.Errorf("parseFfprobeOutput(%q) size: got %dx%d, want 1080x1920", out, info.Width, info.Height)
+    }
+  }
+  info, err = parseFfprobeOutput([]byte(`{"streams": [{"codec_type": "video", "codec_name": "h264",
+      "width": 1920, "height": 1080, "tags": {"rotate": "180"}}], "format": {}}`))
+  if err != nil || info.Width != 1920 || info.Height != 1080 {
+    t.Errorf("parseFfprobeOutput upside down: got %+v (%v), want 1920x1080", info, err)
+  }
+
+  badOutputs := []string{
+    `not json`,
+    `{"streams": [{"codec_type": "audio", "codec_name": "mp3"}], "format": {"duration": "10.0"}}`,
+  }
+  for _, out := range badOutputs {
+    if _, err := parseFfprobeOutput([]byte(out)); err == nil {
+      t.Errorf("parseFfprobeOutput(%q) should fail", out)
+    }
+  }
+}
+
+func TestListVideo(t *testing.T) {
+  testDir := "testdata/tmp"
+  os.RemoveAll(testDir)
+  if err := os.MkdirAll(testDir, 0744); err != nil {
+    t.Fatalf("Unable to create test directory: %v", err)
+  }
+  defer os.RemoveAll(testDir)
+
+  // Rather than running ffprobe, print the output it would for a video.
+  if err := ioutil.WriteFile(testDir + "/probe.json", []byte(testFfprobeOutput), 0644); err != nil {
+    t.Fatalf("Unable to write test data: %v", err)
+  }
+  fakeFfprobe := "#!/bin/sh\ncat testdata/tmp/probe.json\n"
+  if err := ioutil.WriteFile(testDir + "/ffprobe", []byte(fakeFfprobe), 0755); err != nil {
+    t.Fatalf("Unable to write test script: %v", err)
+  }
+  defer func(command string) { ffprobeCommand = command }(ffprobeCommand)
+  ffprobeCommand = testDir + "/ffprobe"
+  if err := ioutil.WriteFile(testDir + "/clip.mp4", []byte("not really a video"), 0644); err != nil {
+    t.Fatalf("Unable to write test video: %v", err)
+  }
+  if err := os.Symlink("/usr/share/zoneinfo/America/New_York", testDir + "/TZ"); err != nil {
+    t.Fatalf("Unable to create TZ link: %v", err)
+  }
+
+  h := NewHandler(&Config{
+    ContentRoot: testDir,
+  });
+  list, err, _ := h.List("", ListOptions{})
+  if err != nil {
+    t.Fatalf("List failed: %v", err)
+  }
+  var item *ListItem
+  for i := range list.Items {
+    if list.Items[i].Name == "clip.mp4" {
+      item = &list.Items[i]
+    }
+  }
+  if item == nil {
+    t.Fatalf("List does not include the video")
+  }
+  if item.Video == nil {
+    t.Fatalf("List item for the video has no Video info")
+  }
+  if got, want := item.Video.Duration, 42.508; got != want {
+    t.Errorf("Video duration: got %v, want %v", got, want)
+  }
+  // The clock time in New York, like an EXIF DateTime.
+  if got, want := item.ExifDateTime, time.Date(2019, 6, 1, 8, 34, 50, 0, time.Local); !got.Equal(want) {
+    t.Errorf("Video ExifDateTime: got %v, want %v", got, want)
+  }
+  if r := h.catalogRecordForPath("clip.mp4"); r == nil || r.Width != 1920 || r.Height != 1080 {
+    t.Errorf("Catalog record for the video: got %+v, want 1920x1080", r)
+  }
+}
@@ -0,0 +1,236 @@
+package content
+
+import (
+  "errors"
+  "fmt"
+  "log"
+  "os"
+  "path/filepath"
+  "strings"
+  "sync"
+  "syscall"
+  "time"
+  "unsafe"
+)
+
+const (
+  // How long we wait after a change before processing it, so that we
+  // handle a burst of changes (such as copying in a folder of photos)
+  // together rather than one at a time.
+  watchSettleTime = 250 * time.Millisecond
+
+  watchFileMask = syscall.IN_CLOSE_WRITE | syscall.IN_CREATE | syscall.IN_MODIFY |
+      syscall.IN_DELETE | syscall.IN_MOVED_FROM | syscall.IN_MOVED_TO
+)
+
+// watcher uses inotify to watch every directory under the content root,
+// and calls filesChanged for the files that change in each directory.
+type watcher struct {
+  h *Handler
+  root string
+  fd int                // The inotify file descriptor
+  f *os.File            // The same, for reading
+
+  mu sync.Mutex         // Protects the fields below.
+  dirs map[int32]string // Watch descriptor -> directory api path
+  wds map[string]int32  // Directory api path -> watch descriptor
+  pending map[string]map[string]bool    // Dir api path -> changed names
+  created map[string]bool       // Api paths of new files not yet written
+  timer *time.Timer     // Set when we have pending changes
+}
+
+// startWatcher starts watching the content root for changes.
+func (h *Handler) startWatcher() (*watcher, error) {
+  fd, err := syscall.InotifyInit1(syscall.IN_CLOEXEC | syscall.IN_NONBLOCK)
+  if err != nil {
+    return nil, fmt.Errorf("failed to initialize inotify: %v", err)
+  }
+  w := &watcher{
+    h: h,
+    root: filepath.Clean(h.config.ContentRoot),
+    fd: fd,
+    // Because the fd is non-blocking, os.File uses the runtime poller,
+    // so that close will interrupt a read that is waiting for events.
+    f: os.NewFile(uintptr(fd), "inotify"),
+    dirs: make(map[int32]string),
+    wds: make(map[string]int32),
+    pending: make(map[string]map[string]bool),
+    created: make(map[string]bool),
+  }
+  if err := w.addTree(""); err != nil {
+    w.f.Close()
+    return nil, err
+  }
+  log.Printf("Watching %d directories under %s for changes", len(w.dirs), w.root)
+  go w.run()
+  return w, nil
+}
+
+func (w *watcher) close() {
+  w.f.Close()
+}
+
+// addTree adds watches for the directory and all of the directories under
+// it except hidden ones. For a directory other than the root, which we
+// assume is new, we also note all of its files as changed.
+func (w *watcher) addTree(dirApiPath string) error {
+  start := filepath.Join(w.root, dirApiPath)
+  return filepath.Walk(start, func(p string, f os.FileInfo, err error) error {
+    if err != nil {
+      if p == start {
+        return err
+      }
+      return nil
+    }
+    rel, err := filepath.Rel(w.root, p)
+    if err != nil {
+      return nil
+    }
+    apiPath := cleanApiPath(filepath.ToSlash(rel))
+    if !f.IsDir() {
+      if dirApiPath != "" {
+        w.noteChange(cleanApiPath(filepath.ToSlash(filepath.Dir(rel))), f.Name())
+      }
+      return nil
+    }
+    if p != w.root && strings.HasPrefix(f.Name(), ".") {
+      return filepath.SkipDir
+    }
+    wd, err := syscall.InotifyAddWatch(w.fd, p, watchFileMask)
+    if err != nil {
+      log.Printf("Error watching %s: %v", p, err)
+      return nil
+    }
+    w.mu.Lock()
+    w.dirs[int32(wd)] = apiPath
+    w.wds[apiPath] = int32(wd)
+    w.mu.Unlock()
+    return nil
+  })
+}
+
+// removeTree stops watching the directory and all of the directories under it.
+func (w *watcher) removeTree(dirApiPath string) {
+  w.mu.Lock()
+  defer w.mu.Unlock()
+  for apiPath, wd := range w.wds {
+    if apiPath == dirApiPath || strings.HasPrefix(apiPath, dirApiPath + "/") {
+      // This fails if the directory was deleted, but that's fine.
+      syscall.InotifyRmWatch(w.fd, uint32(wd))
+      delete(w.wds, apiPath)
+      delete(w.dirs, wd)
+    }
+  }
+}
+
+// run reads and handles inotify events until the watcher is closed.
+func (w *watcher) run() {
+  buf := make([]byte, 64 * 1024)
+  for {
+    n, err := w.f.Read(buf)
+    if err != nil {
+      if !errors.Is(err, os.ErrClosed) {
+        log.Printf("Error reading inotify events, no longer watching for changes: %v", err)
+      }
+      return
+    }
+    for offset := 0; offset + syscall.SizeofInotifyEvent <= n; {
+      event := (*syscall.InotifyEvent)(unsafe.Pointer(&buf[offset]))
+      nameBytes := buf[offset + syscall.SizeofInotifyEvent : offset + syscall.SizeofInotifyEvent + int(event.Len)]
+      name := strings.TrimRight(string(nameBytes), "\x00")
+      w.handleEvent(event.Wd, event.Mask, name)
+      offset += syscall.SizeofInotifyEvent + int(event.Len)
+    }
+  }
+}
+
+func (w *watcher) handleEvent(wd int32, mask uint32, name string) {
+  if mask & syscall.IN_Q_OVERFLOW != 0 {
+    // We lost track of what changed, so check everything.
+    log.Printf("Inotify queue overflowed, rescanning")
+    go w.h.scanCatalog()
+    w.noteChange("", "")
+    return
+  }
+  w.mu.Lock()
+  dirApiPath, ok := w.dirs[wd]
+  if ok && mask & syscall.IN_IGNORED != 0 {
+    delete(w.dirs, wd)
+    delete(w.wds, dirApiPath)
+  }
+  w.mu.Unlock()
+  if !ok || name == "" || strings.HasPrefix(name, ".") {
+    return
+  }
+  apiPath := cleanApiPath(dirApiPath + "/" + name)
+  if mask & syscall.IN_ISDIR != 0 {
+    if mask & (syscall.IN_CREATE | syscall.IN_MOVED_TO) != 0 {
+      w.addTree(apiPath)
+    } else if mask & (syscall.IN_DELETE | syscall.IN_MOVED_FROM) != 0 {
+      w.removeTree(apiPath)
+    }
+  } else if mask & syscall.IN_CREATE != 0 {
+    w.noteCreate(dirApiPath, name)
+    return
+  } else if mask & syscall.IN_MODIFY != 0 {
+    w.mu.Lock()
+    delete(w.created, apiPath)
+    w.mu.Unlock()
+    return
+  }
+  w.mu.Lock()
+  delete(w.created, apiPath)
+  w.mu.Unlock()
+  w.noteChange(dirApiPath, name)
+}
+
+// noteCreate handles a new file. Usually the file is then written, and we
+// wait for IN_CLOSE_WRITE to note the change. A link (as from ln or cp -l)
+// is complete when it is created and is never written, so if we don't see
+// a write within watchSettleTime, we note the creation as the change.
+func (w *watcher) noteCreate(dirApiPath, name string) {
+  apiPath := cleanApiPath(dirApiPath + "/" + name)
+  w.mu.Lock()
+  w.created[apiPath] = true
+  w.mu.Unlock()
+  time.AfterFunc(watchSettleTime, func() {
+    w.mu.Lock()
+    unwritten := w.created[apiPath]
+    delete(w.created, apiPath)
+    w.mu.Unlock()
+    if unwritten {
+      w.noteChange(dirApiPath, name)
+    }
+  })
+}
+
+// noteChange adds a file to our set of pending changes, and arranges for
+// them to be processed shortly. An empty name notes a change to the
+// directory without naming any files.
+func (w *watcher) noteChange(dirApiPath, name string) {
+  w.mu.Lock()
+  defer w.mu.Unlock()
+  names, ok := w.pending[dirApiPath]
+  if !ok {
+    names = make(map[string]bool)
+    w.pending[dirApiPath] = names
+  }
+  if name != "" {
+    names[name] = true
+  }
+  if w.timer == nil {
+    w.timer = time.AfterFunc(watchSettleTime, w.flush)
+  }
+}
+
+// flush processes all of our pending changes.
+func (w *watcher) flush() {
+  w.mu.Lock()
+  pending := w.pending
+  w.pending = make(map[string]map[string]bool)
+  w.timer = nil
+  w.mu.Unlock()
+  for dirApiPath, names := range pending {
+    w.h.filesChanged(dirApiPath, names)
+  }
+}
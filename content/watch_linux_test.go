@@ -0,0 +1,120 @@
+package content
+
+import (
+  "io/ioutil"
+  "os"
+  "testing"
+  "time"
+)
+
+// waitForChange waits for a change event for the directory.
+func waitForChange(t *testing.T, events <-chan ChangeEvent, dir string) ChangeEvent {
+  t.Helper()
+  timeout := time.After(5 * time.Second)
+  for {
+    select {
+    case event := <-events:
+      if event.Dir == dir {
+        return event
+      }
+    case <-timeout:
+      t.Fatalf("timed out waiting for change event in %q", dir)
+    }
+  }
+}
+
+func TestWatch(t *testing.T) {
+  testDir := "testdata/tmp"
+  os.RemoveAll(testDir)
+  if err := os.MkdirAll(testDir + "/a", 0744); err != nil {
+    t.Fatalf("Unable to create test directory: %v", err)
+  }
+  defer os.RemoveAll(testDir)
+  if err := ioutil.WriteFile(testDir + "/a/one.txt", []byte("apple"), 0644); err != nil {
+    t.Fatalf("Unable to create test text file: %v", err)
+  }
+
+  h := NewHandler(&Config{
+    ContentRoot: testDir,
+    Watch: true,
+  });
+  defer h.StopWatching()
+  if h.watcher == nil {
+    t.Fatalf("handler should be watching")
+  }
+  events, cancel := h.Subscribe()
+  defer cancel()
+
+  // Build the search index before we make changes.
+  if got, want := len(h.searchIndex.search([]string{"apple"})), 1; got != want {
+    t.Fatalf("search result count: got %d, want %d", got, want)
+  }
+
+  if err := writeTestJpeg(testDir + "/a/one.jpg", 20, 10); err != nil {
+    t.Fatalf("Unable to create test image: %v", err)
+  }
+  if err := ioutil.WriteFile(testDir + "/a/one.txt", []byte("banana"), 0644); err != nil {
+    t.Fatalf("Unable to update test text file: %v", err)
+  }
+  event := waitForChange(t, events, "a")
+  if got, want := len(event.Names), 2; got != want {
+    t.Fatalf("changed file count: got %d (%v), want %d", got, event.Names, want)
+  }
+  if got, want := event.Names[0], "one.jpg"; got != want {
+    t.Errorf("changed file: got %s, want %s", got, want)
+  }
+  if r := h.catalog.get("a/one.jpg"); r == nil {
+    t.Errorf("new image should be in the catalog")
+  } else if got, want := r.Text, "banana"; got != want {
+    t.Errorf("catalog text: got %s, want %s", got, want)
+  }
+  if got, want := len(h.searchIndex.search([]string{"banana"})), 1; got != want {
+    t.Errorf("search result count after change: got %d, want %d", got, want)
+  }
+  if got, want := len(h.searchIndex.search([]string{"apple"})), 0; got != want {
+    t.Errorf("search result count for old text: got %d, want %d", got, want)
+  }
+
+  // A new directory should be watched too.
+  if err := os.MkdirAll(testDir + "/a/b", 0744); err != nil {
+    t.Fatalf("Unable to create test directory: %v", err)
+  }
+  waitForChange(t, events, "a")
+  if err := writeTestJpeg(testDir + "/a/b/two.jpg", 20, 10); err != nil {
+    t.Fatalf("Unable to create test image: %v", err)
+  }
+  event = waitForChange(t, events, "a/b")
+  if got, want := event.Names, []string{"two.jpg"}; len(got) != 1 || got[0] != want[0] {
+    t.Errorf("changed files in new dir: got %v, want %v", got, want)
+  }
+
+  // Links are never written, so we only get IN_CREATE for them.
+  if err := os.Link(testDir + "/a/b/two.jpg", testDir + "/a/three.jpg"); err != nil {
+    t.Fatalf("Unable to link test image: %v", err)
+  }
+  event = waitForChange(t, events, "a")
+  if got, want := event.Names, []string{"three.jpg"}; len(got) != 1 || got[0] != want[0] {
+    t.Errorf("changed files after link: got %v, want %v", got, want)
+  }
+  if r := h.catalog.get("a/three.jpg"); r == nil {
+    t.Errorf("linked image should be in the catalog")
+  }
+  if err := os.Symlink("b/two.jpg", testDir + "/a/four.jpg"); err != nil {
+    t.Fatalf("Unable to symlink test image: %v", err)
+  }
+  event = waitForChange(t, events, "a")
+  if got, want := event.Names, []string{"four.jpg"}; len(got) != 1 || got[0] != want[0] {
+    t.Errorf("changed files after symlink: got %v, want %v", got, want)
+  }
+  if r := h.catalog.get("a/four.jpg"); r == nil {
+    t.Errorf("symlinked image should be in the catalog")
+  }
+
+  if err := os.Remove(testDir + "/a/one.jpg"); err != nil {
+    t.Fatalf("Unable to remove test image: %v", err)
+  }
+  waitForChange(t, events, "a")
+  if r := h.catalog.get("a/one.jpg"); r != nil {
+    t.Errorf("removed image should not be in the catalog")
+  }
+}
@@ -0,0 +1,18 @@
+//go:build !linux
+// +build !linux
+
+package content
+
+import (
+  "fmt"
+)
+
+// watcher is only implemented for Linux, where we use inotify.
+type watcher struct {}
+
+func (h *Handler) startWatcher() (*watcher, error) {
+  return nil, fmt.Errorf("watching for changes is not supported on this platform")
+}
+
+func (w *watcher) close() {
+}
@@ -6,7 +6,10 @@ import (
   "log"
   "net/http"
   "os"
+  "path/filepath"
   "strconv"
+  "strings"
+  "time"
 
   "github.com/jimmc/mimsrv/api"
   "github.com/jimmc/mimsrv/auth"
@@ -17,6 +20,14 @@ type config struct {
   port int
   mimViewRoot string
   contentRoot string
+  imageCacheDir string
+  imageCacheSizeMB int
+  catalogFile string
+  catalogScanMinutes int
+  watch bool
+  transcodeWorkers int
+  mediaTypes string
+  maxUploadMB int
   passwordFilePath string
   password string
   maxClockSkewSeconds int
@@ -28,6 +39,14 @@ func main() {
   flag.IntVar(&config.port, "port", 8080, "port on which to listen for connections")
   flag.StringVar(&config.mimViewRoot, "mimviewroot", "", "location of mimview ui root (build/default)")
   flag.StringVar(&config.contentRoot, "contentroot", "", "root directory for content (photos)")
+  flag.StringVar(&config.imageCacheDir, "imagecachedir", "", "directory for cached resized images (default contentroot/.mimcache/images)")
+  flag.IntVar(&config.imageCacheSizeMB, "imagecachesize", 500, "max size in MB of the image cache, 0 to disable")
+  flag.StringVar(&config.catalogFile, "catalogfile", "", "file in which to save file metadata (default contentroot/.mimcache/catalog.json)")
+  flag.IntVar(&config.catalogScanMinutes, "catalogscanminutes", 10, "minutes between background scans for changed files, 0 to scan only on demand")
+  flag.BoolVar(&config.watch, "watch", true, "watch contentroot for changes and notify clients")
+  flag.IntVar(&config.transcodeWorkers, "transcodeworkers", 2, "max number of video transcoding jobs to run at once")
+  flag.StringVar(&config.mediaTypes, "mediatypes", "", "comma-separated list of optional media types to enable (webm, mov, tiff, heic)")
+  flag.IntVar(&config.maxUploadMB, "maxuploadsize", 2048, "max size in MB of one upload request, 0 for no limit")
   flag.StringVar(&config.passwordFilePath, "passwordfile", "", "location of password file")
   flag.StringVar(&config.password, "password", "", "password for update, for testing")
   flag.IntVar(&config.maxClockSkewSeconds, "maxclockskewseconds", 2, "max allowed skew between client and server")
@@ -76,15 +95,30 @@ func main() {
     log.Fatal("--contentroot is required")
   }
 
+  if config.imageCacheDir == "" {
+    config.imageCacheDir = filepath.Join(config.contentRoot, ".mimcache", "images")
+  }
+  if config.catalogFile == "" {
+    config.catalogFile = filepath.Join(config.contentRoot, ".mimcache", "catalog.json")
+  }
+
   mux := http.NewServeMux()
 
   contentHandler := content.NewHandler(&content.Config{
     ContentRoot: config.contentRoot,
+    ImageCacheDir: config.imageCacheDir,
+    ImageCacheMaxBytes: int64(config.imageCacheSizeMB) * 1024 * 1024,
+    CatalogPath: config.catalogFile,
+    CatalogScanInterval: time.Duration(config.catalogScanMinutes) * time.Minute,
+    Watch: config.watch,
+    JobWorkers: config.transcodeWorkers,
+    MediaTypes: strings.Split(config.mediaTypes, ","),
   })
   uiFileHandler := http.FileServer(http.Dir(config.mimViewRoot))
   apiHandler := api.NewHandler(&api.Config{
     Prefix: "/api/",
     ContentHandler: contentHandler,
+    MaxUploadBytes: int64(config.maxUploadMB) * 1024 * 1024,
   })
   mux.Handle("/ui/", http.StripPrefix("/ui/", uiFileHandler))
   mux.Handle("/api/", authHandler.RequireAuth(apiHandler))
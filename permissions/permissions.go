@@ -9,6 +9,8 @@ const permSepChar = " "
 type Permission int
 const (
   CanEdit Permission = iota +1
+  CanUpload
+  CanAdmin
 )
 
 type Permissions struct {
@@ -49,6 +51,12 @@ func permFromString(s string) Permission {
   if s == "edit" {
     return CanEdit
   }
+  if s == "upload" {
+    return CanUpload
+  }
+  if s == "admin" {
+    return CanAdmin
+  }
   return 0      // No valid permission string found
 }
 
@@ -56,5 +64,11 @@ func permToString(perm Permission) string {
   if perm == CanEdit {
     return "edit"
   }
+  if perm == CanUpload {
+    return "upload"
+  }
+  if perm == CanAdmin {
+    return "admin"
+  }
   return ""
 }
@@ -20,4 +20,28 @@ func TestFromString(t *testing.T) {
   if !p.HasPermission(CanEdit) {
     t.Errorf("'edit' string fails to give CanEdit permission")
   }
+
+  if p.HasPermission(CanUpload) {
+    t.Errorf("'edit' string should not give CanUpload permission")
+  }
+
+  p = FromString("edit upload")
+  if got, want := len(p.perms), 2; got != want {
+    t.Errorf("Number of permissions in 'edit upload' string: got %d, want %d", got, want)
+  }
+  if !p.HasPermission(CanUpload) {
+    t.Errorf("'edit upload' string fails to give CanUpload permission")
+  }
+
+  if p.HasPermission(CanAdmin) {
+    t.Errorf("'edit upload' string should not give CanAdmin permission")
+  }
+
+  p = FromString("admin")
+  if !p.HasPermission(CanAdmin) {
+    t.Errorf("'admin' string fails to give CanAdmin permission")
+  }
+  if got, want := p.ToString(), "admin"; got != want {
+    t.Errorf("ToString of 'admin' permissions: got %q, want %q", got, want)
+  }
 }